@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
 	"flag"
 	"fmt"
 	"github.com/caarlos0/env/v6"
 	"github.com/rs/zerolog"
 	"github.com/smamykin/smetrics/internal/agent"
 	"github.com/smamykin/smetrics/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,14 +25,71 @@ type Config struct {
 	ReportInterval time.Duration `env:"REPORT_INTERVAL"`
 	PollInterval   time.Duration `env:"POLL_INTERVAL"`
 	Key            string        `env:"KEY"`
+	KeyID          string        `env:"KEY_ID"`
+	Labels         string        `env:"LABELS"`
+	// HostLabel adds the host=<hostname> label to every metric unless the Labels override it.
+	// Disabling it changes the identity of the series on the server, they start over without the label
+	HostLabel bool `env:"HOST_LABEL"`
+	// HistogramBounds are the upper bounds of the buckets of the histograms, e.g. 0.1,0.5,1
+	HistogramBounds string `env:"HISTOGRAM_BOUNDS"`
+	// GaugeAggregates are reported for every gauge in addition to the last value, e.g. min,max,avg
+	GaugeAggregates string `env:"GAUGE_AGGREGATES"`
+	// Collectors are the enabled collectors with their intervals and timeouts, see agent.ParseCollectorSpecs.
+	// The host and process collectors read the proc filesystem at ProcPath,
+	// the host collector reports the usage of the file systems of the comma separated MountPoints
+	Collectors  string `env:"COLLECTORS"`
+	ProcPath    string `env:"PROC_PATH"`
+	MountPoints string `env:"MOUNT_POINTS"`
+	// the retries of the failed sending, see agent.RetryPolicy
+	RetryInitialInterval time.Duration `env:"RETRY_INITIAL_INTERVAL"`
+	RetryMaxInterval     time.Duration `env:"RETRY_MAX_INTERVAL"`
+	RetryMaxElapsedTime  time.Duration `env:"RETRY_MAX_ELAPSED_TIME"`
+	// CryptoKey is the path of the PEM public key of the server to encrypt the metrics with
+	CryptoKey string `env:"CRYPTO_KEY"`
+	// RateLimit is the maximum number of the concurrent requests to the server
+	RateLimit int `env:"RATE_LIMIT"`
+	// CompressThreshold is the size of the batch in bytes from which it's compressed, the negative one disables the compression
+	CompressThreshold int `env:"COMPRESS_THRESHOLD"`
+	// Transport is how the metrics are sent, http for the JSON API or grpc for the gRPC service at Address
+	Transport string `env:"TRANSPORT"`
+	// ShutdownTimeout is how long to wait for the final report on shutdown
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	// SpoolDir is the directory where the metrics which failed to be sent are kept until the server is back,
+	// the spool is disabled if empty
+	SpoolDir     string `env:"SPOOL_DIR"`
+	SpoolMaxSize int64  `env:"SPOOL_MAX_SIZE"`
 }
 
 const (
-	defaultAddress        = "http://localhost:8080"
-	defaultReportInterval = time.Second * 10
-	defaultPollInterval   = time.Second * 2
-	defaultSchema         = "http://"
-	defaultKey            = ""
+	defaultAddress         = "http://localhost:8080"
+	defaultReportInterval  = time.Second * 10
+	defaultPollInterval    = time.Second * 2
+	defaultSchema          = "http://"
+	defaultKey             = ""
+	defaultKeyID           = ""
+	defaultLabels          = ""
+	defaultHostLabel       = true
+	defaultHistogramBound  = ""
+	defaultGaugeAggregate  = ""
+	defaultCollectors      = "runtime"
+	defaultProcPath        = "/proc"
+	defaultMountPoints     = "/"
+	defaultRetryInitial    = time.Second
+	defaultRetryMax        = time.Second * 5
+	defaultRetryElapsed    = time.Second * 30
+	defaultCryptoKey       = ""
+	defaultRateLimit       = 1
+	defaultSendQueueSize   = 100
+	defaultShutdownTimeout = time.Second * 10
+	defaultTransport       = transportHTTP
+	defaultCompress        = 1024
+	defaultSpoolDir        = ""
+	defaultSpoolMaxSize    = 10 << 20
+)
+
+const (
+	transportHTTP = "http"
+	transportGRPC = "grpc"
 )
 
 var logger = zerolog.New(os.Stdout)
@@ -35,6 +99,24 @@ func main() {
 	reportInterval := flag.Duration("r", defaultReportInterval, "How often to send metrics to server")
 	pollInterval := flag.Duration("p", defaultPollInterval, "How often to refresh metrics")
 	key := flag.String("k", defaultKey, "The secret key")
+	keyID := flag.String("key-id", defaultKeyID, "The id of the secret key, the server verifies the signs with the key of this id")
+	labels := flag.String("l", defaultLabels, "The labels of the metrics in the format key1=value1,key2=value2")
+	hostLabel := flag.Bool("host-label", defaultHostLabel, "Whether to add the host=<hostname> label to the metrics")
+	histogramBounds := flag.String("b", defaultHistogramBound, "The comma separated upper bounds of the buckets of the histograms")
+	gaugeAggregates := flag.String("g", defaultGaugeAggregate, "The comma separated aggregates of the gauges reported in addition to the last value: min, max, avg")
+	collectors := flag.String("c", defaultCollectors, "The comma separated collectors in the format name[:interval[:timeout]], the built-in collectors are runtime, host and process, the others are added with agent.RegisterProvider")
+	procPath := flag.String("proc-path", defaultProcPath, "The path of the proc filesystem")
+	mountPoints := flag.String("mount-points", defaultMountPoints, "The comma separated mount points to report the usage of")
+	retryInitialInterval := flag.Duration("retry-initial-interval", defaultRetryInitial, "How long to wait before the first retry of the failed sending")
+	retryMaxInterval := flag.Duration("retry-max-interval", defaultRetryMax, "The maximum interval between the retries")
+	retryMaxElapsedTime := flag.Duration("retry-max-elapsed-time", defaultRetryElapsed, "How long to retry the sending before the metrics are dropped, 0 disables the retries")
+	cryptoKey := flag.String("crypto-key", defaultCryptoKey, "The path of the PEM public key of the server to encrypt the metrics with")
+	rateLimit := flag.Int("rate-limit", defaultRateLimit, "The maximum number of the concurrent requests to the server")
+	compressThreshold := flag.Int("compress-threshold", defaultCompress, "The size of the batch in bytes from which it's compressed, -1 to disable the compression")
+	transport := flag.String("transport", defaultTransport, "How to send the metrics, http or grpc")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout, "How long to wait for the final report on shutdown")
+	spoolDir := flag.String("spool-dir", defaultSpoolDir, "The directory to keep the metrics which failed to be sent, empty disables the spool")
+	spoolMaxSize := flag.Int64("spool-max-size", defaultSpoolMaxSize, "The maximum size of the spool in bytes, the oldest metrics are dropped when it's full")
 	flag.Parse()
 
 	var cfg Config
@@ -55,17 +137,240 @@ func main() {
 	if _, isPresent := os.LookupEnv("KEY"); !isPresent {
 		cfg.Key = *key
 	}
+	if _, isPresent := os.LookupEnv("KEY_ID"); !isPresent {
+		cfg.KeyID = *keyID
+	}
+	if _, isPresent := os.LookupEnv("LABELS"); !isPresent {
+		cfg.Labels = *labels
+	}
+	if _, isPresent := os.LookupEnv("HOST_LABEL"); !isPresent {
+		cfg.HostLabel = *hostLabel
+	}
+	if _, isPresent := os.LookupEnv("HISTOGRAM_BOUNDS"); !isPresent {
+		cfg.HistogramBounds = *histogramBounds
+	}
+	if _, isPresent := os.LookupEnv("GAUGE_AGGREGATES"); !isPresent {
+		cfg.GaugeAggregates = *gaugeAggregates
+	}
+	if _, isPresent := os.LookupEnv("COLLECTORS"); !isPresent {
+		cfg.Collectors = *collectors
+	}
+	if _, isPresent := os.LookupEnv("PROC_PATH"); !isPresent {
+		cfg.ProcPath = *procPath
+	}
+	if _, isPresent := os.LookupEnv("MOUNT_POINTS"); !isPresent {
+		cfg.MountPoints = *mountPoints
+	}
+	if _, isPresent := os.LookupEnv("RETRY_INITIAL_INTERVAL"); !isPresent {
+		cfg.RetryInitialInterval = *retryInitialInterval
+	}
+	if _, isPresent := os.LookupEnv("RETRY_MAX_INTERVAL"); !isPresent {
+		cfg.RetryMaxInterval = *retryMaxInterval
+	}
+	if _, isPresent := os.LookupEnv("RETRY_MAX_ELAPSED_TIME"); !isPresent {
+		cfg.RetryMaxElapsedTime = *retryMaxElapsedTime
+	}
+	if _, isPresent := os.LookupEnv("CRYPTO_KEY"); !isPresent {
+		cfg.CryptoKey = *cryptoKey
+	}
+	if _, isPresent := os.LookupEnv("RATE_LIMIT"); !isPresent {
+		cfg.RateLimit = *rateLimit
+	}
+	if _, isPresent := os.LookupEnv("COMPRESS_THRESHOLD"); !isPresent {
+		cfg.CompressThreshold = *compressThreshold
+	}
+	if _, isPresent := os.LookupEnv("TRANSPORT"); !isPresent {
+		cfg.Transport = *transport
+	}
+	if _, isPresent := os.LookupEnv("SHUTDOWN_TIMEOUT"); !isPresent {
+		cfg.ShutdownTimeout = *shutdownTimeout
+	}
+	if _, isPresent := os.LookupEnv("SPOOL_DIR"); !isPresent {
+		cfg.SpoolDir = *spoolDir
+	}
+	if _, isPresent := os.LookupEnv("SPOOL_MAX_SIZE"); !isPresent {
+		cfg.SpoolMaxSize = *spoolMaxSize
+	}
 
 	if strings.Index(cfg.Address, "http") != 0 {
 		cfg.Address = defaultSchema + cfg.Address
 	}
 
-	fmt.Printf("Starting the agent. The configuration: %#v", cfg)
+	metricLabels, err := getMetricLabels(cfg.Labels, cfg.HostLabel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var bounds []float64
+	if cfg.HistogramBounds != "" {
+		bounds, err = utils.ParseHistogramBounds(cfg.HistogramBounds)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	aggregates, err := agent.ParseGaugeAggregates(cfg.GaugeAggregates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var publicKey *rsa.PublicKey
+	if cfg.CryptoKey != "" {
+		publicKey, err = utils.LoadPublicKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	printedCfg := cfg
+	if printedCfg.Key != "" {
+		printedCfg.Key = "[REDACTED]"
+	}
+	fmt.Printf("Starting the agent. The configuration: %#v", printedCfg)
+
+	// the server may accept the metrics only from the trusted subnets
+	realIP, err := agent.OutboundIP(cfg.Address)
+	if err != nil {
+		logger.Warn().Err(err).Msg("The X-Real-IP header is not sent")
+	}
+	retryPolicy := agent.NewRetryPolicy(cfg.RetryInitialInterval, cfg.RetryMaxInterval, cfg.RetryMaxElapsedTime)
+	clientOptions := []agent.ClientOption{
+		agent.WithKeyID(cfg.KeyID),
+		agent.WithRealIP(realIP),
+		agent.WithCompressionThreshold(cfg.CompressThreshold),
+	}
+	var client agent.IClient
+	switch cfg.Transport {
+	case transportHTTP:
+		client = agent.NewClient(&logger, cfg.Address, cfg.Key, metricLabels, retryPolicy, publicKey, clientOptions...)
+	case transportGRPC:
+		if publicKey != nil {
+			log.Fatal("the encryption with CRYPTO_KEY isn't supported by the grpc transport")
+		}
+		target, err := url.Parse(cfg.Address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err := grpc.Dial(target.Host, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		client = agent.NewGRPCClient(&logger, conn, cfg.Key, metricLabels, retryPolicy, clientOptions...)
+	default:
+		log.Fatalf("unknown transport %q, http or grpc is expected", cfg.Transport)
+	}
+	if cfg.SpoolDir != "" {
+		spool, err := agent.NewSpool(cfg.SpoolDir, cfg.SpoolMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client = agent.NewSpoolingClient(&logger, client, spool)
+	}
+	sender, err := agent.NewSender(&logger, client, cfg.RateLimit, defaultSendQueueSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the retries of the queued batches are abandoned when the final report doesn't fit into the shutdown timeout
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+	sender.Start(sendCtx)
+
+	registry, err := newCollectorRegistry(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	metricAgent := agent.MetricAgent{
-		Client:   agent.NewClient(&logger, cfg.Address, cfg.Key),
-		Provider: &agent.MetricProvider{},
+		Client:          sender,
+		HistogramBounds: bounds,
+		GaugeAggregates: aggregates,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	collected := make(chan struct{})
+	go func() {
+		registry.Run(ctx, &metricAgent)
+		close(collected)
+	}()
+	utils.InvokeFunctionWithInterval(ctx, cfg.ReportInterval, metricAgent.SendMetrics)
+
+	logger.Info().Msg("Shutting down the agent, sending the final report")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = utils.InvokeFunctionWithDeadline(shutdownCtx, func() error {
+		<-collected
+		metricAgent.SendMetrics()
+		sender.Close()
+		return nil
+	})
+	if err != nil {
+		cancelSend()
+		logger.Error().Err(err).Msg("Cannot send the final report")
+	}
+}
+
+// newCollectorRegistry registers the configured collectors, the providers are created by the factories
+// registered with agent.RegisterProvider.
+func newCollectorRegistry(cfg Config) (*agent.CollectorRegistry, error) {
+	specs, err := agent.ParseCollectorSpecs(cfg.Collectors, cfg.PollInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	providerConfig := agent.ProviderConfig{
+		ProcPath:    cfg.ProcPath,
+		MountPoints: splitList(cfg.MountPoints),
+	}
+	registry := agent.NewCollectorRegistry()
+	for _, spec := range specs {
+		provider, err := agent.NewProvider(spec.Name, providerConfig)
+		if err != nil {
+			return nil, err
+		}
+		err = registry.Register(agent.Collector{
+			Name:     spec.Name,
+			Provider: provider,
+			Interval: spec.Interval,
+			Timeout:  spec.Timeout,
+			Enabled:  true,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// getMetricLabels returns the automatic host labels, if enabled, overridden by the configured ones.
+func getMetricLabels(configured string, isHostLabel bool) (map[string]string, error) {
+	labels := map[string]string{}
+	if hostname, err := os.Hostname(); isHostLabel && err == nil && hostname != "" {
+		labels["host"] = hostname
+	}
+
+	parsed, err := utils.ParseLabels(configured)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range parsed {
+		labels[key] = value
+	}
+
+	return labels, nil
+}
+
+// splitList splits the comma separated list and skips the empty items
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
 	}
 
-	go utils.InvokeFunctionWithInterval(cfg.PollInterval, metricAgent.GatherMetrics)
-	utils.InvokeFunctionWithInterval(cfg.ReportInterval, metricAgent.SendMetrics)
+	return result
 }
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/caarlos0/env/v6"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/server/graphite"
+	"github.com/smamykin/smetrics/internal/server/grpcserver"
 	"github.com/smamykin/smetrics/internal/server/handlers"
 	"github.com/smamykin/smetrics/internal/server/server"
+	"github.com/smamykin/smetrics/internal/server/statsd"
 	"github.com/smamykin/smetrics/internal/server/storage"
 	"github.com/smamykin/smetrics/internal/utils"
+	"google.golang.org/grpc"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,18 +35,69 @@ type Config struct {
 	StoreFile     string        `env:"STORE_FILE"`
 	StoreInterval time.Duration `env:"STORE_INTERVAL"`
 	Key           string        `env:"KEY"`
-	DatabaseDsn   string        `env:"DATABASE_DSN"`
+	KeyID         string        `env:"KEY_ID"`
+	// PreviousKeys are the keys the agents may still sign with, in the format id:key[,id:key...]
+	PreviousKeys          string        `env:"PREVIOUS_KEYS"`
+	DatabaseDsn           string        `env:"DATABASE_DSN"`
+	History               bool          `env:"HISTORY"`
+	HistorySize           int           `env:"HISTORY_SIZE"`
+	Rollups               string        `env:"ROLLUPS"`
+	RollupCleanupInterval time.Duration `env:"ROLLUP_CLEANUP_INTERVAL"`
+	// CryptoKey is the path of the PEM private key to decrypt the metrics with, the unencrypted metrics are rejected if set
+	CryptoKey string `env:"CRYPTO_KEY"`
+	// TrustedSubnet are the comma separated subnets in the CIDR notation the metrics are accepted from, any if empty.
+	// The address reported by the agent in X-Real-IP is checked, and the address of the connection
+	// if TrustedSubnetCheckRemoteAddr is set
+	TrustedSubnet                string `env:"TRUSTED_SUBNET"`
+	TrustedSubnetCheckRemoteAddr bool   `env:"TRUSTED_SUBNET_CHECK_REMOTE_ADDR"`
+	// GRPCAddress is the address of the gRPC service, it isn't served if empty
+	GRPCAddress string `env:"GRPC_ADDRESS"`
+	// StatsdUDPAddress and StatsdTCPAddress are the addresses of the StatsD listener, it isn't started if both are empty.
+	// The received samples are written to the storage every StatsdFlushInterval
+	StatsdUDPAddress     string        `env:"STATSD_UDP_ADDRESS"`
+	StatsdTCPAddress     string        `env:"STATSD_TCP_ADDRESS"`
+	StatsdFlushInterval  time.Duration `env:"STATSD_FLUSH_INTERVAL"`
+	StatsdMaxConnections int           `env:"STATSD_MAX_CONNECTIONS"`
+	StatsdIdleTimeout    time.Duration `env:"STATSD_IDLE_TIMEOUT"`
+	// GraphiteAddress is the TCP address of the Graphite plaintext listener, it isn't started if empty
+	GraphiteAddress        string        `env:"GRAPHITE_ADDRESS"`
+	GraphiteMaxConnections int           `env:"GRAPHITE_MAX_CONNECTIONS"`
+	GraphiteMaxLineSize    int           `env:"GRAPHITE_MAX_LINE_SIZE"`
+	GraphiteIdleTimeout    time.Duration `env:"GRAPHITE_IDLE_TIMEOUT"`
+	// OTLPNamePrefixAttributes are the comma separated resource attributes of OTLP, whose values prefix the names
+	// of the metrics, e.g. service.name. The other attributes become the labels
+	OTLPNamePrefixAttributes string `env:"OTLP_NAME_PREFIX_ATTRIBUTES"`
+	// ShutdownTimeout is how long to wait for the in-flight requests and the closing of the storage on shutdown
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
 }
 
 const (
-	defaultAddress       = "localhost:8080"
-	defaultRestore       = true
-	defaultStoreFile     = "/tmp/devops-metrics-db.json"
-	defaultStoreInterval = time.Second * 300
-	defaultKey           = ""
-	defaultDatabaseDsn   = ""
+	defaultAddress                  = "localhost:8080"
+	defaultRestore                  = true
+	defaultStoreFile                = "/tmp/devops-metrics-db.json"
+	defaultStoreInterval            = time.Second * 300
+	defaultKey                      = ""
+	defaultKeyID                    = ""
+	defaultPreviousKeys             = ""
+	defaultDatabaseDsn              = ""
+	defaultHistory                  = false
+	defaultHistorySize              = 1000
+	defaultRollups                  = ""
+	defaultRollupCleanupInterval    = time.Minute
+	defaultCryptoKey                = ""
+	defaultShutdownTimeout          = time.Second * 10
+	defaultTrustedSubnet            = ""
+	defaultGRPCAddress              = ""
+	defaultStatsdUDPAddress         = ""
+	defaultStatsdTCPAddress         = ""
+	defaultStatsdFlushInterval      = time.Second * 10
+	defaultGraphiteAddress          = ""
+	defaultOTLPNamePrefixAttributes = ""
 )
 
+// keyUsesInterval is how often the uses of the keys are recorded to the HashKeyUses counter
+const keyUsesInterval = time.Minute
+
 var logger = zerolog.New(os.Stdout)
 
 func main() {
@@ -45,7 +107,28 @@ func main() {
 	storeFile := flag.String("f", defaultStoreFile, "the absolute path to the dump file.")
 	storeInterval := flag.Duration("i", defaultStoreInterval, "How often to save the dump of the metrics")
 	key := flag.String("k", defaultKey, "The secret key")
+	keyID := flag.String("key-id", defaultKeyID, "The id of the secret key")
+	previousKeys := flag.String("previous-keys", defaultPreviousKeys, "The keys the agents may still sign with, e.g. v1:secret1,v2:secret2")
 	databaseDsn := flag.String("d", defaultDatabaseDsn, "The database url")
+	history := flag.Bool("history", defaultHistory, "To record every update of the metrics")
+	historySize := flag.Int("history-size", defaultHistorySize, "How many samples of every metric to keep in memory")
+	rollups := flag.String("rollups", defaultRollups, "The resolutions of the rollups and their retention, e.g. 1m:24h,1h:720h,24h:8760h")
+	rollupCleanupInterval := flag.Duration("rollup-cleanup-interval", defaultRollupCleanupInterval, "How often to remove the rollups older than their retention")
+	cryptoKey := flag.String("crypto-key", defaultCryptoKey, "The path of the PEM private key to decrypt the metrics with")
+	trustedSubnet := flag.String("t", defaultTrustedSubnet, "The subnets the metrics are accepted from, e.g. 10.0.0.0/8,192.168.0.0/16")
+	trustedSubnetCheckRemoteAddr := flag.Bool("trusted-subnet-check-remote-addr", false, "To check that the address of the connection belongs to the trusted subnets as well")
+	grpcAddress := flag.String("grpc-address", defaultGRPCAddress, "The address of the gRPC service, e.g. localhost:3200")
+	statsdUDPAddress := flag.String("statsd-udp-address", defaultStatsdUDPAddress, "The UDP address of the StatsD listener, e.g. localhost:8125")
+	statsdTCPAddress := flag.String("statsd-tcp-address", defaultStatsdTCPAddress, "The TCP address of the StatsD listener, e.g. localhost:8125")
+	statsdFlushInterval := flag.Duration("statsd-flush-interval", defaultStatsdFlushInterval, "How often to write the StatsD metrics to the storage")
+	statsdMaxConnections := flag.Int("statsd-max-connections", statsd.DefaultLimits.MaxConnections, "How many StatsD TCP connections are served at once")
+	statsdIdleTimeout := flag.Duration("statsd-idle-timeout", statsd.DefaultLimits.IdleTimeout, "How long to wait for the next StatsD line before closing the TCP connection")
+	graphiteAddress := flag.String("graphite-address", defaultGraphiteAddress, "The TCP address of the Graphite plaintext listener, e.g. localhost:2003")
+	graphiteMaxConnections := flag.Int("graphite-max-connections", graphite.DefaultLimits.MaxConnections, "How many Graphite connections are served at once")
+	graphiteMaxLineSize := flag.Int("graphite-max-line-size", graphite.DefaultLimits.MaxLineSize, "The longest Graphite line in bytes")
+	graphiteIdleTimeout := flag.Duration("graphite-idle-timeout", graphite.DefaultLimits.IdleTimeout, "How long to wait for the next Graphite line before closing the connection")
+	otlpNamePrefixAttributes := flag.String("otlp-name-prefix-attributes", defaultOTLPNamePrefixAttributes, "The resource attributes of OTLP which prefix the names of the metrics, e.g. service.name")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout, "How long to wait for the in-flight requests and the closing of the storage on shutdown")
 	flag.Parse()
 
 	var cfg Config
@@ -69,66 +152,377 @@ func main() {
 	if _, isPresent := os.LookupEnv("KEY"); !isPresent {
 		cfg.Key = *key
 	}
+	if _, isPresent := os.LookupEnv("KEY_ID"); !isPresent {
+		cfg.KeyID = *keyID
+	}
+	if _, isPresent := os.LookupEnv("PREVIOUS_KEYS"); !isPresent {
+		cfg.PreviousKeys = *previousKeys
+	}
 	if _, isPresent := os.LookupEnv("DATABASE_DSN"); !isPresent {
 		cfg.DatabaseDsn = *databaseDsn
 	}
+	if _, isPresent := os.LookupEnv("HISTORY"); !isPresent {
+		cfg.History = *history
+	}
+	if _, isPresent := os.LookupEnv("HISTORY_SIZE"); !isPresent {
+		cfg.HistorySize = *historySize
+	}
+	if _, isPresent := os.LookupEnv("ROLLUPS"); !isPresent {
+		cfg.Rollups = *rollups
+	}
+	if _, isPresent := os.LookupEnv("ROLLUP_CLEANUP_INTERVAL"); !isPresent {
+		cfg.RollupCleanupInterval = *rollupCleanupInterval
+	}
+	if _, isPresent := os.LookupEnv("CRYPTO_KEY"); !isPresent {
+		cfg.CryptoKey = *cryptoKey
+	}
+	if _, isPresent := os.LookupEnv("TRUSTED_SUBNET"); !isPresent {
+		cfg.TrustedSubnet = *trustedSubnet
+	}
+	if _, isPresent := os.LookupEnv("TRUSTED_SUBNET_CHECK_REMOTE_ADDR"); !isPresent {
+		cfg.TrustedSubnetCheckRemoteAddr = *trustedSubnetCheckRemoteAddr
+	}
+	if _, isPresent := os.LookupEnv("GRPC_ADDRESS"); !isPresent {
+		cfg.GRPCAddress = *grpcAddress
+	}
+	if _, isPresent := os.LookupEnv("STATSD_UDP_ADDRESS"); !isPresent {
+		cfg.StatsdUDPAddress = *statsdUDPAddress
+	}
+	if _, isPresent := os.LookupEnv("STATSD_TCP_ADDRESS"); !isPresent {
+		cfg.StatsdTCPAddress = *statsdTCPAddress
+	}
+	if _, isPresent := os.LookupEnv("STATSD_FLUSH_INTERVAL"); !isPresent {
+		cfg.StatsdFlushInterval = *statsdFlushInterval
+	}
+	if _, isPresent := os.LookupEnv("STATSD_MAX_CONNECTIONS"); !isPresent {
+		cfg.StatsdMaxConnections = *statsdMaxConnections
+	}
+	if _, isPresent := os.LookupEnv("STATSD_IDLE_TIMEOUT"); !isPresent {
+		cfg.StatsdIdleTimeout = *statsdIdleTimeout
+	}
+	if _, isPresent := os.LookupEnv("GRAPHITE_ADDRESS"); !isPresent {
+		cfg.GraphiteAddress = *graphiteAddress
+	}
+	if _, isPresent := os.LookupEnv("GRAPHITE_MAX_CONNECTIONS"); !isPresent {
+		cfg.GraphiteMaxConnections = *graphiteMaxConnections
+	}
+	if _, isPresent := os.LookupEnv("GRAPHITE_MAX_LINE_SIZE"); !isPresent {
+		cfg.GraphiteMaxLineSize = *graphiteMaxLineSize
+	}
+	if _, isPresent := os.LookupEnv("GRAPHITE_IDLE_TIMEOUT"); !isPresent {
+		cfg.GraphiteIdleTimeout = *graphiteIdleTimeout
+	}
+	if _, isPresent := os.LookupEnv("OTLP_NAME_PREFIX_ATTRIBUTES"); !isPresent {
+		cfg.OTLPNamePrefixAttributes = *otlpNamePrefixAttributes
+	}
+	if _, isPresent := os.LookupEnv("SHUTDOWN_TIMEOUT"); !isPresent {
+		cfg.ShutdownTimeout = *shutdownTimeout
+	}
+
+	rollupPolicies, err := storage.ParseRollupPolicies(cfg.Rollups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.History && cfg.HistorySize <= 0 {
+		log.Fatal("HISTORY_SIZE must be positive")
+	}
+	if len(rollupPolicies) != 0 && cfg.RollupCleanupInterval <= 0 {
+		log.Fatal("ROLLUP_CLEANUP_INTERVAL must be positive")
+	}
 
-	fmt.Printf("Starting the server. The configuration: %#v\n", cfg)
+	if cfg.GRPCAddress != "" && cfg.CryptoKey != "" {
+		log.Fatal("the encryption with CRYPTO_KEY isn't supported by the gRPC service")
+	}
+
+	var serverOptions []server.Option
+	var grpcOptions []grpcserver.Option
+	if cfg.CryptoKey != "" {
+		privateKey, err := utils.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverOptions = append(serverOptions, server.WithPrivateKey(privateKey))
+	}
+	trustedSubnets, err := utils.ParseTrustedSubnets(cfg.TrustedSubnet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(trustedSubnets) != 0 {
+		serverOptions = append(serverOptions, server.WithTrustedSubnets(trustedSubnets, cfg.TrustedSubnetCheckRemoteAddr))
+		grpcOptions = append(grpcOptions, grpcserver.WithTrustedSubnets(trustedSubnets, cfg.TrustedSubnetCheckRemoteAddr))
+	}
+
+	var namePrefixAttributes []string
+	for _, attribute := range strings.Split(cfg.OTLPNamePrefixAttributes, ",") {
+		if attribute = strings.TrimSpace(attribute); attribute != "" {
+			namePrefixAttributes = append(namePrefixAttributes, attribute)
+		}
+	}
+	if len(namePrefixAttributes) != 0 {
+		serverOptions = append(serverOptions, server.WithOTLPNamePrefixAttributes(namePrefixAttributes))
+	}
+
+	var keyring *utils.Keyring
+	if cfg.Key != "" {
+		keyring = utils.NewKeyring(cfg.KeyID, cfg.Key)
+		if err = keyring.AddKeys(cfg.PreviousKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("Starting the server. The configuration: %#v\n", cfg.redacted())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 
 	r := chi.NewRouter()
 
 	var repository handlers.IRepository
+	var closeStorage func() error
 	if cfg.DatabaseDsn != "" {
-		repository, err = createDBStorage(cfg)
+		repository, closeStorage, err = createDBStorage(ctx, cfg, rollupPolicies)
 		if err != nil {
 			logger.Error().Msgf("Cannot connect to db. Error: %s\n", err.Error())
 			return
 		}
 	} else {
-		repository, err = createMemStorage(cfg)
+		repository, closeStorage, err = createMemStorage(ctx, cfg, rollupPolicies)
 		if err != nil {
 			logger.Error().Msgf("Cannot create memStorage. Error: %s\n", err.Error())
 			return
 		}
 	}
 
-	if cfg.Key == "" {
-		err = http.ListenAndServe(cfg.Address, server.AddHandlers(r, repository, nil))
-	} else {
-		err = http.ListenAndServe(cfg.Address, server.AddHandlers(r, repository, utils.NewHashGenerator(cfg.Key)))
+	var hashGenerator handlers.IHashGenerator
+	if keyring != nil {
+		hashGenerator = keyring
+		go utils.InvokeFunctionWithInterval(ctx, keyUsesInterval, getRecordKeyUsesFunction(keyring, repository))
+	}
+	httpServer := &http.Server{
+		Addr:    cfg.Address,
+		Handler: server.AddHandlers(r, repository, hashGenerator, serverOptions...),
+	}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("")
+			stop()
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		grpcServer = grpcserver.NewServer(repository, hashGenerator, grpcOptions...)
+		listener, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			logger.Error().Err(err).Msg("Cannot listen to the gRPC address")
+			return
+		}
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				logger.Error().Err(err).Msg("")
+				stop()
+			}
+		}()
+	}
+
+	stopStatsd, err := startStatsd(ctx, cfg, repository, trustedSubnets)
+	if err != nil {
+		logger.Error().Err(err).Msg("Cannot start the StatsD listener")
+		return
+	}
+	stopGraphite, err := startGraphite(cfg, repository, trustedSubnets)
+	if err != nil {
+		logger.Error().Err(err).Msg("Cannot start the Graphite listener")
+		return
+	}
+
+	<-ctx.Done()
+	logger.Info().Msg("Shutting down the server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err = httpServer.Shutdown(shutdownCtx); err != nil {
+		logger.Error().Err(err).Msg("Cannot drain the in-flight requests")
+	}
+	if grpcServer != nil {
+		err = utils.InvokeFunctionWithDeadline(shutdownCtx, func() error {
+			grpcServer.GracefulStop()
+			return nil
+		})
+		if err != nil {
+			logger.Error().Err(err).Msg("Cannot drain the in-flight RPCs")
+			grpcServer.Stop()
+		}
+	}
+	if err = utils.InvokeFunctionWithDeadline(shutdownCtx, stopStatsd); err != nil {
+		logger.Error().Err(err).Msg("Cannot flush the StatsD metrics")
+	}
+	if err = utils.InvokeFunctionWithDeadline(shutdownCtx, stopGraphite); err != nil {
+		logger.Error().Err(err).Msg("Cannot close the Graphite connections")
 	}
+	if err = utils.InvokeFunctionWithDeadline(shutdownCtx, closeStorage); err != nil {
+		logger.Error().Err(err).Msg("Cannot close the storage")
+	}
+}
 
-	logger.Error().Err(err).Msg("")
+// startStatsd starts the StatsD listener if any of its addresses is set. The returned function closes the sockets
+// and the connections, and flushes the samples received since the last flush.
+// redactedValue replaces the secrets in the printed configuration
+const redactedValue = "[REDACTED]"
+
+// redacted returns the configuration safe to print, the keys are replaced, only the ids of the previous keys are kept
+func (c Config) redacted() Config {
+	if c.Key != "" {
+		c.Key = redactedValue
+	}
+
+	var previousKeys []string
+	for _, item := range strings.Split(c.PreviousKeys, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		keyID, _, _ := strings.Cut(item, ":")
+		previousKeys = append(previousKeys, keyID+":"+redactedValue)
+	}
+	c.PreviousKeys = strings.Join(previousKeys, ",")
+
+	return c
 }
 
-func createMemStorage(cfg Config) (handlers.IRepository, error) {
-	memStorage, err := storage.NewMemStorage(cfg.StoreFile, cfg.Restore, cfg.StoreInterval.Seconds() == 0)
+func startStatsd(ctx context.Context, cfg Config, repository handlers.IRepository, trustedSubnets utils.TrustedSubnets) (func() error, error) {
+	if cfg.StatsdUDPAddress == "" && cfg.StatsdTCPAddress == "" {
+		return func() error { return nil }, nil
+	}
+	if cfg.StatsdFlushInterval <= 0 || cfg.StatsdMaxConnections <= 0 || cfg.StatsdIdleTimeout <= 0 {
+		return nil, errors.New("the flush interval and the limits of the StatsD listener must be positive")
+	}
+
+	listener := statsd.NewListener(&logger, repository, statsd.Limits{
+		MaxPending:     statsd.DefaultMaxPending,
+		MaxConnections: cfg.StatsdMaxConnections,
+		IdleTimeout:    cfg.StatsdIdleTimeout,
+	}, trustedSubnets)
+	var closers []io.Closer
+	closeAll := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+	if cfg.StatsdUDPAddress != "" {
+		conn, err := net.ListenPacket("udp", cfg.StatsdUDPAddress)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, conn)
+		go func() {
+			if err := listener.ServeUDP(conn); err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+		}()
+	}
+	if cfg.StatsdTCPAddress != "" {
+		tcpListener, err := net.Listen("tcp", cfg.StatsdTCPAddress)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		closers = append(closers, tcpListener)
+		go func() {
+			if err := listener.ServeTCP(tcpListener); err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+		}()
+	}
+	go listener.Run(ctx, cfg.StatsdFlushInterval)
+
+	return func() error {
+		closeAll()
+		listener.Close()
+		return listener.Flush(context.Background())
+	}, nil
+}
+
+// startGraphite starts the Graphite listener if its address is set. The returned function closes the socket
+// and the connections, and waits until their lines are written.
+func startGraphite(cfg Config, repository handlers.IRepository, trustedSubnets utils.TrustedSubnets) (func() error, error) {
+	if cfg.GraphiteAddress == "" {
+		return func() error { return nil }, nil
+	}
+	if cfg.GraphiteMaxConnections <= 0 || cfg.GraphiteMaxLineSize <= 0 || cfg.GraphiteIdleTimeout <= 0 {
+		return nil, errors.New("the limits of the Graphite listener must be positive")
+	}
+
+	tcpListener, err := net.Listen("tcp", cfg.GraphiteAddress)
 	if err != nil {
 		return nil, err
 	}
+	listener := graphite.NewListener(&logger, repository, graphite.Limits{
+		MaxConnections: cfg.GraphiteMaxConnections,
+		MaxLineSize:    cfg.GraphiteMaxLineSize,
+		IdleTimeout:    cfg.GraphiteIdleTimeout,
+	}, trustedSubnets)
+	go func() {
+		if err := listener.Serve(tcpListener); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}()
+
+	return func() error {
+		tcpListener.Close()
+		return listener.Close()
+	}, nil
+}
+
+// createMemStorage returns the storage and the function which persists it to the file for the last time.
+func createMemStorage(ctx context.Context, cfg Config, rollupPolicies []storage.RollupPolicy) (handlers.IRepository, func() error, error) {
+	memStorage, err := storage.NewMemStorage(cfg.StoreFile, cfg.Restore, cfg.StoreInterval.Seconds() == 0)
+	if err != nil {
+		return nil, nil, err
+	}
 	memStorage.AddObserver(storage.GetLoggerObserver(logger))
+	if cfg.History {
+		memStorage.EnableHistory(cfg.HistorySize)
+	}
+	if len(rollupPolicies) != 0 {
+		memStorage.EnableRollups(rollupPolicies)
+		go utils.InvokeFunctionWithInterval(ctx, cfg.RollupCleanupInterval, getCleanupRollupsFunction(memStorage))
+	}
 
 	if cfg.StoreInterval.Seconds() != 0 {
-		go utils.InvokeFunctionWithInterval(cfg.StoreInterval, getSaveToFileFunction(memStorage))
+		go utils.InvokeFunctionWithInterval(ctx, cfg.StoreInterval, getSaveToFileFunction(memStorage))
 	}
 
-	return memStorage, nil
+	return memStorage, memStorage.Close, nil
 }
 
-func createDBStorage(cfg Config) (*storage.DBStorage, error) {
+// createDBStorage returns the storage and the function which closes the connection to the database.
+func createDBStorage(ctx context.Context, cfg Config, rollupPolicies []storage.RollupPolicy) (*storage.DBStorage, func() error, error) {
 	db, err := sql.Open("pgx", cfg.DatabaseDsn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer db.Close()
 
 	dbStorage, err := storage.NewDBStorage(db)
 	if err != nil {
-		return nil, err
+		db.Close()
+		return nil, nil, err
 	}
 	dbStorage.AddObserver(storage.GetLoggerObserver(logger))
+	if cfg.History {
+		if err = dbStorage.EnableHistory(); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+	if len(rollupPolicies) != 0 {
+		if err = dbStorage.EnableRollups(rollupPolicies); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		go utils.InvokeFunctionWithInterval(ctx, cfg.RollupCleanupInterval, getCleanupRollupsFunction(dbStorage))
+	}
 
-	return dbStorage, nil
+	return dbStorage, db.Close, nil
 }
 
 func getSaveToFileFunction(memStorage *storage.MemStorage) func() {
@@ -140,3 +534,49 @@ func getSaveToFileFunction(memStorage *storage.MemStorage) func() {
 		}
 	}
 }
+
+type rollupsCleaner interface {
+	CleanupRollups(ctx context.Context, now time.Time) error
+}
+
+func getCleanupRollupsFunction(cleaner rollupsCleaner) func() {
+	return func() {
+		logger.Info().Msg("Removing expired rollups")
+		err := cleaner.CleanupRollups(context.Background(), time.Now())
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// getRecordKeyUsesFunction adds the uses of the keys to the HashKeyUses counter labeled with the id of the key,
+// so it's visible when the previous key isn't used anymore and can be retired.
+func getRecordKeyUsesFunction(keyring *utils.Keyring, repository handlers.IRepository) func() {
+	return func() {
+		var metrics []interface{}
+		for keyID, uses := range keyring.TakeUses() {
+			label := keyID
+			if label == "" {
+				label = "none"
+			}
+			metrics = append(metrics, handlers.CounterMetric{
+				Name:   "HashKeyUses",
+				Value:  uses,
+				Labels: handlers.Labels{"key_id": label},
+			})
+
+			if keyID != keyring.KeyID() {
+				logger.Warn().Msgf("The previous key %q is still in use, %d signs are verified with it", keyID, uses)
+			} else {
+				logger.Info().Msgf("%d signs are verified with the current key %q", uses, keyID)
+			}
+		}
+		if len(metrics) == 0 {
+			return
+		}
+
+		if err := repository.IncrementMany(context.Background(), metrics); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/smamykin/smetrics/internal/utils"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The aggregates of the gauges which may be reported in addition to the last value.
+// The aggregate is reported as the gauge with the name of the aggregate appended, e.g. Alloc_max.
+const (
+	GaugeAggregateMin = "min"
+	GaugeAggregateMax = "max"
+	GaugeAggregateAvg = "avg"
+)
+
+// ParseGaugeAggregates parses the comma separated list of the aggregates of the gauges, e.g. min,max,avg
+func ParseGaugeAggregates(value string) ([]string, error) {
+	var result []string
+	for _, aggregate := range strings.Split(value, ",") {
+		aggregate = strings.TrimSpace(aggregate)
+		switch aggregate {
+		case "":
+			continue
+		case GaugeAggregateMin, GaugeAggregateMax, GaugeAggregateAvg:
+			result = append(result, aggregate)
+		default:
+			return nil, fmt.Errorf("unknown aggregate of the gauge: %s", aggregate)
+		}
+	}
+
+	return result, nil
+}
+
+// aggregationTable aggregates the polled metrics between the reports, so every report carries one entry per metric:
+// the last value of the gauge (and the configured aggregates), the sum of the deltas of the counter
+// and the merged histogram.
+type aggregationTable struct {
+	mu              sync.Mutex
+	gaugeAggregates []string
+	entries         map[string]*aggregationEntry
+	// keys are the keys of the entries in the order of the first appearance
+	keys []string
+}
+
+type aggregationEntry struct {
+	metricType string
+	name       string
+	// the gauge
+	last  float64
+	min   float64
+	max   float64
+	sum   float64
+	count int
+	// the counter
+	delta int
+	// the histogram
+	histogram *utils.Histogram
+}
+
+func newAggregationTable(gaugeAggregates []string) *aggregationTable {
+	return &aggregationTable{
+		gaugeAggregates: gaugeAggregates,
+		entries:         map[string]*aggregationEntry{},
+	}
+}
+
+// add aggregates the metrics. The metrics with the values which cannot be parsed are skipped.
+func (t *aggregationTable) add(metrics []IMetric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, metric := range metrics {
+		switch metric.GetType() {
+		case MetricTypeGauge:
+			value, err := gaugeValue(metric)
+			if err != nil {
+				continue
+			}
+			entry := t.entry(MetricTypeGauge, metric.GetName())
+			if entry.count == 0 || value < entry.min {
+				entry.min = value
+			}
+			if entry.count == 0 || value > entry.max {
+				entry.max = value
+			}
+			entry.last = value
+			entry.sum += value
+			entry.count++
+		case MetricTypeCounter:
+			delta, err := counterDelta(metric)
+			if err != nil {
+				continue
+			}
+			t.entry(MetricTypeCounter, metric.GetName()).delta += delta
+		case MetricTypeHistogram:
+			histogram, ok := metric.(MetricHistogram)
+			if !ok {
+				continue
+			}
+			entry := t.entry(MetricTypeHistogram, metric.GetName())
+			if entry.histogram == nil || entry.histogram.Merge(histogram.value) != nil {
+				// the histogram with other bounds replaces the previous one
+				clone := histogram.value.Clone()
+				entry.histogram = &clone
+			}
+		}
+	}
+}
+
+// observe adds the value to the histogram, the histogram is created with the given bounds.
+func (t *aggregationTable) observe(name string, bounds []float64, value float64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := t.entry(MetricTypeHistogram, name)
+	if entry.histogram == nil {
+		histogram, err := utils.NewHistogram(bounds)
+		if err != nil {
+			return err
+		}
+		entry.histogram = &histogram
+	}
+	return entry.histogram.Observe(value)
+}
+
+// take returns the aggregated metrics and starts the aggregation over.
+func (t *aggregationTable) take() []IMetric {
+	return t.metrics(t.takeEntries())
+}
+
+// takeEntries returns the aggregated entries in the order of the first appearance and starts the aggregation over.
+func (t *aggregationTable) takeEntries() []*aggregationEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]*aggregationEntry, 0, len(t.keys))
+	for _, key := range t.keys {
+		result = append(result, t.entries[key])
+	}
+
+	t.entries = map[string]*aggregationEntry{}
+	t.keys = nil
+
+	return result
+}
+
+// restore merges the entries taken earlier back into the table, e.g. when their report cannot be sent.
+// The entries are older than the aggregated since, so the last value of the gauge is kept if it is aggregated again.
+func (t *aggregationTable) restore(older []*aggregationEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, entry := range older {
+		key := entry.metricType + ":" + entry.name
+		newer, ok := t.entries[key]
+		if !ok {
+			t.entries[key] = entry
+			t.keys = append(t.keys, key)
+			continue
+		}
+
+		switch entry.metricType {
+		case MetricTypeGauge:
+			if entry.min < newer.min {
+				newer.min = entry.min
+			}
+			if entry.max > newer.max {
+				newer.max = entry.max
+			}
+			newer.sum += entry.sum
+			newer.count += entry.count
+		case MetricTypeCounter:
+			newer.delta += entry.delta
+		case MetricTypeHistogram:
+			if newer.histogram == nil {
+				newer.histogram = entry.histogram
+			} else if entry.histogram != nil {
+				// the older histogram with other bounds is dropped
+				_ = newer.histogram.Merge(*entry.histogram)
+			}
+		}
+	}
+}
+
+// metrics returns the metrics of the entries with the configured aggregates of the gauges.
+func (t *aggregationTable) metrics(entries []*aggregationEntry) []IMetric {
+	result := []IMetric{}
+	for _, entry := range entries {
+		switch entry.metricType {
+		case MetricTypeGauge:
+			result = append(result, MetricGauge{entry.last, entry.name})
+			for _, aggregate := range t.gaugeAggregates {
+				switch aggregate {
+				case GaugeAggregateMin:
+					result = append(result, MetricGauge{entry.min, entry.name + "_min"})
+				case GaugeAggregateMax:
+					result = append(result, MetricGauge{entry.max, entry.name + "_max"})
+				case GaugeAggregateAvg:
+					result = append(result, MetricGauge{entry.sum / float64(entry.count), entry.name + "_avg"})
+				}
+			}
+		case MetricTypeCounter:
+			result = append(result, MetricCounter{entry.delta, entry.name})
+		case MetricTypeHistogram:
+			if entry.histogram != nil {
+				result = append(result, MetricHistogram{*entry.histogram, entry.name})
+			}
+		}
+	}
+
+	return result
+}
+
+func (t *aggregationTable) entry(metricType string, name string) *aggregationEntry {
+	key := metricType + ":" + name
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &aggregationEntry{metricType: metricType, name: name}
+		t.entries[key] = entry
+		t.keys = append(t.keys, key)
+	}
+
+	return entry
+}
+
+func gaugeValue(metric IMetric) (float64, error) {
+	if gauge, ok := metric.(MetricGauge); ok {
+		return gauge.value, nil
+	}
+
+	return strconv.ParseFloat(metric.String(), 64)
+}
+
+func counterDelta(metric IMetric) (int, error) {
+	if counter, ok := metric.(MetricCounter); ok {
+		return counter.delta, nil
+	}
+
+	return strconv.Atoi(metric.String())
+}
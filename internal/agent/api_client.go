@@ -2,35 +2,90 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/smamykin/smetrics/internal/utils"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-func NewClient(logger *zerolog.Logger, metricAggregatorService string, key string) *Client {
+// ClientOption configures the optional features of the clients, both Client and GRPCClient
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	keyID                string
+	realIP               net.IP
+	compressionThreshold int
+}
+
+// WithKeyID makes the client send the id of the key alongside the signs, so the server knows which of its keys to verify with
+func WithKeyID(keyID string) ClientOption {
+	return func(o *clientOptions) {
+		o.keyID = keyID
+	}
+}
+
+// WithRealIP makes the client report the address in the X-Real-IP header, the server checks it against the trusted subnets
+func WithRealIP(ip net.IP) ClientOption {
+	return func(o *clientOptions) {
+		o.realIP = ip
+	}
+}
+
+// WithCompressionThreshold sets the size of the batch in bytes from which it's compressed, the negative one disables the compression
+func WithCompressionThreshold(threshold int) ClientOption {
+	return func(o *clientOptions) {
+		o.compressionThreshold = threshold
+	}
+}
+
+// NewClient creates the client. If publicKey is not nil, the bodies of the requests are encrypted with it.
+func NewClient(logger *zerolog.Logger, metricAggregatorService string, key string, labels map[string]string, retryPolicy RetryPolicy, publicKey *rsa.PublicKey, opts ...ClientOption) *Client {
 	result := &Client{
 		MetricAggregatorService: metricAggregatorService,
 		logger:                  logger,
+		labels:                  labels,
+		retryPolicy:             retryPolicy,
+		httpClient:              &http.Client{Timeout: defaultRequestTimeout},
+		publicKey:               publicKey,
+		clientOptions:           clientOptions{compressionThreshold: defaultCompressionThreshold},
 	}
 
 	if key != "" {
 		result.hashGenerator = utils.NewHashGenerator(key)
 	}
+	for _, opt := range opts {
+		opt(&result.clientOptions)
+	}
+	result.compressor = newCompressor(result.compressionThreshold)
 
 	return result
 }
 
+const defaultRequestTimeout = 10 * time.Second
+
 type Client struct {
 	MetricAggregatorService string
 	logger                  *zerolog.Logger
 	hashGenerator           IHashGenerator
+	labels                  map[string]string
+	retryPolicy             RetryPolicy
+	httpClient              *http.Client
+	publicKey               *rsa.PublicKey
+	compressor              *compressor
+	clientOptions
 }
 
-func (c *Client) SendMetrics(metrics []IMetric) error {
+// SendMetrics sends the metrics and retries the retriable failures according to the retry policy.
+// The error is returned only when the retries are exhausted, the failure is not retriable or the context is cancelled.
+func (c *Client) SendMetrics(ctx context.Context, metrics []IMetric) error {
 
 	body, err := c.createRequestBody(metrics)
 	if err != nil {
@@ -38,23 +93,133 @@ func (c *Client) SendMetrics(metrics []IMetric) error {
 		return err
 	}
 	url := fmt.Sprintf("%s/updates/", c.MetricAggregatorService)
-
 	c.logger.Info().Msgf("client are making request. url: %s, body: %s \n", url, string(body))
 
-	post, err := http.Post(url, "application/json", bytes.NewReader(body))
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if c.realIP != nil {
+		header.Set(utils.RealIPHeader, c.realIP.String())
+	}
+	// the whole body is signed before the encryption in addition to the hashes of the metrics for the older servers
+	if c.hashGenerator != nil {
+		sign, err := c.hashGenerator.Generate(string(body))
+		if err != nil {
+			return fmt.Errorf("cannot sign the metrics: %w", err)
+		}
+		header.Set(utils.HashSHA256Header, sign)
+		if c.keyID != "" {
+			header.Set(utils.HashKeyIDHeader, c.keyID)
+		}
+	}
+	// the compressed body is encrypted, the server decrypts it first and then decompresses
+	if c.compressor != nil {
+		var encoding string
+		body, encoding, err = c.compressor.compress(body)
+		if err != nil {
+			return fmt.Errorf("cannot compress the metrics: %w", err)
+		}
+		if encoding != "" {
+			header.Set("Content-Encoding", encoding)
+		}
+	}
+	if c.publicKey != nil {
+		body, err = utils.Encrypt(c.publicKey, body)
+		if err != nil {
+			return fmt.Errorf("cannot encrypt the metrics: %w", err)
+		}
+		header.Set(utils.EncryptionHeader, utils.EncryptionScheme)
+	}
+
+	start := time.Now()
+	for retry := 1; ; retry++ {
+		wait, err := c.post(ctx, url, body, header)
+		if err == nil {
+			return nil
+		}
+		c.logger.Warn().Err(err).Msg("")
+
+		var retriable *retriableError
+		if !errors.As(err, &retriable) {
+			return err
+		}
+		if wait == 0 {
+			wait = c.retryPolicy.backoff(retry)
+		}
+		if time.Since(start)+wait > c.retryPolicy.MaxElapsedTime {
+			return fmt.Errorf("giving up sending the metrics after %d attempts: %w", retry, retriable)
+		}
+
+		c.logger.Info().Msgf("retrying to send the metrics in %s", wait)
+		if err = sleep(ctx, wait); err != nil {
+			return fmt.Errorf("giving up sending the metrics after %d attempts: %w", retry, err)
+		}
+	}
+}
+
+// sleep waits for the duration, the error is returned if the context is cancelled earlier
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retriableError is the failure of the request which may succeed later
+type retriableError struct {
+	err error
+}
+
+func (e *retriableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retriableError) Unwrap() error {
+	return e.err
+}
+
+// post makes one attempt to send the body. If the server asks to wait with Retry-After, the duration is returned.
+func (c *Client) post(ctx context.Context, url string, body []byte, header http.Header) (time.Duration, error) {
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		c.logger.Warn().Msgf("error while sending the metrics to server. Error: %s\n", err.Error())
-		return err
+		return 0, err
+	}
+	request.Header = header.Clone()
+
+	post, err := httpClient.Do(request)
+	if err != nil {
+		err = fmt.Errorf("error while sending the metrics to server. Error: %w", err)
+		if isRetriableError(err) {
+			return 0, &retriableError{err}
+		}
+		return 0, err
 	}
 	defer post.Body.Close()
+	io.Copy(io.Discard, post.Body)
+	if c.compressor != nil {
+		c.compressor.learn(post.Header)
+	}
 
-	if post.StatusCode != http.StatusOK {
-		err = fmt.Errorf("error while sending the metrics to server. Status: %d", post.StatusCode)
-		c.logger.Warn().Err(err).Msg("")
-		return err
+	if post.StatusCode == http.StatusOK {
+		return 0, nil
 	}
 
-	return nil
+	err = fmt.Errorf("error while sending the metrics to server. Status: %d", post.StatusCode)
+	if !isRetriableStatus(post.StatusCode) {
+		return 0, err
+	}
+	wait, _ := parseRetryAfter(post.Header.Get("Retry-After"), time.Now())
+
+	return wait, &retriableError{err}
 }
 
 func (c *Client) createRequestBody(metrics []IMetric) (body []byte, err error) {
@@ -64,6 +229,9 @@ func (c *Client) createRequestBody(metrics []IMetric) (body []byte, err error) {
 			MType: metric.GetType(),
 			ID:    metric.GetName(),
 		}
+		if len(c.labels) > 0 {
+			m.Labels = c.labels
+		}
 		switch m.MType {
 		case MetricTypeGauge:
 			value, err := strconv.ParseFloat(metric.String(), 64)
@@ -82,6 +250,17 @@ func (c *Client) createRequestBody(metrics []IMetric) (body []byte, err error) {
 			}
 			m.Delta = &value
 
+			err = c.signMetricWithHash(&m)
+			if err != nil {
+				return body, err
+			}
+		case MetricTypeHistogram:
+			histogram, ok := metric.(MetricHistogram)
+			if !ok {
+				return body, errors.New("unable to get histogram value")
+			}
+			m.Histogram = &histogram.value
+
 			err = c.signMetricWithHash(&m)
 			if err != nil {
 				return body, err
@@ -103,10 +282,13 @@ func (c *Client) signMetricWithHash(metrics *Metrics) (err error) {
 
 	switch metrics.MType {
 	case MetricTypeGauge:
-		stringToHash := fmt.Sprintf("%s:gauge:%f", metrics.ID, *metrics.Value)
+		stringToHash := fmt.Sprintf("%s:gauge:%f", metrics.ID, *metrics.Value) + labelsSuffix(metrics.Labels)
 		sign, err = c.hashGenerator.Generate(stringToHash)
 	case MetricTypeCounter:
-		stringToHash := fmt.Sprintf("%s:counter:%d", metrics.ID, *metrics.Delta)
+		stringToHash := fmt.Sprintf("%s:counter:%d", metrics.ID, *metrics.Delta) + labelsSuffix(metrics.Labels)
+		sign, err = c.hashGenerator.Generate(stringToHash)
+	case MetricTypeHistogram:
+		stringToHash := fmt.Sprintf("%s:histogram:%s", metrics.ID, metrics.Histogram.SignString()) + labelsSuffix(metrics.Labels)
 		sign, err = c.hashGenerator.Generate(stringToHash)
 	default:
 		err = errors.New("unknown type of the metric")
@@ -117,16 +299,29 @@ func (c *Client) signMetricWithHash(metrics *Metrics) (err error) {
 	}
 
 	metrics.Hash = sign
+	metrics.KeyID = c.keyID
 
 	return nil
 }
 
+// labelsSuffix is appended to the sign string of the metric with labels, the metrics without labels are signed as before.
+func labelsSuffix(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	return ":" + utils.LabelsString(labels)
+}
+
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	ID        string            `json:"id"`                  // имя метрики
+	MType     string            `json:"type"`                // параметр, принимающий значение gauge, counter или histogram
+	Delta     *int64            `json:"delta,omitempty"`     // значение метрики в случае передачи counter
+	Value     *float64          `json:"value,omitempty"`     // значение метрики в случае передачи gauge
+	Histogram *utils.Histogram  `json:"histogram,omitempty"` // значение метрики в случае передачи histogram
+	Hash      string            `json:"hash,omitempty"`      // значение хеш-функции
+	KeyID     string            `json:"key_id,omitempty"`    // идентификатор ключа, которым подписан hash
+	Labels    map[string]string `json:"labels,omitempty"`    // метки, которые вместе с именем и типом определяют метрику
 }
 
 type IHashGenerator interface {
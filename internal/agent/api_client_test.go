@@ -1,8 +1,14 @@
 package agent
 
 import (
+	"context"
+	crand "crypto/rand"
+	"crypto/rsa"
 	"fmt"
+	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/server/server"
+	"github.com/smamykin/smetrics/internal/server/storage"
 	"github.com/smamykin/smetrics/internal/utils"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -10,27 +16,55 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestClient_SendMetrics(t *testing.T) {
 	type testCase struct {
 		hash         IHashGenerator
+		labels       map[string]string
 		expectedBody string
+		metrics      []IMetric
 	}
 	value := rand.Int()
 
 	h := utils.NewHashGenerator("secret")
 	sign, err := h.Generate(fmt.Sprintf("metricNameTest:counter:%d", value))
 	require.Nil(t, err)
+	signWithLabels, err := h.Generate(fmt.Sprintf(`metricNameTest:counter:%d:{host="h1"}`, value))
+	require.Nil(t, err)
+
+	histogram, err := utils.NewHistogram([]float64{1})
+	require.Nil(t, err)
+	histogram.Observe(0.5)
+	histogramSign, err := h.Generate("latency:histogram:" + histogram.SignString())
+	require.Nil(t, err)
 
 	tests := map[string]testCase{
 		"default": {
+			nil,
 			nil,
 			fmt.Sprintf(`[{"id":"metricNameTest","type":"counter","delta":%d}]`, value),
+			nil,
 		},
 		"with key": {
 			h,
+			nil,
 			fmt.Sprintf(`[{"id":"metricNameTest","type":"counter","delta":%d,"hash":"%s"}]`, value, sign),
+			nil,
+		},
+		"with labels": {
+			h,
+			map[string]string{"host": "h1"},
+			fmt.Sprintf(`[{"id":"metricNameTest","type":"counter","delta":%d,"hash":"%s","labels":{"host":"h1"}}]`, value, signWithLabels),
+			nil,
+		},
+		"with histogram": {
+			h,
+			nil,
+			fmt.Sprintf(`[{"id":"metricNameTest","type":"counter","delta":%d,"hash":"%s"},`, value, sign) +
+				fmt.Sprintf(`{"id":"latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1},"hash":"%s"}]`, histogramSign),
+			[]IMetric{MetricHistogram{histogram, "latency"}},
 		},
 	}
 
@@ -48,13 +82,14 @@ func TestClient_SendMetrics(t *testing.T) {
 
 			logger := zerolog.Nop()
 			client := Client{
-				server.URL,
-				&logger,
-				tt.hash,
+				MetricAggregatorService: server.URL,
+				logger:                  &logger,
+				hashGenerator:           tt.hash,
+				labels:                  tt.labels,
 			}
-			client.SendMetrics([]IMetric{
+			client.SendMetrics(context.Background(), append([]IMetric{
 				MetricCounter{value, "metricNameTest"},
-			})
+			}, tt.metrics...))
 
 			require.True(t, handler.isInvoked)
 		})
@@ -89,3 +124,235 @@ type writerMock struct {
 func (t writerMock) Write(p []byte) (n int, err error) {
 	return 0, nil
 }
+
+func TestClient_SendMetrics_Retry(t *testing.T) {
+	type testCase struct {
+		statuses         []int
+		retryAfter       string
+		maxElapsedTime   time.Duration
+		expectedAttempts int
+		isErrorExpected  bool
+	}
+
+	tests := map[string]testCase{
+		"success after server errors": {
+			statuses:         []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK},
+			maxElapsedTime:   time.Second,
+			expectedAttempts: 3,
+		},
+		"not retriable status": {
+			statuses:         []int{http.StatusBadRequest},
+			maxElapsedTime:   time.Second,
+			expectedAttempts: 1,
+			isErrorExpected:  true,
+		},
+		"retries are exhausted": {
+			statuses:         []int{http.StatusInternalServerError},
+			maxElapsedTime:   30 * time.Millisecond,
+			expectedAttempts: 3,
+			isErrorExpected:  true,
+		},
+		"retry-after exceeds the max elapsed time": {
+			statuses:         []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter:       "60",
+			maxElapsedTime:   time.Second,
+			expectedAttempts: 1,
+			isErrorExpected:  true,
+		},
+		"retries are disabled": {
+			statuses:         []int{http.StatusInternalServerError, http.StatusOK},
+			expectedAttempts: 1,
+			isErrorExpected:  true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[len(tt.statuses)-1]
+				if attempts < len(tt.statuses) {
+					status = tt.statuses[attempts]
+				}
+				attempts++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			logger := zerolog.Nop()
+			client := NewClient(&logger, server.URL, "", nil, RetryPolicy{
+				InitialInterval: 5 * time.Millisecond,
+				MaxInterval:     10 * time.Millisecond,
+				Multiplier:      2,
+				MaxElapsedTime:  tt.maxElapsedTime,
+			}, nil)
+			err := client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "metricNameTest"}})
+
+			require.Equal(t, tt.isErrorExpected, err != nil)
+			if tt.expectedAttempts > 1 && tt.isErrorExpected {
+				require.GreaterOrEqual(t, attempts, tt.expectedAttempts)
+			} else {
+				require.Equal(t, tt.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestClient_SendMetrics_ConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, url, "", nil, NewRetryPolicy(5*time.Millisecond, 10*time.Millisecond, 30*time.Millisecond), nil)
+	err := client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "metricNameTest"}})
+
+	require.NotNil(t, err)
+	require.True(t, isRetriableError(err))
+}
+
+func TestClient_SendMetrics_RetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "", nil, NewRetryPolicy(time.Minute, time.Minute, time.Hour), nil)
+	start := time.Now()
+	err := client.SendMetrics(ctx, []IMetric{MetricCounter{1, "metricNameTest"}})
+
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, attempts)
+	require.Less(t, time.Since(start), time.Minute)
+}
+
+func TestClient_SendMetrics_Encrypted(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	require.Nil(t, err)
+
+	var decrypted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, utils.EncryptionScheme, r.Header.Get(utils.EncryptionHeader))
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.NotContains(t, string(body), "metricNameTest")
+
+		plaintext, err := utils.Decrypt(privateKey, body)
+		require.Nil(t, err)
+		decrypted = string(plaintext)
+	}))
+	defer server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), &privateKey.PublicKey)
+	require.Nil(t, client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "metricNameTest"}}))
+	require.Equal(t, `[{"id":"metricNameTest","type":"counter","delta":1}]`, decrypted)
+}
+
+func TestClient_SendMetrics_BodySignature(t *testing.T) {
+	h := utils.NewHashGenerator("secret")
+	var sign, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		body = string(data)
+		sign = r.Header.Get(utils.HashSHA256Header)
+	}))
+	defer server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "secret", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), nil)
+	require.Nil(t, client.SendMetrics(context.Background(), []IMetric{MetricGauge{0.1, "metricNameTest"}}))
+
+	expected, err := h.Generate(body)
+	require.Nil(t, err)
+	require.Equal(t, expected, sign)
+	// the hashes of the metrics are kept for the older servers
+	require.Contains(t, body, `"hash":`)
+}
+
+func TestClient_SendMetrics_KeyID(t *testing.T) {
+	var keyID, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		body = string(data)
+		keyID = r.Header.Get(utils.HashKeyIDHeader)
+	}))
+	defer server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "secret", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), nil, WithKeyID("v2"))
+	require.Nil(t, client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}}))
+
+	require.Equal(t, "v2", keyID)
+	require.Contains(t, body, `"key_id":"v2"`)
+}
+
+func TestClient_SendMetrics_RealIP(t *testing.T) {
+	var realIP string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIP = r.Header.Get(utils.RealIPHeader)
+	}))
+	defer server.Close()
+
+	ip, err := OutboundIP(server.URL)
+	require.Nil(t, err)
+	require.True(t, ip.IsLoopback())
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), nil, WithRealIP(ip))
+	require.Nil(t, client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}}))
+	require.Equal(t, ip.String(), realIP)
+}
+
+func TestClient_SendMetrics_Compression(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	require.Nil(t, err)
+	repository := storage.NewMemStorageDefault()
+	handler := server.AddHandlers(chi.NewRouter(), repository, utils.NewKeyring("", "secret"), server.WithPrivateKey(privateKey))
+
+	var encodings []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, ts.URL, "secret", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), &privateKey.PublicKey, WithCompressionThreshold(200))
+
+	var batch []IMetric
+	for i := 0; i < 20; i++ {
+		batch = append(batch, MetricCounter{1, fmt.Sprintf("Counter%d", i)})
+	}
+	require.Nil(t, client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "Counter0"}}))
+	// the first response advertises zstd, so gzip is only used until it's known
+	require.Nil(t, client.SendMetrics(context.Background(), batch))
+	require.Nil(t, client.SendMetrics(context.Background(), batch))
+
+	require.Equal(t, []string{"", EncodingZstd, EncodingZstd}, encodings)
+	counter, err := repository.GetCounter("Counter0", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), counter)
+	counter, err = repository.GetCounter("Counter19", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), counter)
+
+	client = NewClient(&logger, ts.URL, "secret", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), &privateKey.PublicKey, WithCompressionThreshold(200))
+	encodings = nil
+	require.Nil(t, client.SendMetrics(context.Background(), batch))
+	require.Equal(t, []string{EncodingGzip}, encodings)
+	counter, err = repository.GetCounter("Counter19", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), counter)
+}
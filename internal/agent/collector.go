@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector is the named provider of the metrics polled with its own interval.
+// The poll which takes longer than Timeout is abandoned, and the collector is not polled until the poll returns.
+type Collector struct {
+	Name     string
+	Provider IMetricProvider
+	Interval time.Duration
+	// Timeout is Interval if zero
+	Timeout time.Duration
+	Enabled bool
+}
+
+// CollectorSpec is the configuration of the collector
+type CollectorSpec struct {
+	Name     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// ProviderConfig is the configuration of the agent the providers of the collectors are created with
+type ProviderConfig struct {
+	ProcPath    string
+	MountPoints []string
+}
+
+// ProviderFactory creates the provider of the collector
+type ProviderFactory func(cfg ProviderConfig) (IMetricProvider, error)
+
+var (
+	providerFactoriesMu sync.RWMutex
+	providerFactories   = map[string]ProviderFactory{
+		"runtime": func(cfg ProviderConfig) (IMetricProvider, error) {
+			return &MetricProvider{}, nil
+		},
+		"host": func(cfg ProviderConfig) (IMetricProvider, error) {
+			return NewHostMetricProvider(cfg.ProcPath, cfg.MountPoints), nil
+		},
+		"process": func(cfg ProviderConfig) (IMetricProvider, error) {
+			return NewProcessMetricProvider(cfg.ProcPath), nil
+		},
+	}
+)
+
+// RegisterProvider makes the collector with the given name available to the agent, e.g. from the init function
+// of the package linked into the agent, so the collectors are added without touching the built-in ones.
+// It panics if the name is empty, the factory is nil or the name is already registered, as database/sql.Register does.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providerFactoriesMu.Lock()
+	defer providerFactoriesMu.Unlock()
+
+	if name == "" || factory == nil {
+		panic("agent: the name and the factory of the provider are required")
+	}
+	if _, ok := providerFactories[name]; ok {
+		panic("agent: the provider is registered twice: " + name)
+	}
+	providerFactories[name] = factory
+}
+
+// NewProvider creates the provider of the registered collector
+func NewProvider(name string, cfg ProviderConfig) (IMetricProvider, error) {
+	providerFactoriesMu.RLock()
+	factory, ok := providerFactories[name]
+	providerFactoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown collector: %s, the known ones are %s", name, strings.Join(ProviderNames(), ", "))
+	}
+
+	return factory(cfg)
+}
+
+// ProviderNames returns the sorted names of the registered collectors
+func ProviderNames() []string {
+	providerFactoriesMu.RLock()
+	defer providerFactoriesMu.RUnlock()
+
+	names := make([]string, 0, len(providerFactories))
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ParseCollectorSpecs parses the comma separated list of the collectors in the format name[:interval[:timeout]],
+// e.g. runtime,host:10s:2s. The interval is defaultInterval if omitted, the timeout is the interval if omitted.
+func ParseCollectorSpecs(value string, defaultInterval time.Duration) ([]CollectorSpec, error) {
+	var result []CollectorSpec
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid collector: %s", item)
+		}
+		spec := CollectorSpec{Name: parts[0], Interval: defaultInterval}
+		if len(parts) > 1 {
+			interval, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval of the collector %s: %w", spec.Name, err)
+			}
+			spec.Interval = interval
+		}
+		spec.Timeout = spec.Interval
+		if len(parts) > 2 {
+			timeout, err := time.ParseDuration(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout of the collector %s: %w", spec.Name, err)
+			}
+			spec.Timeout = timeout
+		}
+		result = append(result, spec)
+	}
+
+	return result, nil
+}
+
+// ICollectorSink receives the metrics of the collectors and the durations of the polls
+type ICollectorSink interface {
+	Add(metrics []IMetric)
+	Observe(name string, value float64)
+}
+
+// CollectorRegistry polls the registered collectors concurrently. A collector that panics or hangs doesn't affect
+// the others, the failures are reported to the sink as the counters CollectorPanics_<name>, CollectorTimeouts_<name>
+// and CollectorSkippedPolls_<name>, the durations of the polls as the histogram CollectorDuration_<name>.
+type CollectorRegistry struct {
+	mu         sync.Mutex
+	collectors []*registeredCollector
+}
+
+type registeredCollector struct {
+	Collector
+	// isPolling is set while the poll is running, including the abandoned one
+	isPolling bool
+}
+
+func NewCollectorRegistry() *CollectorRegistry {
+	return &CollectorRegistry{}
+}
+
+func (r *CollectorRegistry) Register(collector Collector) error {
+	if collector.Name == "" {
+		return fmt.Errorf("the name of the collector is required")
+	}
+	if collector.Provider == nil {
+		return fmt.Errorf("the collector %s has no provider", collector.Name)
+	}
+	if collector.Interval <= 0 {
+		return fmt.Errorf("the interval of the collector %s must be positive", collector.Name)
+	}
+	if collector.Timeout <= 0 {
+		collector.Timeout = collector.Interval
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, registered := range r.collectors {
+		if registered.Name == collector.Name {
+			return fmt.Errorf("the collector %s is already registered", collector.Name)
+		}
+	}
+	r.collectors = append(r.collectors, &registeredCollector{Collector: collector})
+
+	return nil
+}
+
+// SetEnabled enables or disables the collector, the disabled collector is not polled until it's enabled.
+func (r *CollectorRegistry) SetEnabled(name string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, registered := range r.collectors {
+		if registered.Name == name {
+			registered.Enabled = enabled
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown collector: %s", name)
+}
+
+// Run polls the collectors registered before the call until the context is done.
+func (r *CollectorRegistry) Run(ctx context.Context, sink ICollectorSink) {
+	r.mu.Lock()
+	collectors := append([]*registeredCollector{}, r.collectors...)
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, collector := range collectors {
+		wg.Add(1)
+		go func(collector *registeredCollector) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(collector.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					r.poll(ctx, collector, sink)
+				}
+			}
+		}(collector)
+	}
+	wg.Wait()
+}
+
+type pollResult struct {
+	metrics []IMetric
+	panic   interface{}
+}
+
+// poll polls the collector once and waits for the result not longer than the timeout of the collector.
+func (r *CollectorRegistry) poll(ctx context.Context, collector *registeredCollector, sink ICollectorSink) {
+	r.mu.Lock()
+	if !collector.Enabled {
+		r.mu.Unlock()
+		return
+	}
+	if collector.isPolling {
+		r.mu.Unlock()
+		sink.Add([]IMetric{MetricCounter{1, "CollectorSkippedPolls_" + collector.Name}})
+		return
+	}
+	collector.isPolling = true
+	provider, timeout := collector.Provider, collector.Timeout
+	r.mu.Unlock()
+
+	start := time.Now()
+	// the channel is buffered, so the abandoned poll doesn't block when it returns
+	results := make(chan pollResult, 1)
+	go func() {
+		var result pollResult
+		defer func() {
+			result.panic = recover()
+			r.mu.Lock()
+			collector.isPolling = false
+			r.mu.Unlock()
+			results <- result
+		}()
+		result.metrics = provider.GetMetrics()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		sink.Observe("CollectorDuration_"+collector.Name, time.Since(start).Seconds())
+		if result.panic != nil {
+			sink.Add([]IMetric{MetricCounter{1, "CollectorPanics_" + collector.Name}})
+			return
+		}
+		sink.Add(result.metrics)
+	case <-timer.C:
+		sink.Add([]IMetric{MetricCounter{1, "CollectorTimeouts_" + collector.Name}})
+	case <-ctx.Done():
+	}
+}
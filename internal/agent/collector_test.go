@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollectorRegistry_Run(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	registry := NewCollectorRegistry()
+	require.Nil(t, registry.Register(Collector{
+		Name:     "ok",
+		Provider: &funcProviderMock{func() []IMetric { return []IMetric{MetricCounter{1, "Polls"}} }},
+		Interval: 10 * time.Millisecond,
+		Enabled:  true,
+	}))
+	require.Nil(t, registry.Register(Collector{
+		Name:     "panics",
+		Provider: &funcProviderMock{func() []IMetric { panic("broken collector") }},
+		Interval: 10 * time.Millisecond,
+		Enabled:  true,
+	}))
+	require.Nil(t, registry.Register(Collector{
+		Name: "hangs",
+		Provider: &funcProviderMock{func() []IMetric {
+			<-hang
+			return []IMetric{MetricCounter{1, "Hangs"}}
+		}},
+		Interval: 10 * time.Millisecond,
+		Timeout:  5 * time.Millisecond,
+		Enabled:  true,
+	}))
+	require.Nil(t, registry.Register(Collector{
+		Name:     "disabled",
+		Provider: &funcProviderMock{func() []IMetric { return []IMetric{MetricCounter{1, "Disabled"}} }},
+		Interval: 10 * time.Millisecond,
+	}))
+	require.NotNil(t, registry.Register(Collector{
+		Name:     "ok",
+		Provider: &MetricProvider{},
+		Interval: time.Second,
+	}))
+
+	sink := &collectorSinkMock{counters: map[string]int{}, observed: map[string]int{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	registry.Run(ctx, sink)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	require.Greater(t, sink.counters["Polls"], 5)
+	require.Greater(t, sink.counters["CollectorPanics_panics"], 5)
+	// the hanging collector times out once and isn't polled again until the poll returns
+	require.Equal(t, 1, sink.counters["CollectorTimeouts_hangs"])
+	require.Greater(t, sink.counters["CollectorSkippedPolls_hangs"], 5)
+	require.Zero(t, sink.counters["Hangs"])
+	require.Zero(t, sink.counters["Disabled"])
+	require.Greater(t, sink.observed["CollectorDuration_ok"], 5)
+	require.Zero(t, sink.observed["CollectorDuration_hangs"])
+}
+
+func TestCollectorRegistry_SetEnabled(t *testing.T) {
+	registry := NewCollectorRegistry()
+	require.Nil(t, registry.Register(Collector{
+		Name:     "custom",
+		Provider: &funcProviderMock{func() []IMetric { return []IMetric{MetricCounter{1, "Polls"}} }},
+		Interval: time.Second,
+	}))
+	require.Nil(t, registry.SetEnabled("custom", true))
+	require.NotNil(t, registry.SetEnabled("unknown", true))
+
+	sink := &collectorSinkMock{counters: map[string]int{}, observed: map[string]int{}}
+	registry.poll(context.Background(), registry.collectors[0], sink)
+	require.Equal(t, 1, sink.counters["Polls"])
+
+	require.Nil(t, registry.SetEnabled("custom", false))
+	registry.poll(context.Background(), registry.collectors[0], sink)
+	require.Equal(t, 1, sink.counters["Polls"])
+}
+
+func TestRegisterProvider(t *testing.T) {
+	provider := &funcProviderMock{}
+	RegisterProvider("test_custom", func(cfg ProviderConfig) (IMetricProvider, error) {
+		require.Equal(t, "/host/proc", cfg.ProcPath)
+		return provider, nil
+	})
+	require.Contains(t, ProviderNames(), "test_custom")
+
+	created, err := NewProvider("test_custom", ProviderConfig{ProcPath: "/host/proc"})
+	require.Nil(t, err)
+	require.Same(t, provider, created)
+
+	_, err = NewProvider("unknown", ProviderConfig{})
+	require.NotNil(t, err)
+	require.Panics(t, func() {
+		RegisterProvider("runtime", func(cfg ProviderConfig) (IMetricProvider, error) {
+			return provider, nil
+		})
+	})
+}
+
+func TestParseCollectorSpecs(t *testing.T) {
+	specs, err := ParseCollectorSpecs("runtime, host:10s, process:5s:1s", 2*time.Second)
+	require.Nil(t, err)
+	require.Equal(t, []CollectorSpec{
+		{"runtime", 2 * time.Second, 2 * time.Second},
+		{"host", 10 * time.Second, 10 * time.Second},
+		{"process", 5 * time.Second, time.Second},
+	}, specs)
+
+	for _, value := range []string{"host:soon", "host:1s:later", "host:1s:1s:1s", ":1s"} {
+		_, err = ParseCollectorSpecs(value, time.Second)
+		require.NotNil(t, err, value)
+	}
+}
+
+type funcProviderMock struct {
+	getMetrics func() []IMetric
+}
+
+func (p *funcProviderMock) GetMetrics() []IMetric {
+	return p.getMetrics()
+}
+
+type collectorSinkMock struct {
+	mu       sync.Mutex
+	counters map[string]int
+	observed map[string]int
+}
+
+func (s *collectorSinkMock) Add(metrics []IMetric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, metric := range metrics {
+		if counter, ok := metric.(MetricCounter); ok {
+			s.counters[counter.name] += counter.delta
+		}
+	}
+}
+
+func (s *collectorSinkMock) Observe(name string, _ float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observed[name]++
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// defaultCompressionThreshold is the size of the body below which the compression isn't worth the CPU
+const defaultCompressionThreshold = 1024
+
+// compressor compresses the bodies of the requests with the pooled writers. Every server accepts gzip,
+// zstd is used once the server has advertised it in the Accept-Encoding header of a response.
+type compressor struct {
+	threshold     int
+	zstdSupported int32
+	gzipWriters   sync.Pool
+	zstdWriters   sync.Pool
+}
+
+func newCompressor(threshold int) *compressor {
+	return &compressor{
+		threshold: threshold,
+		gzipWriters: sync.Pool{New: func() interface{} {
+			writer, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+			return writer
+		}},
+		zstdWriters: sync.Pool{New: func() interface{} {
+			writer, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return nil
+			}
+			return writer
+		}},
+	}
+}
+
+// compress returns the compressed body and its Content-Encoding.
+// The body smaller than the threshold is returned as is with the empty encoding.
+func (c *compressor) compress(body []byte) ([]byte, string, error) {
+	if c.threshold < 0 || len(body) < c.threshold {
+		return body, "", nil
+	}
+
+	if atomic.LoadInt32(&c.zstdSupported) == 1 {
+		if writer, ok := c.zstdWriters.Get().(*zstd.Encoder); ok {
+			defer c.zstdWriters.Put(writer)
+			return writer.EncodeAll(body, make([]byte, 0, len(body)/2)), EncodingZstd, nil
+		}
+	}
+
+	writer := c.gzipWriters.Get().(*gzip.Writer)
+	defer c.gzipWriters.Put(writer)
+
+	var buf bytes.Buffer
+	writer.Reset(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), EncodingGzip, nil
+}
+
+// learn remembers whether the server accepts zstd from the Accept-Encoding header of its response
+func (c *compressor) learn(header http.Header) {
+	value := header.Get("Accept-Encoding")
+	if value == "" {
+		return
+	}
+
+	var supported int32
+	for _, encoding := range strings.Split(value, ",") {
+		encoding, _, _ = strings.Cut(encoding, ";")
+		if strings.TrimSpace(encoding) == EncodingZstd {
+			supported = 1
+		}
+	}
+	atomic.StoreInt32(&c.zstdSupported, supported)
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	c := newCompressor(10)
+	body := []byte(strings.Repeat(`{"id":"Alloc","type":"gauge","value":1}`, 10))
+
+	compressed, encoding, err := c.compress([]byte("short"))
+	require.Nil(t, err)
+	require.Equal(t, "", encoding)
+	require.Equal(t, "short", string(compressed))
+
+	compressed, encoding, err = c.compress(body)
+	require.Nil(t, err)
+	require.Equal(t, EncodingGzip, encoding)
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.Nil(t, err)
+	decompressed, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, body, decompressed)
+
+	c.learn(http.Header{"Accept-Encoding": []string{"gzip, zstd;q=0.5"}})
+	compressed, encoding, err = c.compress(body)
+	require.Nil(t, err)
+	require.Equal(t, EncodingZstd, encoding)
+	decoder, err := zstd.NewReader(nil)
+	require.Nil(t, err)
+	defer decoder.Close()
+	decompressed, err = decoder.DecodeAll(compressed, nil)
+	require.Nil(t, err)
+	require.Equal(t, body, decompressed)
+
+	// the server which stops advertising zstd, e.g. after the downgrade, gets gzip again
+	c.learn(http.Header{"Accept-Encoding": []string{"gzip"}})
+	_, encoding, err = c.compress(body)
+	require.Nil(t, err)
+	require.Equal(t, EncodingGzip, encoding)
+
+	_, encoding, err = newCompressor(-1).compress(body)
+	require.Nil(t, err)
+	require.Equal(t, "", encoding)
+}
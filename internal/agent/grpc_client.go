@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/pb"
+	"github.com/smamykin/smetrics/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// GRPCClient sends the metrics with the UpdateMetrics RPC instead of the JSON API. The batch is signed with the key,
+// the sign and the address reported in X-Real-IP are passed in the metadata.
+type GRPCClient struct {
+	client        pb.MetricsClient
+	logger        *zerolog.Logger
+	hashGenerator IHashGenerator
+	labels        map[string]string
+	retryPolicy   RetryPolicy
+	clientOptions
+}
+
+func NewGRPCClient(logger *zerolog.Logger, conn grpc.ClientConnInterface, key string, labels map[string]string, retryPolicy RetryPolicy, opts ...ClientOption) *GRPCClient {
+	result := &GRPCClient{
+		client:        pb.NewMetricsClient(conn),
+		logger:        logger,
+		labels:        labels,
+		retryPolicy:   retryPolicy,
+		clientOptions: clientOptions{compressionThreshold: defaultCompressionThreshold},
+	}
+
+	if key != "" {
+		result.hashGenerator = utils.NewHashGenerator(key)
+	}
+	for _, opt := range opts {
+		opt(&result.clientOptions)
+	}
+
+	return result
+}
+
+// SendMetrics sends the metrics and retries the retriable failures according to the retry policy, like Client does.
+func (c *GRPCClient) SendMetrics(ctx context.Context, metrics []IMetric) error {
+	request, err := c.createRequest(metrics)
+	if err != nil {
+		return err
+	}
+
+	md := metadata.MD{}
+	if c.realIP != nil {
+		md.Set(pb.RealIPMetadataKey, c.realIP.String())
+	}
+	if c.hashGenerator != nil {
+		stringToHash, err := pb.SignString(request)
+		if err != nil {
+			return err
+		}
+		sign, err := c.hashGenerator.Generate(stringToHash)
+		if err != nil {
+			return fmt.Errorf("cannot sign the metrics: %w", err)
+		}
+		md.Set(pb.HashMetadataKey, sign)
+		if c.keyID != "" {
+			md.Set(pb.KeyIDMetadataKey, c.keyID)
+		}
+	}
+
+	start := time.Now()
+	for retry := 1; ; retry++ {
+		err = c.update(ctx, request, md)
+		if err == nil {
+			return nil
+		}
+		c.logger.Warn().Err(err).Msg("error while sending the metrics to server")
+		if ctx.Err() != nil {
+			return fmt.Errorf("giving up sending the metrics after %d attempts: %w", retry, ctx.Err())
+		}
+
+		if !isRetriableCode(status.Code(err)) {
+			return fmt.Errorf("error while sending the metrics to server. Error: %w", err)
+		}
+		wait := c.retryPolicy.backoff(retry)
+		if time.Since(start)+wait > c.retryPolicy.MaxElapsedTime {
+			return fmt.Errorf("giving up sending the metrics after %d attempts: %w", retry, &retriableError{err})
+		}
+
+		c.logger.Info().Msgf("retrying to send the metrics in %s", wait)
+		if err = sleep(ctx, wait); err != nil {
+			return fmt.Errorf("giving up sending the metrics after %d attempts: %w", retry, err)
+		}
+	}
+}
+
+// update makes one attempt to send the batch, the error is the status of the RPC
+func (c *GRPCClient) update(ctx context.Context, request *pb.UpdateMetricsRequest, md metadata.MD) error {
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), defaultRequestTimeout)
+	defer cancel()
+
+	var callOptions []grpc.CallOption
+	if c.compressionThreshold >= 0 && proto.Size(request) >= c.compressionThreshold {
+		callOptions = append(callOptions, grpc.UseCompressor(gzip.Name))
+	}
+	_, err := c.client.UpdateMetrics(ctx, request, callOptions...)
+
+	return err
+}
+
+func (c *GRPCClient) createRequest(metrics []IMetric) (*pb.UpdateMetricsRequest, error) {
+	request := &pb.UpdateMetricsRequest{Metrics: make([]*pb.Metric, 0, len(metrics))}
+	for _, metric := range metrics {
+		m := &pb.Metric{Id: metric.GetName()}
+		if len(c.labels) > 0 {
+			m.Labels = c.labels
+		}
+		switch metric := metric.(type) {
+		case MetricGauge:
+			m.Type = pb.MetricType_METRIC_TYPE_GAUGE
+			m.Value = metric.value
+		case MetricCounter:
+			m.Type = pb.MetricType_METRIC_TYPE_COUNTER
+			m.Delta = int64(metric.delta)
+		case MetricHistogram:
+			m.Type = pb.MetricType_METRIC_TYPE_HISTOGRAM
+			m.Histogram = &pb.Histogram{
+				Bounds: metric.value.Bounds,
+				Counts: metric.value.Counts,
+				Sum:    metric.value.Sum,
+				Count:  metric.value.Count,
+			}
+		default:
+			return nil, errors.New("unknown type of the metric")
+		}
+		request.Metrics = append(request.Metrics, m)
+	}
+
+	return request, nil
+}
+
+// isRetriableCode tells whether the RPC failed because the server is unavailable or overloaded and may succeed later
+func isRetriableCode(code codes.Code) bool {
+	return code == codes.Unavailable || code == codes.ResourceExhausted || code == codes.DeadlineExceeded || code == codes.Aborted
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/pb"
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGRPCClient_SendMetrics(t *testing.T) {
+	server := &metricsServerMock{failures: 1}
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	pb.RegisterMetricsServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	logger := zerolog.Nop()
+	client := NewGRPCClient(
+		&logger,
+		conn,
+		"secret",
+		map[string]string{"host": "a"},
+		NewRetryPolicy(time.Millisecond, time.Millisecond, time.Second),
+		WithKeyID("v1"),
+		WithRealIP(net.ParseIP("10.0.0.1")),
+	)
+	histogram, err := utils.NewHistogram([]float64{1})
+	require.Nil(t, err)
+	histogram.Observe(0.5)
+	require.Nil(t, client.SendMetrics(context.Background(), []IMetric{
+		MetricGauge{0.1, "Alloc"},
+		MetricCounter{5, "PollCount"},
+		MetricHistogram{histogram, "Latency"},
+	}))
+
+	// the first attempt fails with Unavailable and is retried
+	require.Equal(t, 2, server.calls)
+	require.Equal(t, []*pb.Metric{
+		{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 0.1, Labels: map[string]string{"host": "a"}},
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 5, Labels: map[string]string{"host": "a"}},
+		{
+			Id:        "Latency",
+			Type:      pb.MetricType_METRIC_TYPE_HISTOGRAM,
+			Histogram: &pb.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1},
+			Labels:    map[string]string{"host": "a"},
+		},
+	}, server.request.GetMetrics())
+
+	stringToHash, err := pb.SignString(server.request)
+	require.Nil(t, err)
+	expectedSign, err := utils.NewHashGenerator("secret").Generate(stringToHash)
+	require.Nil(t, err)
+	require.Equal(t, []string{expectedSign}, server.md.Get(pb.HashMetadataKey))
+	require.Equal(t, []string{"v1"}, server.md.Get(pb.KeyIDMetadataKey))
+	require.Equal(t, []string{"10.0.0.1"}, server.md.Get(pb.RealIPMetadataKey))
+
+	server.code = codes.InvalidArgument
+	require.NotNil(t, client.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}}))
+	require.Equal(t, 3, server.calls)
+}
+
+func TestGRPCClient_SendMetrics_RetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := &metricsServerMock{failures: 100, onCall: cancel}
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	pb.RegisterMetricsServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	logger := zerolog.Nop()
+	client := NewGRPCClient(&logger, conn, "", nil, NewRetryPolicy(time.Minute, time.Minute, time.Hour))
+	start := time.Now()
+	err = client.SendMetrics(ctx, []IMetric{MetricCounter{1, "PollCount"}})
+
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, server.calls)
+	require.Less(t, time.Since(start), time.Minute)
+}
+
+type metricsServerMock struct {
+	pb.UnimplementedMetricsServer
+	failures int
+	code     codes.Code
+	calls    int
+	request  *pb.UpdateMetricsRequest
+	md       metadata.MD
+	onCall   func()
+}
+
+func (s *metricsServerMock) UpdateMetrics(ctx context.Context, request *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	s.calls++
+	if s.onCall != nil {
+		s.onCall()
+	}
+	if s.calls <= s.failures {
+		return nil, status.Error(codes.Unavailable, "restarting")
+	}
+	if s.code != codes.OK {
+		return nil, status.Error(s.code, "rejected")
+	}
+	s.request = request
+	s.md, _ = metadata.FromIncomingContext(ctx)
+
+	return &pb.UpdateMetricsResponse{}, nil
+}
@@ -0,0 +1,375 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const diskSectorSize = 512
+
+// HostMetricProvider reports the metrics of the Linux machine read from the proc filesystem:
+// the memory from meminfo, the utilization of every CPU between the polls from stat, the load from loadavg,
+// the traffic of the network interfaces from net/dev, the IO of the disks from diskstats
+// and the usage of the file systems of the mount points.
+// The cumulative values of the kernel are reported as the counters with the deltas since the previous poll,
+// so nothing is reported for them on the first poll.
+type HostMetricProvider struct {
+	procPath    string
+	mountPoints []string
+	mu          sync.Mutex
+	// previous are the cumulative values of the previous poll by the names of the counters
+	previous map[string]uint64
+	// previousCPU are the times of the CPUs of the previous poll by the names of the gauges
+	previousCPU map[string]cpuTimes
+}
+
+func NewHostMetricProvider(procPath string, mountPoints []string) *HostMetricProvider {
+	return &HostMetricProvider{
+		procPath:    procPath,
+		mountPoints: mountPoints,
+		previous:    map[string]uint64{},
+		previousCPU: map[string]cpuTimes{},
+	}
+}
+
+// GetMetrics returns the metrics which could be read, the missing files of the proc filesystem are skipped.
+func (p *HostMetricProvider) GetMetrics() []IMetric {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var result []IMetric
+	if metrics, err := p.readMemInfo(); err == nil {
+		result = append(result, metrics...)
+	}
+	if metrics, err := p.readStat(); err == nil {
+		result = append(result, metrics...)
+	}
+	if metrics, err := p.readLoadAvg(); err == nil {
+		result = append(result, metrics...)
+	}
+	if metrics, err := p.readNetDev(); err == nil {
+		result = append(result, metrics...)
+	}
+	if metrics, err := p.readDiskStats(); err == nil {
+		result = append(result, metrics...)
+	}
+	for _, mountPoint := range p.mountPoints {
+		if metrics, err := mountPointMetrics(mountPoint); err == nil {
+			result = append(result, metrics...)
+		}
+	}
+
+	return result
+}
+
+// memInfoGauges are the fields of meminfo by the names of the gauges
+var memInfoGauges = []struct {
+	name  string
+	field string
+}{
+	{"TotalMemory", "MemTotal"},
+	{"FreeMemory", "MemFree"},
+	{"AvailableMemory", "MemAvailable"},
+	{"BuffersMemory", "Buffers"},
+	{"CachedMemory", "Cached"},
+	{"TotalSwap", "SwapTotal"},
+	{"FreeSwap", "SwapFree"},
+}
+
+// readMemInfo reports the memory in bytes
+func (p *HostMetricProvider) readMemInfo() ([]IMetric, error) {
+	lines, err := p.readLines("meminfo")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := parseProcFields(lines)
+
+	var result []IMetric
+	for _, gauge := range memInfoGauges {
+		if value, ok := fields[gauge.field]; ok {
+			result = append(result, MetricGauge{value, gauge.name})
+		}
+	}
+
+	return result, nil
+}
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// readStat reports the utilization of all the CPUs as CPUutilization and of every CPU as CPUutilizationN
+// numbered from 1, in percents. The context switches and the created processes are reported as the counters.
+func (p *HostMetricProvider) readStat() ([]IMetric, error) {
+	lines, err := p.readLines("stat")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []IMetric
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(fields[0], "cpu"):
+			name := "CPUutilization"
+			if fields[0] != "cpu" {
+				number, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+				if err != nil {
+					continue
+				}
+				name += strconv.Itoa(number + 1)
+			}
+			times, err := parseCPUTimes(fields[1:])
+			if err != nil {
+				continue
+			}
+			previous, ok := p.previousCPU[name]
+			p.previousCPU[name] = times
+			if !ok || times.total <= previous.total || times.idle < previous.idle {
+				continue
+			}
+			busy := float64((times.total-previous.total)-(times.idle-previous.idle)) / float64(times.total-previous.total)
+			result = append(result, MetricGauge{busy * 100, name})
+		case fields[0] == "ctxt":
+			result = p.appendCounter(result, "ContextSwitches", fields[1])
+		case fields[0] == "processes":
+			result = p.appendCounter(result, "ProcessesCreated", fields[1])
+		}
+	}
+
+	return result, nil
+}
+
+// parseCPUTimes parses the times of the CPU: user nice system idle iowait irq softirq steal guest guest_nice.
+// The guest times are already included into the user times, the idle time includes iowait.
+func parseCPUTimes(fields []string) (times cpuTimes, err error) {
+	if len(fields) < 4 {
+		return times, fmt.Errorf("too few times of the cpu: %d", len(fields))
+	}
+	for i, field := range fields {
+		if i >= 8 {
+			break
+		}
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return times, err
+		}
+		times.total += value
+		if i == 3 || i == 4 {
+			times.idle += value
+		}
+	}
+
+	return times, nil
+}
+
+// readLoadAvg reports the load averages and the numbers of the running and all the processes
+func (p *HostMetricProvider) readLoadAvg() ([]IMetric, error) {
+	lines, err := p.readLines("loadavg")
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty loadavg")
+	}
+
+	fields := strings.Fields(lines[0])
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("unexpected format of loadavg: %s", lines[0])
+	}
+
+	var result []IMetric
+	for i, name := range []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, MetricGauge{value, name})
+	}
+	if running, total, ok := strings.Cut(fields[3], "/"); ok {
+		for _, gauge := range []struct {
+			name  string
+			value string
+		}{{"ProcessesRunning", running}, {"ProcessesTotal", total}} {
+			value, err := strconv.ParseFloat(gauge.value, 64)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, MetricGauge{value, gauge.name})
+		}
+	}
+
+	return result, nil
+}
+
+// netDevCounters are the columns of net/dev after the name of the interface by the names of the counters
+var netDevCounters = []struct {
+	name   string
+	column int
+}{
+	{"NetworkReceivedBytes", 0},
+	{"NetworkReceivedPackets", 1},
+	{"NetworkReceiveErrors", 2},
+	{"NetworkReceiveDropped", 3},
+	{"NetworkTransmittedBytes", 8},
+	{"NetworkTransmittedPackets", 9},
+	{"NetworkTransmitErrors", 10},
+	{"NetworkTransmitDropped", 11},
+}
+
+// readNetDev reports the traffic of every network interface as the counters with the name of the interface appended,
+// e.g. NetworkReceivedBytes_eth0
+func (p *HostMetricProvider) readNetDev() ([]IMetric, error) {
+	lines, err := p.readLines(filepath.Join("net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []IMetric
+	for _, line := range lines {
+		iface, values, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		iface = strings.TrimSpace(iface)
+		fields := strings.Fields(values)
+		if len(fields) < 16 {
+			continue
+		}
+		for _, counter := range netDevCounters {
+			result = p.appendCounter(result, counter.name+"_"+sanitizeMetricNamePart(iface), fields[counter.column])
+		}
+	}
+
+	return result, nil
+}
+
+// readDiskStats reports the IO of every disk as the counters with the name of the disk appended, e.g. DiskReads_sda.
+// The loop and ram devices are skipped.
+func (p *HostMetricProvider) readDiskStats() ([]IMetric, error) {
+	lines, err := p.readLines("diskstats")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []IMetric
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 14 {
+			continue
+		}
+		device := fields[2]
+		if strings.HasPrefix(device, "loop") || strings.HasPrefix(device, "ram") {
+			continue
+		}
+		suffix := "_" + sanitizeMetricNamePart(device)
+		result = p.appendCounter(result, "DiskReads"+suffix, fields[3])
+		result = p.appendSectorsCounter(result, "DiskReadBytes"+suffix, fields[5])
+		result = p.appendCounter(result, "DiskWrites"+suffix, fields[7])
+		result = p.appendSectorsCounter(result, "DiskWrittenBytes"+suffix, fields[9])
+		result = p.appendCounter(result, "DiskIOTimeMs"+suffix, fields[12])
+	}
+
+	return result, nil
+}
+
+func (p *HostMetricProvider) appendSectorsCounter(metrics []IMetric, name string, sectors string) []IMetric {
+	value, err := strconv.ParseUint(sectors, 10, 64)
+	if err != nil {
+		return metrics
+	}
+
+	return p.appendCounter(metrics, name, strconv.FormatUint(value*diskSectorSize, 10))
+}
+
+// appendCounter appends the counter with the delta of the cumulative value since the previous poll.
+// Nothing is appended on the first poll and after the value is reset.
+func (p *HostMetricProvider) appendCounter(metrics []IMetric, name string, cumulative string) []IMetric {
+	value, err := strconv.ParseUint(cumulative, 10, 64)
+	if err != nil {
+		return metrics
+	}
+
+	previous, ok := p.previous[name]
+	p.previous[name] = value
+	if !ok || value < previous {
+		return metrics
+	}
+
+	return append(metrics, MetricCounter{int(value - previous), name})
+}
+
+func (p *HostMetricProvider) readLines(name string) ([]string, error) {
+	return readProcLines(p.procPath, name)
+}
+
+// parseProcFields parses the lines like "MemTotal:  2048 kB" of meminfo and status, the sizes are returned in bytes.
+func parseProcFields(lines []string) map[string]float64 {
+	fields := map[string]float64{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		parts := strings.Fields(value)
+		if len(parts) == 0 {
+			continue
+		}
+		number, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			continue
+		}
+		if len(parts) > 1 && parts[1] == "kB" {
+			number *= 1024
+		}
+		fields[name] = number
+	}
+
+	return fields
+}
+
+func readProcLines(procPath string, name string) ([]string, error) {
+	file, err := os.Open(filepath.Join(procPath, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+// mountPointName is the part of the names of the metrics of the mount point, "root" for "/", e.g. "var_lib" for "/var/lib"
+func mountPointName(mountPoint string) string {
+	name := strings.Trim(filepath.Clean(mountPoint), "/")
+	if name == "" {
+		return "root"
+	}
+
+	return sanitizeMetricNamePart(name)
+}
+
+// sanitizeMetricNamePart replaces all the characters except the letters, the digits and "_" with "_"
+func sanitizeMetricNamePart(value string) string {
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			return c
+		}
+		return '_'
+	}, value)
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHostMetricProvider_GetMetrics(t *testing.T) {
+	provider := NewHostMetricProvider(filepath.Join("testdata", "proc", "first"), nil)
+
+	// the counters and the utilization of the CPUs are reported since the second poll
+	require.Equal(t, []IMetric{
+		MetricGauge{2048000 * 1024, "TotalMemory"},
+		MetricGauge{512000 * 1024, "FreeMemory"},
+		MetricGauge{1024000 * 1024, "AvailableMemory"},
+		MetricGauge{64000 * 1024, "BuffersMemory"},
+		MetricGauge{256000 * 1024, "CachedMemory"},
+		MetricGauge{1000000 * 1024, "TotalSwap"},
+		MetricGauge{900000 * 1024, "FreeSwap"},
+		MetricGauge{0.5, "LoadAverage1"},
+		MetricGauge{0.25, "LoadAverage5"},
+		MetricGauge{0.1, "LoadAverage15"},
+		MetricGauge{2, "ProcessesRunning"},
+		MetricGauge{150, "ProcessesTotal"},
+	}, provider.GetMetrics())
+
+	provider.procPath = filepath.Join("testdata", "proc", "second")
+	metrics := provider.GetMetrics()
+
+	cpu := map[string]float64{}
+	var rest []IMetric
+	for _, metric := range metrics {
+		if gauge, ok := metric.(MetricGauge); ok && strings.HasPrefix(gauge.name, "CPUutilization") {
+			cpu[gauge.name] = gauge.value
+			continue
+		}
+		rest = append(rest, metric)
+	}
+	require.Len(t, cpu, 3)
+	require.InDelta(t, 45, cpu["CPUutilization"], 1e-9)
+	require.InDelta(t, 75, cpu["CPUutilization1"], 1e-9)
+	require.InDelta(t, 25, cpu["CPUutilization2"], 1e-9)
+
+	require.Equal(t, []IMetric{
+		MetricGauge{2048000 * 1024, "TotalMemory"},
+		MetricGauge{256000 * 1024, "FreeMemory"},
+		MetricGauge{768000 * 1024, "AvailableMemory"},
+		MetricGauge{64000 * 1024, "BuffersMemory"},
+		MetricGauge{256000 * 1024, "CachedMemory"},
+		MetricGauge{1000000 * 1024, "TotalSwap"},
+		MetricGauge{800000 * 1024, "FreeSwap"},
+		MetricCounter{250, "ContextSwitches"},
+		MetricCounter{10, "ProcessesCreated"},
+		MetricGauge{1.5, "LoadAverage1"},
+		MetricGauge{0.75, "LoadAverage5"},
+		MetricGauge{0.3, "LoadAverage15"},
+		MetricGauge{3, "ProcessesRunning"},
+		MetricGauge{160, "ProcessesTotal"},
+		MetricCounter{500, "NetworkReceivedBytes_lo"},
+		MetricCounter{5, "NetworkReceivedPackets_lo"},
+		MetricCounter{0, "NetworkReceiveErrors_lo"},
+		MetricCounter{0, "NetworkReceiveDropped_lo"},
+		MetricCounter{500, "NetworkTransmittedBytes_lo"},
+		MetricCounter{5, "NetworkTransmittedPackets_lo"},
+		MetricCounter{0, "NetworkTransmitErrors_lo"},
+		MetricCounter{0, "NetworkTransmitDropped_lo"},
+		MetricCounter{100000, "NetworkReceivedBytes_eth0"},
+		MetricCounter{100, "NetworkReceivedPackets_eth0"},
+		MetricCounter{0, "NetworkReceiveErrors_eth0"},
+		MetricCounter{1, "NetworkReceiveDropped_eth0"},
+		MetricCounter{50000, "NetworkTransmittedBytes_eth0"},
+		MetricCounter{100, "NetworkTransmittedPackets_eth0"},
+		MetricCounter{0, "NetworkTransmitErrors_eth0"},
+		MetricCounter{0, "NetworkTransmitDropped_eth0"},
+		MetricCounter{10, "DiskReads_sda"},
+		MetricCounter{100 * 512, "DiskReadBytes_sda"},
+		MetricCounter{20, "DiskWrites_sda"},
+		MetricCounter{200 * 512, "DiskWrittenBytes_sda"},
+		MetricCounter{50, "DiskIOTimeMs_sda"},
+	}, rest)
+}
+
+func TestHostMetricProvider_MissingProc(t *testing.T) {
+	provider := NewHostMetricProvider(filepath.Join("testdata", "proc", "missing"), nil)
+	require.Empty(t, provider.GetMetrics())
+}
+
+func TestMountPointName(t *testing.T) {
+	require.Equal(t, "root", mountPointName("/"))
+	require.Equal(t, "var_lib", mountPointName("/var/lib/"))
+	require.Equal(t, "mnt_my_disk", mountPointName("/mnt/my-disk"))
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package agent
+
+import (
+	"syscall"
+)
+
+// mountPointMetrics reports the usage of the file system of the mount point in bytes, e.g. DiskTotal_root.
+// The free space is the space available to the unprivileged users.
+func mountPointMetrics(mountPoint string) ([]IMetric, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return nil, err
+	}
+
+	suffix := "_" + mountPointName(mountPoint)
+	blockSize := float64(stat.Bsize)
+	total := float64(stat.Blocks) * blockSize
+	free := float64(stat.Bavail) * blockSize
+	used := float64(stat.Blocks-stat.Bfree) * blockSize
+
+	result := []IMetric{
+		MetricGauge{total, "DiskTotal" + suffix},
+		MetricGauge{free, "DiskFree" + suffix},
+		MetricGauge{used, "DiskUsed" + suffix},
+	}
+	if used+free > 0 {
+		result = append(result, MetricGauge{used / (used + free) * 100, "DiskUsedPercent" + suffix})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package agent
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMountPointMetrics(t *testing.T) {
+	metrics, err := mountPointMetrics("/")
+	require.Nil(t, err)
+	require.Len(t, metrics, 4)
+
+	values := map[string]float64{}
+	for _, metric := range metrics {
+		gauge, ok := metric.(MetricGauge)
+		require.True(t, ok)
+		values[gauge.name] = gauge.value
+	}
+	require.Greater(t, values["DiskTotal_root"], float64(0))
+	require.LessOrEqual(t, values["DiskUsed_root"], values["DiskTotal_root"])
+	require.GreaterOrEqual(t, values["DiskUsedPercent_root"], float64(0))
+	require.LessOrEqual(t, values["DiskUsedPercent_root"], float64(100))
+
+	_, err = mountPointMetrics("/nonexistent/mount/point")
+	require.NotNil(t, err)
+}
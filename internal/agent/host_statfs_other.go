@@ -0,0 +1,11 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+)
+
+func mountPointMetrics(mountPoint string) ([]IMetric, error) {
+	return nil, errors.New("the usage of the mount points is supported only on linux")
+}
@@ -1,6 +1,13 @@
 package agent
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/smamykin/smetrics/internal/utils"
+	"sync"
+	"time"
+)
 
 type IMetric interface {
 	fmt.Stringer
@@ -8,35 +15,68 @@ type IMetric interface {
 	GetName() string
 }
 
+// IClient sends the batch of the metrics, the retries stop when the context is cancelled
 type IClient interface {
-	SendMetrics(metrics []IMetric) error
+	SendMetrics(ctx context.Context, metrics []IMetric) error
 }
 
+// IMetricProvider provides the current metrics. The values of the counters are the deltas since the previous call.
 type IMetricProvider interface {
-	GetMetrics(pollCounter int) []IMetric
+	GetMetrics() []IMetric
 }
 
+// MetricAgent polls the metrics from the Provider and sends them with the Client. The polled metrics are aggregated
+// between the reports, so every report carries one entry per metric.
 type MetricAgent struct {
-	container []IMetric
-	Client    IClient
-	Provider  IMetricProvider
-	counter   int
+	Client   IClient
+	Provider IMetricProvider
+	// HistogramBounds are the bounds of the buckets of the observed histograms, utils.DefaultHistogramBounds if empty
+	HistogramBounds []float64
+	// GaugeAggregates are reported for every gauge in addition to its last value, see GaugeAggregateMin etc.
+	GaugeAggregates []string
+	tableOnce       sync.Once
+	table           *aggregationTable
 }
 
 func (mc *MetricAgent) GatherMetrics() {
-	mc.counter++
-	mc.container = append(mc.container, mc.Provider.GetMetrics(mc.counter)...)
+	start := time.Now()
+	mc.aggregationTable().add(mc.Provider.GetMetrics())
+	mc.Observe("PollDuration", time.Since(start).Seconds())
 }
 
-func (mc *MetricAgent) SendMetrics() {
-	defer mc.reset()
+// Add aggregates the metrics polled elsewhere, e.g. by CollectorRegistry, with the metrics of the Provider.
+func (mc *MetricAgent) Add(metrics []IMetric) {
+	mc.aggregationTable().add(metrics)
+}
 
-	mc.Client.SendMetrics(mc.container)
+// Observe adds the value to the histogram with the given name. The histograms are sent with the other metrics
+// and start over after that, so the server gets the observations made since the previous report.
+func (mc *MetricAgent) Observe(name string, value float64) {
+	bounds := mc.HistogramBounds
+	if len(bounds) == 0 {
+		bounds = utils.DefaultHistogramBounds
+	}
+	mc.aggregationTable().observe(name, bounds, value)
+}
+
+// SendMetrics passes the aggregated metrics to the Client. The Client is expected to be the Sender,
+// which only queues the batch, so the sending is not bound to the context of the caller.
+// The batch which doesn't fit into the queue is aggregated back and goes with the next report,
+// the SendQueueFull counter reports how many times it happened.
+func (mc *MetricAgent) SendMetrics() {
+	table := mc.aggregationTable()
+	entries := table.takeEntries()
+	err := mc.Client.SendMetrics(context.Background(), table.metrics(entries))
+	if errors.Is(err, ErrSendQueueFull) {
+		table.restore(entries)
+		table.add([]IMetric{MetricCounter{1, "SendQueueFull"}})
+	}
 }
 
-func (mc *MetricAgent) reset() *MetricAgent {
-	mc.container = []IMetric{}
-	mc.counter = 0
+func (mc *MetricAgent) aggregationTable() *aggregationTable {
+	mc.tableOnce.Do(func() {
+		mc.table = newAggregationTable(mc.GaugeAggregates)
+	})
 
-	return mc
+	return mc.table
 }
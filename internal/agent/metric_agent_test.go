@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"context"
+	"github.com/smamykin/smetrics/internal/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"strconv"
@@ -8,47 +10,112 @@ import (
 )
 
 func TestMetricAgent_GatherMetrics(t *testing.T) {
+	clientMock := apiClientMock{0, []IMetric{
+		MetricGauge{2, "metricTestName1"},
+		MetricCounter{3, "metricTestName2"},
+	}, t}
 	ma := &MetricAgent{
-		container: []IMetric{},
-		Client:    &apiClientMock{},
-		Provider:  &providerMock{0},
+		Client:          &clientMock,
+		Provider:        &providerMock{},
+		HistogramBounds: []float64{1},
 	}
 	ma.GatherMetrics()
-	require.Equal(t, []IMetric{
-		metricMock{"1", "gauge", "metricTestName1"},
-		metricMock{"1", "counter", "metricTestName2"},
-	}, ma.container)
-
 	ma.GatherMetrics()
-	require.Equal(t, []IMetric{
-		metricMock{"1", "gauge", "metricTestName1"},
-		metricMock{"1", "counter", "metricTestName2"},
-		metricMock{"2", "gauge", "metricTestName1"},
-		metricMock{"2", "counter", "metricTestName2"},
-	}, ma.container)
+
+	metrics := ma.aggregationTable().take()
+	require.Len(t, metrics, 3)
+	// one entry per metric: the last value of the gauge and the sum of the deltas of the counter
+	require.Equal(t, clientMock.expectedArgs, metrics[:2])
+	pollDuration, ok := metrics[2].(MetricHistogram)
+	require.True(t, ok)
+	require.Equal(t, "PollDuration", pollDuration.name)
+	require.Equal(t, int64(2), pollDuration.value.Count)
 }
 
 func TestMetricAgent_SendMetrics(t *testing.T) {
 	clientMock := apiClientMock{0, []IMetric{
-		metricMock{"11", "gauge", "metricTestName1"},
-		metricMock{"22", "counter", "metricTestName2"},
-		metricMock{"22", "gauge", "metricTestName1"},
-		metricMock{"33", "counter", "metricTestName2"},
+		MetricGauge{2, "metricTestName1"},
+		MetricGauge{1, "metricTestName1_min"},
+		MetricGauge{2, "metricTestName1_max"},
+		MetricGauge{1.5, "metricTestName1_avg"},
+		MetricCounter{3, "metricTestName2"},
+	}, t}
+	ma := &MetricAgent{
+		Client:          &clientMock,
+		Provider:        &providerMock{},
+		GaugeAggregates: []string{GaugeAggregateMin, GaugeAggregateMax, GaugeAggregateAvg},
+	}
+	provider := providerMock{}
+	ma.aggregationTable().add(provider.GetMetrics())
+	ma.aggregationTable().add(provider.GetMetrics())
+
+	ma.SendMetrics()
+	require.Equal(t, 1, clientMock.invokedTimes)
+
+	// the aggregation starts over after sending
+	clientMock.expectedArgs = []IMetric{}
+	ma.SendMetrics()
+	require.Equal(t, 2, clientMock.invokedTimes)
+}
+
+func TestMetricAgent_SendMetrics_QueueFull(t *testing.T) {
+	client := &failingClientMock{err: ErrSendQueueFull}
+	ma := &MetricAgent{
+		Client:          client,
+		GaugeAggregates: []string{GaugeAggregateMax},
+	}
+	ma.Add([]IMetric{MetricGauge{3, "Alloc"}, MetricCounter{1, "PollCount"}})
+	ma.SendMetrics()
+
+	// the rejected batch goes with the next report, the newer value of the gauge wins
+	client.err = nil
+	ma.Add([]IMetric{MetricGauge{2, "Alloc"}, MetricCounter{2, "PollCount"}})
+	ma.SendMetrics()
+	require.Equal(t, []IMetric{
+		MetricGauge{2, "Alloc"},
+		MetricGauge{3, "Alloc_max"},
+		MetricCounter{3, "PollCount"},
+		MetricCounter{1, "SendQueueFull"},
+	}, client.sent[len(client.sent)-1])
+}
+
+func TestParseGaugeAggregates(t *testing.T) {
+	aggregates, err := ParseGaugeAggregates("min, avg")
+	require.Nil(t, err)
+	require.Equal(t, []string{GaugeAggregateMin, GaugeAggregateAvg}, aggregates)
+
+	aggregates, err = ParseGaugeAggregates("")
+	require.Nil(t, err)
+	require.Empty(t, aggregates)
+
+	_, err = ParseGaugeAggregates("median")
+	require.NotNil(t, err)
+}
+
+func TestMetricAgent_Observe(t *testing.T) {
+	histogram, err := utils.NewHistogram([]float64{1, 2})
+	require.Nil(t, err)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	clientMock := apiClientMock{0, []IMetric{
+		MetricHistogram{histogram, "latency"},
 	}, t}
 	ma := &MetricAgent{
-		container: []IMetric{
-			metricMock{"11", "gauge", "metricTestName1"},
-			metricMock{"22", "counter", "metricTestName2"},
-			metricMock{"22", "gauge", "metricTestName1"},
-			metricMock{"33", "counter", "metricTestName2"},
-		},
-		Client:   &clientMock,
-		Provider: &providerMock{},
+		Client:          &clientMock,
+		Provider:        &providerMock{},
+		HistogramBounds: []float64{1, 2},
 	}
+	ma.Observe("latency", 0.5)
+	ma.Observe("latency", 3)
 
 	ma.SendMetrics()
-	require.Empty(t, ma.container)
 	require.Equal(t, 1, clientMock.invokedTimes)
+
+	// the observations start over after sending
+	clientMock.expectedArgs = []IMetric{}
+	ma.SendMetrics()
+	require.Equal(t, 2, clientMock.invokedTimes)
 }
 
 type apiClientMock struct {
@@ -57,7 +124,7 @@ type apiClientMock struct {
 	t            *testing.T
 }
 
-func (a *apiClientMock) SendMetrics(metrics []IMetric) error {
+func (a *apiClientMock) SendMetrics(_ context.Context, metrics []IMetric) error {
 	assert.Equal(a.t, a.expectedArgs, metrics)
 	a.invokedTimes++
 	return nil
@@ -84,17 +151,10 @@ func (m metricMock) GetType() string {
 	return m.typeOfMetric
 }
 
-func (p *providerMock) GetMetrics(pollCounter int) []IMetric {
+func (p *providerMock) GetMetrics() []IMetric {
 	p.invokedCount++
-	if p.invokedCount == 1 {
-		return []IMetric{
-			metricMock{"1", "gauge", "metricTestName1"},
-			metricMock{strconv.Itoa(pollCounter), "counter", "metricTestName2"},
-		}
-	}
-
 	return []IMetric{
-		metricMock{"2", "gauge", "metricTestName1"},
-		metricMock{strconv.Itoa(pollCounter), "counter", "metricTestName2"},
+		metricMock{strconv.Itoa(p.invokedCount), "gauge", "metricTestName1"},
+		metricMock{strconv.Itoa(p.invokedCount), "counter", "metricTestName2"},
 	}
 }
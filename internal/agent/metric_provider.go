@@ -2,18 +2,20 @@ package agent
 
 import (
 	"fmt"
+	"github.com/smamykin/smetrics/internal/utils"
 	"math/rand"
 	"runtime"
 )
 
 const (
-	MetricTypeGauge   = "gauge"
-	MetricTypeCounter = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeCounter   = "counter"
+	MetricTypeHistogram = "histogram"
 )
 
 type MetricProvider struct{}
 
-func (mp *MetricProvider) GetMetrics(pollCounter int) []IMetric {
+func (mp *MetricProvider) GetMetrics() []IMetric {
 	var memStats = runtime.MemStats{}
 	runtime.ReadMemStats(&memStats)
 
@@ -47,7 +49,7 @@ func (mp *MetricProvider) GetMetrics(pollCounter int) []IMetric {
 		MetricGauge{float64(memStats.TotalAlloc), "TotalAlloc"},
 
 		//custom
-		MetricCounter{pollCounter, "PollCount"},
+		MetricCounter{1, "PollCount"},
 		MetricGauge{rand.Float64(), "RandomValue"},
 	}
 
@@ -82,3 +84,18 @@ func (m MetricCounter) GetType() string {
 func (m MetricCounter) String() string {
 	return fmt.Sprintf("%d", m.delta)
 }
+
+type MetricHistogram struct {
+	value utils.Histogram
+	name  string
+}
+
+func (m MetricHistogram) GetName() string {
+	return m.name
+}
+func (m MetricHistogram) GetType() string {
+	return MetricTypeHistogram
+}
+func (m MetricHistogram) String() string {
+	return fmt.Sprintf("count=%d sum=%f", m.value.Count, m.value.Sum)
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// OutboundIP returns the address of the interface the requests to the server go through.
+// Connecting the UDP socket only chooses the route, no packets are sent.
+func OutboundIP(serverAddress string) (net.IP, error) {
+	host := serverAddress
+	if u, err := url.Parse(serverAddress); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the outbound address: %w", err)
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+	}
+
+	return addr.IP, nil
+}
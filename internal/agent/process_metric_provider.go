@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ProcessMetricProvider reports the metrics of the agent process read from the self directory of the proc filesystem:
+// the memory and the threads from status and the number of the open files, and the number of the goroutines.
+type ProcessMetricProvider struct {
+	procPath string
+}
+
+func NewProcessMetricProvider(procPath string) *ProcessMetricProvider {
+	return &ProcessMetricProvider{procPath: procPath}
+}
+
+// processStatusGauges are the fields of status by the names of the gauges
+var processStatusGauges = []struct {
+	name  string
+	field string
+}{
+	{"ProcessResidentMemory", "VmRSS"},
+	{"ProcessVirtualMemory", "VmSize"},
+	{"ProcessThreads", "Threads"},
+}
+
+func (p *ProcessMetricProvider) GetMetrics() []IMetric {
+	var result []IMetric
+	if lines, err := readProcLines(p.procPath, filepath.Join("self", "status")); err == nil {
+		fields := parseProcFields(lines)
+		for _, gauge := range processStatusGauges {
+			if value, ok := fields[gauge.field]; ok {
+				result = append(result, MetricGauge{value, gauge.name})
+			}
+		}
+	}
+
+	if entries, err := os.ReadDir(filepath.Join(p.procPath, "self", "fd")); err == nil {
+		result = append(result, MetricGauge{float64(len(entries)), "ProcessOpenFiles"})
+	}
+
+	return append(result, MetricGauge{float64(runtime.NumGoroutine()), "ProcessGoroutines"})
+}
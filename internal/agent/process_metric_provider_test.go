@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessMetricProvider_GetMetrics(t *testing.T) {
+	provider := NewProcessMetricProvider(filepath.Join("testdata", "proc", "first"))
+
+	metrics := provider.GetMetrics()
+	require.Len(t, metrics, 5)
+	require.Equal(t, []IMetric{
+		MetricGauge{25000 * 1024, "ProcessResidentMemory"},
+		MetricGauge{750000 * 1024, "ProcessVirtualMemory"},
+		MetricGauge{12, "ProcessThreads"},
+		MetricGauge{4, "ProcessOpenFiles"},
+	}, metrics[:4])
+	require.Equal(t, "ProcessGoroutines", metrics[4].GetName())
+}
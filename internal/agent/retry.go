@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy describes how the failed requests are retried. The interval before the n-th retry is
+// InitialInterval * Multiplier^(n-1) but not more than MaxInterval, randomized by ±RandomizationFactor.
+// The retries stop once MaxElapsedTime passes since the first attempt, zero MaxElapsedTime disables the retries.
+type RetryPolicy struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	RandomizationFactor float64
+	MaxElapsedTime      time.Duration
+}
+
+func NewRetryPolicy(initialInterval time.Duration, maxInterval time.Duration, maxElapsedTime time.Duration) RetryPolicy {
+	return RetryPolicy{
+		InitialInterval:     initialInterval,
+		MaxInterval:         maxInterval,
+		Multiplier:          2,
+		RandomizationFactor: 0.5,
+		MaxElapsedTime:      maxElapsedTime,
+	}
+}
+
+// backoff returns the randomized interval before the retry with the given number starting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	interval := float64(p.InitialInterval) * math.Pow(p.Multiplier, float64(retry-1))
+	if p.MaxInterval > 0 && interval > float64(p.MaxInterval) {
+		interval = float64(p.MaxInterval)
+	}
+
+	delta := p.RandomizationFactor * interval
+	return time.Duration(interval - delta + rand.Float64()*2*delta)
+}
+
+// isRetriable tells whether the batch which the client failed to send may be accepted later, so it's worth keeping:
+// the retries are exhausted or interrupted. The batches rejected by the server, e.g. with 400, are not.
+func isRetriable(err error) bool {
+	var retriable *retriableError
+
+	return errors.As(err, &retriable) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isRetriableError tells whether the request failed because of the network and may succeed later,
+// e.g. the connection is refused while the server restarts.
+func isRetriableError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isRetriableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// parseRetryAfter parses the value of the Retry-After header, which is either the number of seconds or the HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if date.Before(now) {
+			return 0, true
+		}
+		return date.Sub(now), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := NewRetryPolicy(100*time.Millisecond, time.Second, time.Minute)
+
+	for i := 0; i < 100; i++ {
+		require.GreaterOrEqual(t, policy.backoff(1), 50*time.Millisecond)
+		require.LessOrEqual(t, policy.backoff(1), 150*time.Millisecond)
+		require.GreaterOrEqual(t, policy.backoff(3), 200*time.Millisecond)
+		require.LessOrEqual(t, policy.backoff(3), 600*time.Millisecond)
+		require.GreaterOrEqual(t, policy.backoff(10), 500*time.Millisecond)
+		require.LessOrEqual(t, policy.backoff(10), 1500*time.Millisecond)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("120", now)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, wait)
+
+	_, ok = parseRetryAfter("soon", now)
+	require.False(t, ok)
+
+	_, ok = parseRetryAfter("", now)
+	require.False(t, ok)
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"sync"
+)
+
+var ErrSendQueueFull = errors.New("the queue of the batches to send is full")
+var ErrSenderClosed = errors.New("the sender is closed")
+
+// Sender decouples the sending of the metrics from their gathering. SendMetrics only puts the batch into
+// the bounded queue, and the pool of the workers sends the batches with the Client,
+// so at most RateLimit requests are made to the server at the same time.
+type Sender struct {
+	client  IClient
+	ctx     context.Context
+	logger  *zerolog.Logger
+	jobs    chan []IMetric
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+	started sync.Once
+	workers int
+}
+
+func NewSender(logger *zerolog.Logger, client IClient, rateLimit int, queueSize int) (*Sender, error) {
+	if rateLimit <= 0 {
+		return nil, fmt.Errorf("the rate limit must be positive, got %d", rateLimit)
+	}
+	if queueSize < 0 {
+		return nil, fmt.Errorf("the size of the queue must not be negative, got %d", queueSize)
+	}
+
+	return &Sender{
+		client:  client,
+		logger:  logger,
+		jobs:    make(chan []IMetric, queueSize),
+		workers: rateLimit,
+	}, nil
+}
+
+// Start starts the workers, the batches put into the queue before are sent as well.
+// The workers stop retrying the failed batches when the context is cancelled.
+func (s *Sender) Start(ctx context.Context) {
+	s.started.Do(func() {
+		s.ctx = ctx
+		for i := 0; i < s.workers; i++ {
+			s.wg.Add(1)
+			go s.work()
+		}
+	})
+}
+
+// SendMetrics puts the batch into the queue without waiting for the sending.
+// The batch is rejected with ErrSendQueueFull if the workers cannot keep up with the gathering,
+// the caller keeps it then, see MetricAgent.SendMetrics.
+func (s *Sender) SendMetrics(_ context.Context, metrics []IMetric) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ErrSenderClosed
+	}
+
+	select {
+	case s.jobs <- metrics:
+		return nil
+	default:
+		s.logger.Warn().Msgf("the queue of the batches to send is full, the batch of %d metrics is rejected", len(metrics))
+		return ErrSendQueueFull
+	}
+}
+
+// Close stops accepting the batches and waits until the queued ones are sent.
+func (s *Sender) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.jobs)
+	s.mu.Unlock()
+
+	s.Start(context.Background())
+	s.wg.Wait()
+}
+
+func (s *Sender) work() {
+	defer s.wg.Done()
+
+	for metrics := range s.jobs {
+		if err := s.client.SendMetrics(s.ctx, metrics); err != nil {
+			s.logger.Warn().Err(err).Msg("unable to send the metrics")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSender_RateLimit(t *testing.T) {
+	var inFlight, maxInFlight, received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			observed := atomic.LoadInt64(&maxInFlight)
+			if current <= observed || atomic.CompareAndSwapInt64(&maxInFlight, observed, current) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt64(&received, 1)
+	}))
+	defer server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), nil)
+	sender, err := NewSender(&logger, client, 3, 20)
+	require.Nil(t, err)
+	sender.Start(context.Background())
+
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		require.Nil(t, sender.SendMetrics(context.Background(), []IMetric{MetricCounter{i, "PollCount"}}))
+	}
+	// the batches are only queued, the gathering doesn't wait for the slow server
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	sender.Close()
+	require.Equal(t, int64(12), atomic.LoadInt64(&received))
+	require.Equal(t, int64(3), atomic.LoadInt64(&maxInFlight))
+	require.ErrorIs(t, sender.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}}), ErrSenderClosed)
+}
+
+func TestSender_QueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt64(&received, 1)
+	}))
+	defer server.Close()
+
+	logger := zerolog.Nop()
+	client := NewClient(&logger, server.URL, "", nil, NewRetryPolicy(time.Millisecond, time.Millisecond, 0), nil)
+	sender, err := NewSender(&logger, client, 1, 1)
+	require.Nil(t, err)
+
+	// the queue holds one batch until the workers are started
+	require.Nil(t, sender.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}}))
+	require.ErrorIs(t, sender.SendMetrics(context.Background(), []IMetric{MetricCounter{2, "PollCount"}}), ErrSendQueueFull)
+
+	sender.Start(context.Background())
+	close(release)
+	sender.Close()
+	require.Equal(t, int64(1), atomic.LoadInt64(&received))
+
+	_, err = NewSender(&logger, client, 0, 1)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentPrefix = "segment-"
+	spoolSegmentSuffix = ".spool"
+	// spoolRecordHeaderSize is the length and the CRC32 checksum of the payload
+	spoolRecordHeaderSize = 8
+	// spoolSegmentsPerSize is how many segments fit into the max size of the spool,
+	// the oldest segment is dropped when the spool is full
+	spoolSegmentsPerSize = 4
+)
+
+var ErrSpoolRecordTooLarge = errors.New("record is larger than the spool")
+
+// Spool is the on-disk queue of the records. The records are appended to the segment files,
+// every record is prefixed with its length and checksum, so the record torn by a crash is detected on reading.
+// When the total size of the segments exceeds the max size, the oldest segments are removed.
+type Spool struct {
+	mu          sync.Mutex
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	segments    []spoolSegment
+	// isLastWritable tells whether the last segment is written by this process. The segments left by
+	// the previous run are not appended, because their tails might be corrupted.
+	isLastWritable bool
+	nextSeq        uint64
+	// inFlight are the segments being replayed, the other replays skip them
+	inFlight map[uint64]bool
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+func NewSpool(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("max size of the spool must be positive, got %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	spool := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: maxSize / spoolSegmentsPerSize,
+		inFlight:    map[uint64]bool{},
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, spoolSegmentPrefix) || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, spoolSegmentPrefix), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		spool.segments = append(spool.segments, spoolSegment{seq: seq, size: info.Size()})
+		if seq >= spool.nextSeq {
+			spool.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(spool.segments, func(i, j int) bool {
+		return spool.segments[i].seq < spool.segments[j].seq
+	})
+
+	return spool, nil
+}
+
+// Append writes the record to the end of the queue and drops the oldest segments if the spool is full.
+// It returns the number of the dropped records.
+func (s *Spool) Append(payload []byte) (dropped int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recordSize := int64(spoolRecordHeaderSize + len(payload))
+	if recordSize > s.maxSize {
+		return 0, ErrSpoolRecordTooLarge
+	}
+
+	if !s.isLastWritable || s.segments[len(s.segments)-1].size+recordSize > s.segmentSize {
+		s.segments = append(s.segments, spoolSegment{seq: s.nextSeq})
+		s.isLastWritable = true
+		s.nextSeq++
+	}
+	current := &s.segments[len(s.segments)-1]
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolRecordHeaderSize:], payload)
+
+	file, err := os.OpenFile(s.segmentPath(current.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Write(record)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	current.size += recordSize
+
+	for s.totalSize() > s.maxSize && len(s.segments) > 1 {
+		records, _ := readSpoolSegment(s.segmentPath(s.segments[0].seq))
+		if err = s.removeOldest(); err != nil {
+			return dropped, err
+		}
+		dropped += len(records)
+	}
+
+	return dropped, nil
+}
+
+// Replay passes all the records to send, the oldest first. If send succeeds, the records are removed from the queue,
+// otherwise they are left for the next replay. The spool isn't locked while send runs: the records are appended
+// to the new segments meanwhile, and the concurrent replays skip the segments being replayed.
+// The rest of the segment after a corrupted record is skipped.
+func (s *Spool) Replay(send func(payloads [][]byte) error) error {
+	seqs := s.take()
+	if len(seqs) == 0 {
+		return nil
+	}
+	defer s.release(seqs)
+
+	var payloads [][]byte
+	for _, seq := range seqs {
+		records, err := readSpoolSegment(s.segmentPath(seq))
+		if err != nil && !errors.Is(err, errSpoolCorruptedRecord) {
+			return err
+		}
+		payloads = append(payloads, records...)
+	}
+
+	if err := send(payloads); err != nil {
+		return err
+	}
+
+	return s.remove(seqs)
+}
+
+// take marks the segments, which aren't being replayed yet, as being replayed and returns them
+func (s *Spool) take() (seqs []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, segment := range s.segments {
+		if !s.inFlight[segment.seq] {
+			s.inFlight[segment.seq] = true
+			seqs = append(seqs, segment.seq)
+		}
+	}
+	// the records appended during the replay go to the next segment, so they aren't removed with the replayed ones
+	s.isLastWritable = false
+
+	return seqs
+}
+
+func (s *Spool) release(seqs []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seq := range seqs {
+		delete(s.inFlight, seq)
+	}
+}
+
+// remove removes the replayed segments, some of them might be already dropped by Append if the spool was full
+func (s *Spool) remove(seqs []uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	isRemoved := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		isRemoved[seq] = true
+	}
+	segments := s.segments[:0]
+	var err error
+	for _, segment := range s.segments {
+		if !isRemoved[segment.seq] {
+			segments = append(segments, segment)
+			continue
+		}
+		if removeErr := os.Remove(s.segmentPath(segment.seq)); removeErr != nil && !os.IsNotExist(removeErr) {
+			if err == nil {
+				err = removeErr
+			}
+			segments = append(segments, segment)
+		}
+	}
+	s.segments = segments
+	if len(s.segments) == 0 {
+		s.isLastWritable = false
+	}
+
+	return err
+}
+
+// Size returns the total size of the segments in bytes.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.totalSize()
+}
+
+func (s *Spool) totalSize() (size int64) {
+	for _, segment := range s.segments {
+		size += segment.size
+	}
+
+	return size
+}
+
+func (s *Spool) removeOldest() error {
+	if err := os.Remove(s.segmentPath(s.segments[0].seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.segments = s.segments[1:]
+	if len(s.segments) == 0 {
+		s.isLastWritable = false
+	}
+
+	return nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", spoolSegmentPrefix, seq, spoolSegmentSuffix))
+}
+
+var errSpoolCorruptedRecord = errors.New("corrupted record of the spool")
+
+// readSpoolSegment returns the records of the segment up to the first corrupted one.
+func readSpoolSegment(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < spoolRecordHeaderSize {
+			return records, fmt.Errorf("%w: %s: %v", errSpoolCorruptedRecord, path, io.ErrUnexpectedEOF)
+		}
+		length := binary.BigEndian.Uint32(data[0:4])
+		checksum := binary.BigEndian.Uint32(data[4:8])
+		data = data[spoolRecordHeaderSize:]
+		if uint64(len(data)) < uint64(length) {
+			return records, fmt.Errorf("%w: %s: %v", errSpoolCorruptedRecord, path, io.ErrUnexpectedEOF)
+		}
+		payload := data[:length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return records, fmt.Errorf("%w: %s: checksum mismatch", errSpoolCorruptedRecord, path)
+		}
+		records = append(records, payload)
+		data = data[length:]
+	}
+
+	return records, nil
+}
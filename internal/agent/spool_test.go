@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpool_ReplayOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, 1024)
+	require.Nil(t, err)
+
+	for _, payload := range []string{"first", "second", "third"} {
+		_, err = spool.Append([]byte(payload))
+		require.Nil(t, err)
+	}
+
+	// the spool survives the restart
+	spool, err = NewSpool(dir, 1024)
+	require.Nil(t, err)
+	_, err = spool.Append([]byte("fourth"))
+	require.Nil(t, err)
+
+	sendErr := errors.New("the server is down")
+	err = spool.Replay(func(payloads [][]byte) error {
+		require.Equal(t, []string{"first", "second", "third", "fourth"}, toStrings(payloads))
+		return sendErr
+	})
+	require.ErrorIs(t, err, sendErr)
+
+	var replayed []string
+	err = spool.Replay(func(payloads [][]byte) error {
+		replayed = toStrings(payloads)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"first", "second", "third", "fourth"}, replayed)
+	require.Equal(t, int64(0), spool.Size())
+
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	err = spool.Replay(func(payloads [][]byte) error {
+		t.Fatal("the empty spool must not be replayed")
+		return nil
+	})
+	require.Nil(t, err)
+}
+
+func TestSpool_ReplayUnlocked(t *testing.T) {
+	spool, err := NewSpool(t.TempDir(), 1024)
+	require.Nil(t, err)
+	_, err = spool.Append([]byte("first"))
+	require.Nil(t, err)
+
+	err = spool.Replay(func(payloads [][]byte) error {
+		// the spool isn't locked while the records are sent, the concurrent replay skips them
+		_, err := spool.Append([]byte("second"))
+		require.Nil(t, err)
+		err = spool.Replay(func(payloads [][]byte) error {
+			require.Equal(t, []string{"second"}, toStrings(payloads))
+			return errors.New("the server is down")
+		})
+		require.NotNil(t, err)
+		return nil
+	})
+	require.Nil(t, err)
+
+	// only the replayed records are removed
+	var replayed []string
+	err = spool.Replay(func(payloads [][]byte) error {
+		replayed = toStrings(payloads)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"second"}, replayed)
+	require.Equal(t, int64(0), spool.Size())
+}
+
+func TestSpool_MaxSize(t *testing.T) {
+	spool, err := NewSpool(t.TempDir(), 100)
+	require.Nil(t, err)
+
+	// every record takes 8 bytes of the header and 17 bytes of the payload, so one segment fits one record
+	var dropped int
+	for _, payload := range []string{"00000000000000001", "00000000000000002", "00000000000000003", "00000000000000004", "00000000000000005"} {
+		n, err := spool.Append([]byte(payload))
+		require.Nil(t, err)
+		dropped += n
+	}
+	require.Equal(t, 1, dropped)
+	require.LessOrEqual(t, spool.Size(), int64(100))
+
+	err = spool.Replay(func(payloads [][]byte) error {
+		require.Equal(t, []string{"00000000000000002", "00000000000000003", "00000000000000004", "00000000000000005"}, toStrings(payloads))
+		return nil
+	})
+	require.Nil(t, err)
+
+	_, err = spool.Append(make([]byte, 100))
+	require.ErrorIs(t, err, ErrSpoolRecordTooLarge)
+}
+
+func TestSpool_CorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, 1024)
+	require.Nil(t, err)
+	for _, payload := range []string{"first", "second", "third"} {
+		_, err = spool.Append([]byte(payload))
+		require.Nil(t, err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "segment-*.spool"))
+	require.Nil(t, err)
+	require.Len(t, segments, 1)
+	data, err := os.ReadFile(segments[0])
+	require.Nil(t, err)
+	// corrupt the payload of the second record
+	data[spoolRecordHeaderSize+len("first")+spoolRecordHeaderSize] ^= 0xff
+	require.Nil(t, os.WriteFile(segments[0], data, 0644))
+
+	spool, err = NewSpool(dir, 1024)
+	require.Nil(t, err)
+	_, err = spool.Append([]byte("fourth"))
+	require.Nil(t, err)
+
+	err = spool.Replay(func(payloads [][]byte) error {
+		require.Equal(t, []string{"first", "fourth"}, toStrings(payloads))
+		return nil
+	})
+	require.Nil(t, err)
+}
+
+func toStrings(payloads [][]byte) []string {
+	result := make([]string, len(payloads))
+	for i, payload := range payloads {
+		result[i] = string(payload)
+	}
+
+	return result
+}
@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/utils"
+)
+
+// SpoolingClient keeps the batches which the Client failed to send in the Spool. Before the next batch is sent,
+// the spooled batches are merged with it oldest first: the deltas of the counters are summed, the latest gauges win,
+// the histograms are merged. So the server gets every delta exactly once, and the batches are removed
+// from the spool only when the merged batch is accepted.
+type SpoolingClient struct {
+	Client IClient
+	Spool  *Spool
+	logger *zerolog.Logger
+}
+
+func NewSpoolingClient(logger *zerolog.Logger, client IClient, spool *Spool) *SpoolingClient {
+	return &SpoolingClient{
+		Client: client,
+		Spool:  spool,
+		logger: logger,
+	}
+}
+
+func (s *SpoolingClient) SendMetrics(ctx context.Context, metrics []IMetric) error {
+	isReplayed := false
+	var rejectedErr error
+	err := s.Spool.Replay(func(payloads [][]byte) error {
+		isReplayed = true
+
+		var batches [][]IMetric
+		for _, payload := range payloads {
+			batch, err := decodeSpoolBatch(payload)
+			if err != nil {
+				s.logger.Warn().Err(err).Msg("skipping the spooled batch")
+				continue
+			}
+			batches = append(batches, batch)
+		}
+		s.logger.Info().Msgf("replaying %d spooled batches", len(batches))
+
+		sendErr := s.Client.SendMetrics(ctx, mergeMetrics(append(batches, metrics)...))
+		if sendErr != nil && !isRetriable(sendErr) {
+			// the merged batch would be rejected on every replay, so the spooled batches are dropped
+			s.logger.Warn().Err(sendErr).Msgf("the replayed batch is rejected, %d spooled batches are dropped", len(batches))
+			rejectedErr = sendErr
+			return nil
+		}
+		return sendErr
+	})
+	if rejectedErr != nil {
+		err = rejectedErr
+	}
+	if !isReplayed {
+		if err != nil {
+			s.logger.Warn().Err(err).Msg("unable to replay the spool")
+		}
+		err = s.Client.SendMetrics(ctx, metrics)
+	}
+	if err == nil {
+		return nil
+	}
+
+	// the rejected batch would be rejected again, and it would poison the batches merged with it
+	if isRetriable(err) {
+		s.spool(metrics)
+	} else {
+		s.logger.Warn().Err(err).Msgf("the batch is rejected, %d metrics are dropped", len(metrics))
+	}
+
+	return err
+}
+
+func (s *SpoolingClient) spool(metrics []IMetric) {
+	if len(metrics) == 0 {
+		return
+	}
+	payload, err := encodeSpoolBatch(metrics)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("unable to spool the metrics")
+		return
+	}
+	dropped, err := s.Spool.Append(payload)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("unable to spool the metrics")
+		return
+	}
+	if dropped > 0 {
+		s.logger.Warn().Msgf("the spool is full, %d oldest batches are dropped", dropped)
+	}
+	s.logger.Info().Msgf("the metrics are spooled, the size of the spool is %d bytes", s.Spool.Size())
+}
+
+// spoolMetric is the metric as it's written to the spool
+type spoolMetric struct {
+	Type      string           `json:"type"`
+	Name      string           `json:"name"`
+	Value     float64          `json:"value,omitempty"`
+	Delta     int              `json:"delta,omitempty"`
+	Histogram *utils.Histogram `json:"histogram,omitempty"`
+}
+
+func encodeSpoolBatch(metrics []IMetric) ([]byte, error) {
+	batch := make([]spoolMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		m := spoolMetric{Type: metric.GetType(), Name: metric.GetName()}
+		switch metric := metric.(type) {
+		case MetricGauge:
+			m.Value = metric.value
+		case MetricCounter:
+			m.Delta = metric.delta
+		case MetricHistogram:
+			histogram := metric.value
+			m.Histogram = &histogram
+		default:
+			var err error
+			if m, err = parseSpoolMetric(metric); err != nil {
+				return nil, err
+			}
+		}
+		batch = append(batch, m)
+	}
+
+	return json.Marshal(batch)
+}
+
+// parseSpoolMetric converts the metrics of the other implementations by their string values
+func parseSpoolMetric(metric IMetric) (m spoolMetric, err error) {
+	m = spoolMetric{Type: metric.GetType(), Name: metric.GetName()}
+	switch m.Type {
+	case MetricTypeGauge:
+		m.Value, err = gaugeValue(metric)
+	case MetricTypeCounter:
+		m.Delta, err = counterDelta(metric)
+	default:
+		err = fmt.Errorf("unable to spool the metric %s of type %s", m.Name, m.Type)
+	}
+
+	return m, err
+}
+
+func decodeSpoolBatch(payload []byte) ([]IMetric, error) {
+	var batch []spoolMetric
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return nil, err
+	}
+
+	result := make([]IMetric, 0, len(batch))
+	for _, m := range batch {
+		switch m.Type {
+		case MetricTypeGauge:
+			result = append(result, MetricGauge{m.Value, m.Name})
+		case MetricTypeCounter:
+			result = append(result, MetricCounter{m.Delta, m.Name})
+		case MetricTypeHistogram:
+			if m.Histogram == nil {
+				return nil, errors.New("the spooled histogram has no value")
+			}
+			result = append(result, MetricHistogram{*m.Histogram, m.Name})
+		default:
+			return nil, fmt.Errorf("unknown type of the spooled metric: %s", m.Type)
+		}
+	}
+
+	return result, nil
+}
+
+// mergeMetrics merges the batches in the given order into one batch with one metric per name and type.
+// The deltas of the counters are summed, the last value of the gauge wins, the histograms are merged,
+// and the histogram with other bounds replaces the previous one.
+func mergeMetrics(batches ...[]IMetric) []IMetric {
+	var result []IMetric
+	indexes := map[string]int{}
+	for _, batch := range batches {
+		for _, metric := range batch {
+			key := metric.GetType() + ":" + metric.GetName()
+			i, ok := indexes[key]
+			if !ok {
+				if histogram, isHistogram := metric.(MetricHistogram); isHistogram {
+					metric = MetricHistogram{histogram.value.Clone(), histogram.name}
+				}
+				indexes[key] = len(result)
+				result = append(result, metric)
+				continue
+			}
+
+			switch merged := result[i].(type) {
+			case MetricCounter:
+				if counter, isCounter := metric.(MetricCounter); isCounter {
+					merged.delta += counter.delta
+					result[i] = merged
+					continue
+				}
+			case MetricHistogram:
+				if histogram, isHistogram := metric.(MetricHistogram); isHistogram {
+					if err := merged.value.Merge(histogram.value); err != nil {
+						merged.value = histogram.value.Clone()
+					}
+					result[i] = merged
+					continue
+				}
+			}
+			result[i] = metric
+		}
+	}
+
+	return result
+}
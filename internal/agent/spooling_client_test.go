@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestSpoolingClient_SendMetrics(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, 1<<20)
+	require.Nil(t, err)
+
+	histogram, err := utils.NewHistogram([]float64{1})
+	require.Nil(t, err)
+	histogram.Observe(0.5)
+
+	client := &failingClientMock{err: &retriableError{errors.New("the server is down")}}
+	spoolingClient := NewSpoolingClient(&logger, client, spool)
+
+	err = spoolingClient.SendMetrics(context.Background(), []IMetric{
+		MetricGauge{1.5, "Alloc"},
+		MetricCounter{2, "PollCount"},
+		MetricHistogram{histogram, "PollDuration"},
+	})
+	require.NotNil(t, err)
+	err = spoolingClient.SendMetrics(context.Background(), []IMetric{
+		MetricGauge{2.5, "Alloc"},
+		MetricCounter{3, "PollCount"},
+	})
+	require.NotNil(t, err)
+
+	// the agent restarts and the server is back
+	spool, err = NewSpool(dir, 1<<20)
+	require.Nil(t, err)
+	client.err = nil
+	spoolingClient = NewSpoolingClient(&logger, client, spool)
+
+	err = spoolingClient.SendMetrics(context.Background(), []IMetric{
+		MetricCounter{4, "PollCount"},
+		MetricHistogram{histogram, "PollDuration"},
+		MetricGauge{0.1, "RandomValue"},
+	})
+	require.Nil(t, err)
+
+	mergedHistogram := histogram.Clone()
+	require.Nil(t, mergedHistogram.Merge(histogram))
+	require.Equal(t, []IMetric{
+		MetricGauge{2.5, "Alloc"},
+		MetricCounter{9, "PollCount"},
+		MetricHistogram{mergedHistogram, "PollDuration"},
+		MetricGauge{0.1, "RandomValue"},
+	}, client.sent[len(client.sent)-1])
+	require.Equal(t, int64(0), spool.Size())
+
+	// the spool is empty, the next batch is sent as is
+	err = spoolingClient.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}})
+	require.Nil(t, err)
+	require.Equal(t, []IMetric{MetricCounter{1, "PollCount"}}, client.sent[len(client.sent)-1])
+}
+
+func TestSpoolingClient_SendMetrics_Rejected(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	spool, err := NewSpool(t.TempDir(), 1<<20)
+	require.Nil(t, err)
+	client := &failingClientMock{err: errors.New("error while sending the metrics to server. Status: 400")}
+	spoolingClient := NewSpoolingClient(&logger, client, spool)
+
+	// the rejected batch isn't spooled, it would be rejected again
+	require.NotNil(t, spoolingClient.SendMetrics(context.Background(), []IMetric{MetricCounter{1, "PollCount"}}))
+	require.Equal(t, int64(0), spool.Size())
+
+	// the spooled batches are dropped once the merged batch is rejected, so they don't poison the later ones
+	client.err = &retriableError{errors.New("the server is down")}
+	require.NotNil(t, spoolingClient.SendMetrics(context.Background(), []IMetric{MetricCounter{2, "PollCount"}}))
+	require.NotEqual(t, int64(0), spool.Size())
+	client.err = errors.New("error while sending the metrics to server. Status: 400")
+	require.NotNil(t, spoolingClient.SendMetrics(context.Background(), []IMetric{MetricCounter{3, "PollCount"}}))
+	require.Equal(t, int64(0), spool.Size())
+
+	client.err = nil
+	require.Nil(t, spoolingClient.SendMetrics(context.Background(), []IMetric{MetricCounter{4, "PollCount"}}))
+	require.Equal(t, []IMetric{MetricCounter{4, "PollCount"}}, client.sent[len(client.sent)-1])
+}
+
+type failingClientMock struct {
+	err  error
+	sent [][]IMetric
+}
+
+func (c *failingClientMock) SendMetrics(_ context.Context, metrics []IMetric) error {
+	c.sent = append(c.sent, metrics)
+	return c.err
+}
@@ -0,0 +1,2 @@
+// Package prompb contains the messages of the remote write protocol of Prometheus generated from remote.proto.
+package prompb
@@ -0,0 +1,26 @@
+// Package pb contains the gRPC service of the metrics generated from metrics.proto.
+package pb
+
+//go:generate buf generate
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// Metadata keys of the gRPC requests and responses, the counterparts of the headers of the JSON API
+const (
+	HashMetadataKey   = "hashsha256"
+	KeyIDMetadataKey  = "hashsha256-key-id"
+	RealIPMetadataKey = "x-real-ip"
+)
+
+// SignString returns the string the message is signed by, the message marshaled deterministically,
+// so the sign made by the agent matches the one computed by the server from the received message.
+func SignString(m proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
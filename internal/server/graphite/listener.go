@@ -0,0 +1,191 @@
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReportedLineErrors limits the errors of the skipped lines logged for the connection, the rest are only counted
+const maxReportedLineErrors = 10
+
+// Limits protect the server from the misbehaving clients
+type Limits struct {
+	// MaxConnections is how many connections are served at once, the others are closed right after accepting
+	MaxConnections int
+	// MaxLineSize is the longest line in bytes, the connection sending the longer one is closed
+	MaxLineSize int
+	// IdleTimeout is how long to wait for the next line before closing the connection
+	IdleTimeout time.Duration
+}
+
+var DefaultLimits = Limits{
+	MaxConnections: 100,
+	MaxLineSize:    4 << 10,
+	IdleTimeout:    time.Minute,
+}
+
+// Listener accepts the connections and upserts the gauge of every received line.
+// The timestamps are not stored, since the repository keeps only the current values.
+type Listener struct {
+	repository     handlers.IRepository
+	logger         *zerolog.Logger
+	limits         Limits
+	trustedSubnets utils.TrustedSubnets
+
+	slots  chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewListener creates the listener. If trustedSubnets is not empty, the connections from the other addresses are closed.
+func NewListener(logger *zerolog.Logger, repository handlers.IRepository, limits Limits, trustedSubnets utils.TrustedSubnets) *Listener {
+	return &Listener{
+		repository:     repository,
+		logger:         logger,
+		limits:         limits,
+		trustedSubnets: trustedSubnets,
+		slots:          make(chan struct{}, limits.MaxConnections),
+		conns:          map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts the connections until the listener is closed
+func (l *Listener) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			l.logger.Warn().Msgf("the graphite connection from the untrusted %s is rejected", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.logger.Warn().Msgf("the graphite connection from %s is rejected, the limit of %d connections is reached", conn.RemoteAddr(), l.limits.MaxConnections)
+			conn.Close()
+			continue
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			<-l.slots
+			continue
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go l.serveConn(conn)
+	}
+}
+
+// Close closes the connections being served and waits until their lines are written.
+// The listener passed to Serve is closed by the caller.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	return nil
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+		<-l.slots
+		l.wg.Done()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	// the buffer holds the newline as well, it mustn't be larger initially since its capacity raises the limit
+	maxBufferSize := l.limits.MaxLineSize + 1
+	initialBufferSize := 4096
+	if initialBufferSize > maxBufferSize {
+		initialBufferSize = maxBufferSize
+	}
+	scanner.Buffer(make([]byte, 0, initialBufferSize), maxBufferSize)
+	skipped := 0
+	var lineErrors []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(l.limits.IdleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		if err := l.handleLine(scanner.Text()); err != nil {
+			skipped++
+			if len(lineErrors) < maxReportedLineErrors {
+				lineErrors = append(lineErrors, err.Error())
+			}
+		}
+	}
+	// the misbehaving client would flood the log with the warning per line
+	if skipped > 0 {
+		l.logger.Warn().Msgf("%d graphite lines from %s are skipped: %s", skipped, conn.RemoteAddr(), strings.Join(lineErrors, "; "))
+	}
+
+	var netErr net.Error
+	switch err := scanner.Err(); {
+	case err == nil, errors.Is(err, net.ErrClosed):
+	case errors.As(err, &netErr) && netErr.Timeout():
+		l.logger.Debug().Msgf("the idle graphite connection from %s is closed", conn.RemoteAddr())
+	default:
+		l.logger.Warn().Err(err).Msgf("the graphite connection from %s is closed", conn.RemoteAddr())
+	}
+}
+
+// handleLine upserts the gauge of the line, the error is returned if the line cannot be parsed
+func (l *Listener) handleLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	metric, err := ParseLine(line)
+	if err != nil {
+		return err
+	}
+
+	err = l.repository.UpsertGauge(handlers.GaugeMetric{Name: metric.Name, Value: metric.Value, Labels: metric.Labels})
+	if err != nil {
+		l.logger.Error().Err(err).Msg("cannot write the graphite metric")
+	}
+
+	return nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	if len(l.trustedSubnets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	return l.trustedSubnets.Contains(net.ParseIP(host))
+}
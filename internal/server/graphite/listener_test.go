@@ -0,0 +1,169 @@
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/server/storage"
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startListener(t *testing.T, repository handlers.IRepository, limits Limits, trustedSubnets utils.TrustedSubnets) (*Listener, string) {
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, limits, trustedSubnets)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go listener.Serve(tcpListener)
+	t.Cleanup(func() {
+		tcpListener.Close()
+		listener.Close()
+	})
+
+	return listener, tcpListener.Addr().String()
+}
+
+// requireClosed waits until the server closes the connection, it's reset if the server hasn't read everything
+func requireClosed(t *testing.T, conn net.Conn) {
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := bufio.NewReader(conn).ReadByte()
+	var netErr net.Error
+	require.NotNil(t, err)
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the connection isn't closed")
+}
+
+func TestListener_Serve(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	_, addr := startListener(t, repository, DefaultLimits, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	_, err = fmt.Fprint(conn, "servers.web1.load 0.5 1700000000\nbroken line\n\nservers.web1.load 0.75 1700000010\ndisk.used;host=a 10 -1\n")
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		_, err := repository.GetGauge("disk.used", handlers.Labels{"host": "a"})
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	load, err := repository.GetGauge("servers.web1.load", nil)
+	require.Nil(t, err)
+	require.Equal(t, 0.75, load)
+	used, err := repository.GetGauge("disk.used", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, 10.0, used)
+}
+
+func TestListener_Limits(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	listener, addr := startListener(t, repository, Limits{MaxConnections: 1, MaxLineSize: 32, IdleTimeout: 100 * time.Millisecond}, nil)
+
+	t.Run("line size", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "%s 1 1700000000\nshort 1 1700000000\n", strings.Repeat("a", 32))
+		require.Nil(t, err)
+
+		requireClosed(t, conn)
+		_, err = repository.GetGauge("short", nil)
+		require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+	})
+
+	t.Run("connections", func(t *testing.T) {
+		first, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		defer first.Close()
+		_, err = fmt.Fprint(first, "first 1 1700000000\n")
+		require.Nil(t, err)
+		require.Eventually(t, func() bool {
+			_, err := repository.GetGauge("first", nil)
+			return err == nil
+		}, time.Second, 5*time.Millisecond)
+
+		second, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		defer second.Close()
+		requireClosed(t, second)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		// the slot of the previous connection is released once it's idle for too long
+		require.Eventually(t, func() bool {
+			listener.mu.Lock()
+			defer listener.mu.Unlock()
+			return len(listener.conns) == 0
+		}, time.Second, 5*time.Millisecond)
+
+		conn, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "third 1 1700000000\n")
+		require.Nil(t, err)
+		requireClosed(t, conn)
+		_, err = repository.GetGauge("third", nil)
+		require.Nil(t, err)
+	})
+}
+
+func TestListener_SkippedLines(t *testing.T) {
+	var logs strings.Builder
+	logger := zerolog.New(&logs)
+	listener := NewListener(&logger, storage.NewMemStorageDefault(), DefaultLimits, nil)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer tcpListener.Close()
+	go listener.Serve(tcpListener)
+
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	_, err = fmt.Fprint(conn, strings.Repeat("broken line\n", maxReportedLineErrors+5)+"servers.web1.load 0.5 1700000000\n")
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+	require.Eventually(t, func() bool {
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		return len(listener.conns) == 0
+	}, time.Second, 5*time.Millisecond)
+	require.Nil(t, listener.Close())
+
+	// one warning per connection with the first errors
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 1)
+	require.Contains(t, lines[0], fmt.Sprintf("%d graphite lines from", maxReportedLineErrors+5))
+}
+
+func TestListener_Close(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	listener, addr := startListener(t, repository, DefaultLimits, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "servers.web1.load 0.5 1700000000\n")
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		_, err := repository.GetGauge("servers.web1.load", nil)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+
+	require.Nil(t, listener.Close())
+	requireClosed(t, conn)
+}
+
+func TestListener_TrustedSubnets(t *testing.T) {
+	subnets, err := utils.ParseTrustedSubnets("10.0.0.0/8")
+	require.Nil(t, err)
+	_, addr := startListener(t, storage.NewMemStorageDefault(), DefaultLimits, subnets)
+
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	requireClosed(t, conn)
+}
@@ -0,0 +1,60 @@
+// Package graphite receives the metrics in the Graphite plaintext protocol over TCP and writes them to the repository as gauges.
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidLine = errors.New("invalid graphite line")
+
+// Metric is the parsed line, e.g. servers.web1.load;dc=eu 0.75 1700000000
+type Metric struct {
+	Name   string
+	Value  float64
+	Labels handlers.Labels
+	// Timestamp is in seconds since the epoch, -1 means the time of the receiving
+	Timestamp float64
+}
+
+// ParseLine parses the line in the format path[;tag=value...] value timestamp, the tags of the path become the labels
+func ParseLine(line string) (Metric, error) {
+	parts := strings.Fields(line)
+	if len(parts) != 3 {
+		return Metric{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+
+	tags := strings.Split(parts[0], ";")
+	metric := Metric{Name: tags[0]}
+	if metric.Name == "" {
+		return Metric{}, fmt.Errorf("%w: missing path", ErrInvalidLine)
+	}
+	for _, tag := range tags[1:] {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok || key == "" || value == "" {
+			return Metric{}, fmt.Errorf("%w: invalid tag %q", ErrInvalidLine, tag)
+		}
+		if metric.Labels == nil {
+			metric.Labels = handlers.Labels{}
+		}
+		metric.Labels[key] = value
+	}
+
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Metric{}, fmt.Errorf("%w: invalid value %q", ErrInvalidLine, parts[1])
+	}
+	metric.Value = value
+
+	timestamp, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return Metric{}, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidLine, parts[2])
+	}
+	metric.Timestamp = timestamp
+
+	return metric, nil
+}
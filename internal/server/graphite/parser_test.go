@@ -0,0 +1,34 @@
+package graphite
+
+import (
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := map[string]Metric{
+		"servers.web1.load 0.75 1700000000":    {Name: "servers.web1.load", Value: 0.75, Timestamp: 1700000000},
+		"backup.size  -12\t-1":                 {Name: "backup.size", Value: -12, Timestamp: -1},
+		"disk.used;host=a;mount=/var 1e3 17.5": {Name: "disk.used", Value: 1000, Timestamp: 17.5, Labels: handlers.Labels{"host": "a", "mount": "/var"}},
+	}
+	for line, expected := range tests {
+		metric, err := ParseLine(line)
+		require.Nil(t, err, line)
+		require.Equal(t, expected, metric, line)
+	}
+
+	for _, line := range []string{
+		"servers.web1.load 0.75",
+		"servers.web1.load 0.75 1700000000 extra",
+		";host=a 1 1700000000",
+		"disk.used;host 1 1700000000",
+		"disk.used;host= 1 1700000000",
+		"servers.web1.load abc 1700000000",
+		"servers.web1.load NaN 1700000000",
+		"servers.web1.load 1 now",
+	} {
+		_, err := ParseLine(line)
+		require.ErrorIs(t, err, ErrInvalidLine, line)
+	}
+}
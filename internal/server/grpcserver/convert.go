@@ -0,0 +1,71 @@
+package grpcserver
+
+import (
+	"fmt"
+	"github.com/smamykin/smetrics/internal/pb"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+)
+
+var metricTypes = map[pb.MetricType]string{
+	pb.MetricType_METRIC_TYPE_GAUGE:     handlers.MetricTypeGauge,
+	pb.MetricType_METRIC_TYPE_COUNTER:   handlers.MetricTypeCounter,
+	pb.MetricType_METRIC_TYPE_HISTOGRAM: handlers.MetricTypeHistogram,
+}
+
+var pbMetricTypes = map[string]pb.MetricType{
+	handlers.MetricTypeGauge:     pb.MetricType_METRIC_TYPE_GAUGE,
+	handlers.MetricTypeCounter:   pb.MetricType_METRIC_TYPE_COUNTER,
+	handlers.MetricTypeHistogram: pb.MetricType_METRIC_TYPE_HISTOGRAM,
+}
+
+// fromPB converts the metric to the one of the JSON API. The histogram without the buckets is the single observation
+// of the value, as in the JSON API.
+func fromPB(metric *pb.Metric) (handlers.Metrics, error) {
+	metricType, ok := metricTypes[metric.GetType()]
+	if !ok {
+		return handlers.Metrics{}, fmt.Errorf("unknown metric type %s", metric.GetType())
+	}
+
+	result := handlers.Metrics{ID: metric.GetId(), MType: metricType}
+	if len(metric.GetLabels()) != 0 {
+		result.Labels = metric.GetLabels()
+	}
+	switch metricType {
+	case handlers.MetricTypeGauge:
+		value := metric.GetValue()
+		result.Value = &value
+	case handlers.MetricTypeCounter:
+		delta := metric.GetDelta()
+		result.Delta = &delta
+	case handlers.MetricTypeHistogram:
+		if h := metric.GetHistogram(); h != nil {
+			result.Histogram = &utils.Histogram{Bounds: h.GetBounds(), Counts: h.GetCounts(), Sum: h.GetSum(), Count: h.GetCount()}
+		} else {
+			value := metric.GetValue()
+			result.Value = &value
+		}
+	}
+
+	return result, nil
+}
+
+func toPB(metric handlers.Metrics) *pb.Metric {
+	result := &pb.Metric{Id: metric.ID, Type: pbMetricTypes[metric.MType], Labels: metric.Labels}
+	if metric.Value != nil {
+		result.Value = *metric.Value
+	}
+	if metric.Delta != nil {
+		result.Delta = *metric.Delta
+	}
+	if metric.Histogram != nil {
+		result.Histogram = &pb.Histogram{
+			Bounds: metric.Histogram.Bounds,
+			Counts: metric.Histogram.Counts,
+			Sum:    metric.Histogram.Sum,
+			Count:  metric.Histogram.Count,
+		}
+	}
+
+	return result
+}
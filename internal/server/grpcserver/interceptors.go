@@ -0,0 +1,160 @@
+package grpcserver
+
+import (
+	"context"
+	"github.com/smamykin/smetrics/internal/pb"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"net"
+)
+
+// signatureUnaryInterceptor verifies the sign of UpdateMetrics passed in the metadata, like the HashSHA256 header
+// of the JSON API, and signs the responses with the current key. The reading requests may be unsigned.
+func signatureUnaryInterceptor(hashGenerator handlers.IHashGenerator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if request, ok := req.(*pb.UpdateMetricsRequest); ok {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if err := verify(hashGenerator, request, firstValue(md, pb.HashMetadataKey), firstValue(md, pb.KeyIDMetadataKey)); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if md, ok := signResponse(hashGenerator, resp); ok {
+			grpc.SetHeader(ctx, md)
+		}
+
+		return resp, nil
+	}
+}
+
+// signatureStreamInterceptor verifies every batch of PushMetrics, which carries its own sign,
+// and signs the response with the current key.
+func signatureStreamInterceptor(hashGenerator handlers.IHashGenerator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &signingServerStream{ServerStream: ss, hashGenerator: hashGenerator})
+	}
+}
+
+type signingServerStream struct {
+	grpc.ServerStream
+	hashGenerator handlers.IHashGenerator
+}
+
+func (s *signingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if request, ok := m.(*pb.PushMetricsRequest); ok {
+		return verify(s.hashGenerator, request.GetBatch(), request.GetHash(), request.GetKeyId())
+	}
+
+	return nil
+}
+
+func (s *signingServerStream) SendMsg(m interface{}) error {
+	if md, ok := signResponse(s.hashGenerator, m); ok {
+		s.SetHeader(md)
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
+
+func verify(hashGenerator handlers.IHashGenerator, message proto.Message, sign string, keyID string) error {
+	if sign == "" {
+		return status.Error(codes.Unauthenticated, "the request is not signed")
+	}
+	stringToHash, err := pb.SignString(message)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !hashGenerator.Verify(keyID, stringToHash, sign) {
+		return status.Error(codes.Unauthenticated, "the signature of the request is not correct")
+	}
+
+	return nil
+}
+
+func signResponse(hashGenerator handlers.IHashGenerator, resp interface{}) (metadata.MD, bool) {
+	message, ok := resp.(proto.Message)
+	if !ok {
+		return nil, false
+	}
+	stringToHash, err := pb.SignString(message)
+	if err != nil {
+		return nil, false
+	}
+	sign, err := hashGenerator.Generate(stringToHash)
+	if err != nil {
+		return nil, false
+	}
+
+	md := metadata.Pairs(pb.HashMetadataKey, sign)
+	if keyID := hashGenerator.KeyID(); keyID != "" {
+		md.Set(pb.KeyIDMetadataKey, keyID)
+	}
+
+	return md, true
+}
+
+// trustedSubnetUnaryInterceptor rejects UpdateMetrics unless x-real-ip, and the address of the peer
+// if checkRemoteAddr is set, belong to the trusted subnets. The reading requests are passed as is.
+func trustedSubnetUnaryInterceptor(subnets utils.TrustedSubnets, checkRemoteAddr bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, ok := req.(*pb.UpdateMetricsRequest); ok {
+			if err := checkTrustedSubnet(ctx, subnets, checkRemoteAddr); err != nil {
+				return nil, err
+			}
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// trustedSubnetStreamInterceptor checks the streams the same way, the only stream PushMetrics changes the metrics
+func trustedSubnetStreamInterceptor(subnets utils.TrustedSubnets, checkRemoteAddr bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkTrustedSubnet(ss.Context(), subnets, checkRemoteAddr); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func checkTrustedSubnet(ctx context.Context, subnets utils.TrustedSubnets, checkRemoteAddr bool) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ip := net.ParseIP(firstValue(md, pb.RealIPMetadataKey))
+	if ip == nil || !subnets.Contains(ip) {
+		return status.Error(codes.PermissionDenied, "the address is not in the trusted subnet")
+	}
+	if checkRemoteAddr {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return status.Error(codes.PermissionDenied, "the address is not in the trusted subnet")
+		}
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil || !subnets.Contains(net.ParseIP(host)) {
+			return status.Error(codes.PermissionDenied, "the address is not in the trusted subnet")
+		}
+	}
+
+	return nil
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) != 0 {
+		return values[0]
+	}
+
+	return ""
+}
@@ -0,0 +1,172 @@
+// Package grpcserver serves the metrics over gRPC against the same repository as the JSON API.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"github.com/smamykin/smetrics/internal/pb"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	// the agents compress the large batches with gzip
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"io"
+)
+
+// Option configures the interceptors of the server
+type Option func(*options)
+
+type options struct {
+	trustedSubnets  utils.TrustedSubnets
+	checkRemoteAddr bool
+}
+
+// WithTrustedSubnets makes the server accept the metrics only from the agents whose x-real-ip belongs to the subnets.
+// If checkRemoteAddr is set, the address of the peer must belong to them as well.
+func WithTrustedSubnets(subnets utils.TrustedSubnets, checkRemoteAddr bool) Option {
+	return func(o *options) {
+		o.trustedSubnets = subnets
+		o.checkRemoteAddr = checkRemoteAddr
+	}
+}
+
+// NewServer creates the gRPC server with the metrics service. The signs are checked if hashGenerator is not nil.
+func NewServer(repository handlers.IRepository, hashGenerator handlers.IHashGenerator, opts ...Option) *grpc.Server {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	var streamInterceptors []grpc.StreamServerInterceptor
+	if len(o.trustedSubnets) != 0 {
+		unaryInterceptors = append(unaryInterceptors, trustedSubnetUnaryInterceptor(o.trustedSubnets, o.checkRemoteAddr))
+		streamInterceptors = append(streamInterceptors, trustedSubnetStreamInterceptor(o.trustedSubnets, o.checkRemoteAddr))
+	}
+	if hashGenerator != nil {
+		unaryInterceptors = append(unaryInterceptors, signatureUnaryInterceptor(hashGenerator))
+		streamInterceptors = append(streamInterceptors, signatureStreamInterceptor(hashGenerator))
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
+	pb.RegisterMetricsServer(server, &MetricsServer{Repository: repository})
+
+	return server
+}
+
+// MetricsServer implements the service of metrics.proto
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	Repository handlers.IRepository
+}
+
+func (s *MetricsServer) UpdateMetrics(ctx context.Context, request *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	if err := s.update(ctx, request); err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+func (s *MetricsServer) GetMetric(_ context.Context, request *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	metricType, ok := metricTypes[request.GetType()]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown metric type %s", request.GetType())
+	}
+
+	metric := handlers.Metrics{ID: request.GetId(), MType: metricType}
+	if len(request.GetLabels()) != 0 {
+		metric.Labels = request.GetLabels()
+	}
+	actualMetric, err := handlers.GetActualMetric(s.Repository, metric)
+	if errors.Is(err, handlers.ErrMetricNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.GetMetricResponse{Metric: toPB(actualMetric)}, nil
+}
+
+func (s *MetricsServer) ListMetrics(context.Context, *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	var result []*pb.Metric
+
+	gauges, err := s.Repository.GetAllGauge()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, gauge := range gauges {
+		value := gauge.Value
+		result = append(result, toPB(handlers.Metrics{ID: gauge.Name, MType: handlers.MetricTypeGauge, Value: &value, Labels: gauge.Labels}))
+	}
+
+	counters, err := s.Repository.GetAllCounters()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, counter := range counters {
+		delta := counter.Value
+		result = append(result, toPB(handlers.Metrics{ID: counter.Name, MType: handlers.MetricTypeCounter, Delta: &delta, Labels: counter.Labels}))
+	}
+
+	histograms, err := s.Repository.GetAllHistograms()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, histogram := range histograms {
+		value := histogram.Value
+		result = append(result, toPB(handlers.Metrics{ID: histogram.Name, MType: handlers.MetricTypeHistogram, Histogram: &value, Labels: histogram.Labels}))
+	}
+
+	return &pb.ListMetricsResponse{Metrics: result}, nil
+}
+
+// PushMetrics applies the batches until the agent closes the stream
+func (s *MetricsServer) PushMetrics(stream pb.Metrics_PushMetricsServer) error {
+	var response pb.PushMetricsResponse
+	for {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&response)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = s.update(stream.Context(), request.GetBatch()); err != nil {
+			return err
+		}
+		response.Batches++
+		response.Metrics += int64(len(request.GetBatch().GetMetrics()))
+	}
+}
+
+func (s *MetricsServer) update(ctx context.Context, request *pb.UpdateMetricsRequest) error {
+	metrics := make([]handlers.Metrics, 0, len(request.GetMetrics()))
+	for _, m := range request.GetMetrics() {
+		metric, err := fromPB(m)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err = handlers.ValidateMetric(metric); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		metrics = append(metrics, metric)
+	}
+
+	err := handlers.UpsertMetrics(ctx, s.Repository, metrics)
+	if errors.Is(err, utils.ErrHistogramBoundsMismatch) || errors.Is(err, utils.ErrNonFiniteValue) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
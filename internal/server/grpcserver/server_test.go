@@ -0,0 +1,155 @@
+package grpcserver
+
+import (
+	"context"
+	"github.com/smamykin/smetrics/internal/pb"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/server/storage"
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+)
+
+func startServer(t *testing.T, repository handlers.IRepository, hashGenerator handlers.IHashGenerator, opts ...Option) pb.MetricsClient {
+	listener := bufconn.Listen(1 << 20)
+	server := NewServer(repository, hashGenerator, opts...)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn)
+}
+
+func sign(t *testing.T, h *utils.HashGenerator, request *pb.UpdateMetricsRequest) string {
+	stringToHash, err := pb.SignString(request)
+	require.Nil(t, err)
+	result, err := h.Generate(stringToHash)
+	require.Nil(t, err)
+
+	return result
+}
+
+func TestMetricsServer(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	client := startServer(t, repository, nil)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 2},
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 3},
+		{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Value: 1.5, Labels: map[string]string{"host": "a"}},
+		{Id: "Latency", Type: pb.MetricType_METRIC_TYPE_HISTOGRAM, Histogram: &pb.Histogram{Bounds: []float64{1, 2}, Counts: []int64{1, 0, 1}, Sum: 3.5, Count: 2}},
+	}})
+	require.Nil(t, err)
+
+	response, err := client.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER})
+	require.Nil(t, err)
+	require.Equal(t, int64(5), response.GetMetric().GetDelta())
+
+	response, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE, Labels: map[string]string{"host": "a"}})
+	require.Nil(t, err)
+	require.Equal(t, 1.5, response.GetMetric().GetValue())
+
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "Alloc", Type: pb.MetricType_METRIC_TYPE_GAUGE})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.Nil(t, err)
+	require.Len(t, list.GetMetrics(), 3)
+
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Unknown"}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Latency", Type: pb.MetricType_METRIC_TYPE_HISTOGRAM, Histogram: &pb.Histogram{Bounds: []float64{5}, Counts: []int64{1, 0}, Sum: 1, Count: 1}},
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMetricsServer_Signature(t *testing.T) {
+	h := utils.NewHashGenerator("secret")
+	keyring := utils.NewKeyring("v1", "secret")
+	repository := storage.NewMemStorageDefault()
+	client := startServer(t, repository, keyring)
+	ctx := context.Background()
+
+	request := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 2, Labels: map[string]string{"host": "a", "region": "b"}},
+	}}
+	_, err := client.UpdateMetrics(ctx, request)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	wrongCtx := metadata.AppendToOutgoingContext(ctx, pb.HashMetadataKey, sign(t, utils.NewHashGenerator("wrong"), request))
+	_, err = client.UpdateMetrics(wrongCtx, request)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	var header metadata.MD
+	signedCtx := metadata.AppendToOutgoingContext(ctx, pb.HashMetadataKey, sign(t, h, request), pb.KeyIDMetadataKey, "v1")
+	response, err := client.UpdateMetrics(signedCtx, request, grpc.Header(&header))
+	require.Nil(t, err)
+	stringToHash, err := pb.SignString(response)
+	require.Nil(t, err)
+	expectedSign, err := h.Generate(stringToHash)
+	require.Nil(t, err)
+	require.Equal(t, []string{expectedSign}, header.Get(pb.HashMetadataKey))
+	require.Equal(t, []string{"v1"}, header.Get(pb.KeyIDMetadataKey))
+
+	// the reading requests may be unsigned
+	_, err = client.GetMetric(ctx, &pb.GetMetricRequest{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Labels: map[string]string{"host": "a", "region": "b"}})
+	require.Nil(t, err)
+
+	stream, err := client.PushMetrics(ctx)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, stream.Send(&pb.PushMetricsRequest{Batch: request, Hash: sign(t, h, request), KeyId: "v1"}))
+	}
+	pushResponse, err := stream.CloseAndRecv()
+	require.Nil(t, err)
+	require.Equal(t, int64(3), pushResponse.GetBatches())
+	require.Equal(t, int64(3), pushResponse.GetMetrics())
+
+	stream, err = client.PushMetrics(ctx)
+	require.Nil(t, err)
+	require.Nil(t, stream.Send(&pb.PushMetricsRequest{Batch: request}))
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	counter, err := repository.GetCounter("PollCount", handlers.Labels{"host": "a", "region": "b"})
+	require.Nil(t, err)
+	require.Equal(t, int64(8), counter)
+}
+
+func TestMetricsServer_TrustedSubnet(t *testing.T) {
+	subnets, err := utils.ParseTrustedSubnets("10.0.0.0/8")
+	require.Nil(t, err)
+	client := startServer(t, storage.NewMemStorageDefault(), nil, WithTrustedSubnets(subnets, false))
+	ctx := context.Background()
+	request := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: pb.MetricType_METRIC_TYPE_COUNTER, Delta: 1}}}
+
+	_, err = client.UpdateMetrics(ctx, request)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.UpdateMetrics(metadata.AppendToOutgoingContext(ctx, pb.RealIPMetadataKey, "192.168.0.1"), request)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.UpdateMetrics(metadata.AppendToOutgoingContext(ctx, pb.RealIPMetadataKey, "10.1.2.3"), request)
+	require.Nil(t, err)
+	_, err = client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	require.Nil(t, err)
+
+	stream, err := client.PushMetrics(ctx)
+	require.Nil(t, err)
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -3,59 +3,161 @@ package handlers
 import (
 	"context"
 	"errors"
+	"github.com/smamykin/smetrics/internal/utils"
 	"net/http"
+	"time"
 )
 
 const (
-	MetricTypeGauge   = "gauge"
-	MetricTypeCounter = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeCounter   = "counter"
+	MetricTypeHistogram = "histogram"
 )
 
 const (
 	paramNameMetricType  = "metricType"
 	paramNameMetricName  = "metricName"
 	paramNameMetricValue = "metricValue"
+	// paramNameQuantile is the parameter of the query string, which is not a label for the histograms
+	paramNameQuantile = "quantile"
 )
 
 type IRepository interface {
 	UpsertGauge(GaugeMetric) error
 	UpsertCounter(CounterMetric) error
+	// UpsertMany replaces the metrics at once, GaugeIncrement and CounterIncrement are added to the stored values instead
 	UpsertMany(context.Context, []interface{}) error
-	GetGauge(name string) (float64, error)
-	GetCounter(name string) (int64, error)
+	// IncrementCounter atomically adds the Value of the metric to the stored counter and returns the new value
+	IncrementCounter(CounterMetric) (int64, error)
+	// IncrementMany works like UpsertMany, except that the counters are incremented by their Value instead of being replaced
+	IncrementMany(context.Context, []interface{}) error
+	GetGauge(name string, labels Labels) (float64, error)
+	GetCounter(name string, labels Labels) (int64, error)
 	GetAllGauge() ([]GaugeMetric, error)
 	GetAllCounters() ([]CounterMetric, error)
+	// MergeHistogram atomically adds the observations of the metric to the stored histogram and returns the merged one.
+	// It returns utils.ErrHistogramBoundsMismatch when the bounds of the histograms differ.
+	MergeHistogram(HistogramMetric) (utils.Histogram, error)
+	GetHistogram(name string, labels Labels) (utils.Histogram, error)
+	GetAllHistograms() ([]HistogramMetric, error)
 }
 
 type IRepositoryWithHealthCheck interface {
 	Healthcheck(context.Context) error
 }
 
+// IRepositoryWithHistory is implemented by the storages which are able to keep all the accepted values of the metrics.
+type IRepositoryWithHistory interface {
+	// GetRange returns the samples of the metric recorded within [from, to] in chronological order
+	GetRange(ctx context.Context, metricType string, name string, labels Labels, from time.Time, to time.Time) ([]Sample, error)
+}
+
+// IRepositoryWithRollups is implemented by the storages which are able to aggregate the metrics over time.
+type IRepositoryWithRollups interface {
+	// GetRollups returns the aggregates of the metric of the given resolution within [from, to] in chronological order
+	GetRollups(ctx context.Context, metricType string, name string, labels Labels, resolution time.Duration, from time.Time, to time.Time) ([]RollupPoint, error)
+}
+
 type IParametersBag interface {
 	GetURLParam(r *http.Request, key string) string
 }
 
 type Metrics struct {
-	ID    string   `json:"id" valid:"required"`                     // имя метрики
-	MType string   `json:"type" valid:"in(gauge|counter),required"` // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"`                         // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"`                         // значение метрики в случае передачи gauge
-	Hash  string   `json:"hash,omitempty"`                          // значение хеш-функции
+	ID        string             `json:"id" valid:"required"`                               // имя метрики
+	MType     string             `json:"type" valid:"in(gauge|counter|histogram),required"` // параметр, принимающий значение gauge, counter или histogram
+	Delta     *int64             `json:"delta,omitempty"`                                   // значение метрики в случае передачи counter
+	Value     *float64           `json:"value,omitempty"`                                   // значение метрики в случае передачи gauge
+	Histogram *utils.Histogram   `json:"histogram,omitempty"`                               // значение метрики в случае передачи histogram
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`                               // оценки квантилей histogram в ответе сервера
+	Hash      string             `json:"hash,omitempty"`                                    // значение хеш-функции
+	KeyID     string             `json:"key_id,omitempty"`                                  // идентификатор ключа, которым подписан hash
+	Labels    Labels             `json:"labels,omitempty"`                                  // метки, которые вместе с именем и типом определяют метрику
+}
+
+// Labels are the key/value pairs, which distinguish the metrics with the same name, e.g. reported by the different hosts.
+type Labels map[string]string
+
+// String returns the canonical representation of the labels, it is empty when there are no labels.
+func (l Labels) String() string {
+	return utils.LabelsString(l)
 }
 
 type GaugeMetric struct {
-	Value float64
-	Name  string
+	Value  float64
+	Name   string
+	Labels Labels `json:",omitempty"`
+}
+
+// Key identifies the series of the metric among the metrics of the same type.
+func (m GaugeMetric) Key() string {
+	return SeriesKey(m.Name, m.Labels)
 }
 
 type CounterMetric struct {
-	Value int64
-	Name  string
+	Value  int64
+	Name   string
+	Labels Labels `json:",omitempty"`
+}
+
+// Key identifies the series of the metric among the metrics of the same type.
+func (m CounterMetric) Key() string {
+	return SeriesKey(m.Name, m.Labels)
+}
+
+// GaugeIncrement is the change of the gauge. UpsertMany and IncrementMany atomically add it to the stored gauge,
+// so the concurrent changes of the same gauge aren't lost.
+type GaugeIncrement GaugeMetric
+
+// CounterIncrement is the increment of the counter. UpsertMany and IncrementMany add it to the stored counter,
+// so the increments and the replaced counters can be written in one batch.
+type CounterIncrement CounterMetric
+
+type HistogramMetric struct {
+	Value  utils.Histogram
+	Name   string
+	Labels Labels `json:",omitempty"`
+}
+
+// Key identifies the series of the metric among the metrics of the same type.
+func (m HistogramMetric) Key() string {
+	return SeriesKey(m.Name, m.Labels)
+}
+
+// SeriesKey is the name followed by the canonical representation of the labels, e.g. HeapAlloc{host="a"}.
+// It is just the name for the metric without labels.
+func SeriesKey(name string, labels Labels) string {
+	return name + labels.String()
+}
+
+// Sample is the value of the metric at the moment of the update. For counters, Delta is the total value after the update.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+}
+
+// RollupPoint is the aggregate of the metric over the interval of the resolution started at Timestamp.
+// Gauges have Min, Max, Avg and Last, counters have the sum of the increments in Delta.
+type RollupPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Count     int64     `json:"count"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Min       *float64  `json:"min,omitempty"`
+	Max       *float64  `json:"max,omitempty"`
+	Avg       *float64  `json:"avg,omitempty"`
+	Last      *float64  `json:"last,omitempty"`
 }
 
 var ErrMetricNotFound = errors.New("metric not found")
+var ErrHistoryDisabled = errors.New("history is disabled")
+var ErrRollupsDisabled = errors.New("rollups are disabled")
+var ErrUnknownResolution = errors.New("unknown resolution")
 
 type IHashGenerator interface {
+	// Generate signs with the current key
 	Generate(stringToHash string) (string, error)
-	Equal(string, string) bool
+	// Verify checks the sign with the key of the id, or with any known key if the id is empty
+	Verify(keyID string, stringToHash string, sign string) bool
+	// KeyID returns the id of the current key
+	KeyID() string
 }
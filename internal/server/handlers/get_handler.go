@@ -45,7 +45,12 @@ func (g *GetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = g.handleBody(w, metric, r.Header.Get("Accept"))
+	if _, err = getQuantilesFromQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = g.handleBody(w, r, metric)
 
 	if err == nil {
 		return
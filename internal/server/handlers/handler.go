@@ -38,7 +38,7 @@ func (h *Handler) getMetricFromRequest(r *http.Request) (metric Metrics, err err
 		return metric, err
 	}
 
-	_, err = h.validateMetric(&metric)
+	_, err = h.validateMetric(r, &metric)
 
 	if err != nil {
 		return metric, err
@@ -67,6 +67,13 @@ func (h *Handler) getMetricsFromJSON(r *http.Request) (metric Metrics, err error
 func (h *Handler) getMetricFromURL(r *http.Request) (metric Metrics, err error) {
 	metric.MType = h.ParametersBag.GetURLParam(r, paramNameMetricType)
 	metric.ID = h.ParametersBag.GetURLParam(r, paramNameMetricName)
+	metric.Labels = getLabelsFromQuery(r)
+	if metric.MType == MetricTypeHistogram && metric.Labels != nil {
+		delete(metric.Labels, paramNameQuantile)
+		if len(metric.Labels) == 0 {
+			metric.Labels = nil
+		}
+	}
 
 	metricValue := h.ParametersBag.GetURLParam(r, paramNameMetricValue)
 	if metricValue == "" {
@@ -74,7 +81,8 @@ func (h *Handler) getMetricFromURL(r *http.Request) (metric Metrics, err error)
 	}
 
 	switch metric.MType {
-	case MetricTypeGauge:
+	case MetricTypeGauge, MetricTypeHistogram:
+		// the value of the histogram is the single observation
 		var value float64
 		value, err = strconv.ParseFloat(metricValue, 64)
 		metric.Value = &value
@@ -89,21 +97,34 @@ func (h *Handler) getMetricFromURL(r *http.Request) (metric Metrics, err error)
 	return metric, err
 }
 
-func (h *Handler) handleBody(w http.ResponseWriter, metric Metrics, acceptHeader string) (err error) {
+func (h *Handler) handleBody(w http.ResponseWriter, r *http.Request, metric Metrics) (err error) {
+	acceptHeader := r.Header.Get("Accept")
 	actualMetric, err := h.getActualMetric(metric)
 	if err != nil {
 		return err
 	}
 
+	var quantiles []float64
+	if actualMetric.Histogram != nil {
+		quantiles, err = getQuantilesFromQuery(r)
+		if err != nil {
+			return err
+		}
+	}
+
 	if h.HashGenerator != nil {
 		sign, err := h.getSign(actualMetric)
 		if err != nil {
 			return err
 		}
 		actualMetric.Hash = sign
+		actualMetric.KeyID = h.HashGenerator.KeyID()
 	}
 
 	if acceptHeader == "application/json" {
+		if actualMetric.Histogram != nil {
+			actualMetric.Quantiles = estimateQuantiles(*actualMetric.Histogram, append(defaultQuantiles, quantiles...))
+		}
 		body, err := json.Marshal(actualMetric)
 		if err != nil {
 			return err
@@ -114,9 +135,14 @@ func (h *Handler) handleBody(w http.ResponseWriter, metric Metrics, acceptHeader
 		return nil
 	}
 
-	if actualMetric.Value != nil {
+	switch {
+	case actualMetric.Histogram != nil && len(quantiles) > 0:
+		w.Write([]byte(fmt.Sprintf("%.3f", actualMetric.Histogram.Quantile(quantiles[0]))))
+	case actualMetric.Histogram != nil:
+		w.Write([]byte(histogramSummary(*actualMetric.Histogram)))
+	case actualMetric.Value != nil:
 		w.Write([]byte(fmt.Sprintf("%.3f", *actualMetric.Value)))
-	} else {
+	default:
 		w.Write([]byte(fmt.Sprintf("%d", *actualMetric.Delta)))
 	}
 
@@ -124,28 +150,46 @@ func (h *Handler) handleBody(w http.ResponseWriter, metric Metrics, acceptHeader
 }
 
 func (h *Handler) getActualMetric(metric Metrics) (Metrics, error) {
+	return GetActualMetric(h.Repository, metric)
+}
+
+// GetActualMetric returns the stored value of the metric identified by the type, the name and the labels
+func GetActualMetric(repository IRepository, metric Metrics) (Metrics, error) {
 	var actualMetric Metrics
 
 	switch metric.MType {
 	case MetricTypeCounter:
-		v, err := h.Repository.GetCounter(metric.ID)
+		v, err := repository.GetCounter(metric.ID, metric.Labels)
 		if err != nil {
 			return Metrics{}, err
 		}
 		actualMetric = Metrics{
-			ID:    metric.ID,
-			MType: MetricTypeCounter,
-			Delta: &v,
+			ID:     metric.ID,
+			MType:  MetricTypeCounter,
+			Delta:  &v,
+			Labels: metric.Labels,
 		}
 	case MetricTypeGauge:
-		v, err := h.Repository.GetGauge(metric.ID)
+		v, err := repository.GetGauge(metric.ID, metric.Labels)
 		if err != nil {
 			return Metrics{}, err
 		}
 		actualMetric = Metrics{
-			ID:    metric.ID,
-			MType: MetricTypeGauge,
-			Value: &v,
+			ID:     metric.ID,
+			MType:  MetricTypeGauge,
+			Value:  &v,
+			Labels: metric.Labels,
+		}
+	case MetricTypeHistogram:
+		v, err := repository.GetHistogram(metric.ID, metric.Labels)
+		if err != nil {
+			return Metrics{}, err
+		}
+		actualMetric = Metrics{
+			ID:        metric.ID,
+			MType:     MetricTypeHistogram,
+			Histogram: &v,
+			Labels:    metric.Labels,
 		}
 	default:
 		return Metrics{}, errors.New("trying to get metric with unknown type, there is an error in logic of checking request")
@@ -154,8 +198,23 @@ func (h *Handler) getActualMetric(metric Metrics) (Metrics, error) {
 	return actualMetric, nil
 }
 
-func (h *Handler) validateMetric(metric *Metrics) (bool, error) {
-	if h.IsSkipCheckOfHashForRequest {
+// ValidateMetric checks the metric of the update, whose sign is already verified
+func ValidateMetric(metric Metrics) error {
+	if _, err := valid.ValidateStruct(metric); err != nil {
+		return err
+	}
+	if metric.MType == MetricTypeGauge && metric.Value == nil {
+		return errors.New("value is required")
+	}
+	if metric.MType == MetricTypeCounter && metric.Delta == nil {
+		return errors.New("delta is required")
+	}
+
+	return validateHistogramUpdate(metric)
+}
+
+func (h *Handler) validateMetric(r *http.Request, metric *Metrics) (bool, error) {
+	if h.IsSkipCheckOfHashForRequest || isBodyVerified(r) {
 		return valid.ValidateStruct(metric)
 	}
 
@@ -163,26 +222,65 @@ func (h *Handler) validateMetric(metric *Metrics) (bool, error) {
 		return false, fmt.Errorf("hash is not correct")
 	}
 
-	sign, err := h.getSign(*metric)
+	stringToHash, err := getStringToHash(*metric)
 	if err != nil {
 		return false, err
 	}
 
-	if !h.HashGenerator.Equal(metric.Hash, sign) {
+	if !h.HashGenerator.Verify(metric.KeyID, stringToHash, metric.Hash) {
 		return false, fmt.Errorf("hash is not correct")
 	}
 
 	return valid.ValidateStruct(metric)
 }
 
-func (h *Handler) getSign(metric Metrics) (sign string, err error) {
+// getSign signs the metric with the current key
+func (h *Handler) getSign(metric Metrics) (string, error) {
+	stringToHash, err := getStringToHash(metric)
+	if err != nil {
+		return "", err
+	}
+
+	return h.HashGenerator.Generate(stringToHash)
+}
+
+// getStringToHash returns the string the metric is signed by. The labels are appended only when there are any,
+// so the signs of the metrics without labels are the same as before the labels were introduced.
+func getStringToHash(metric Metrics) (string, error) {
+	var stringToHash string
 	switch metric.MType {
 	case MetricTypeCounter:
-		stringToHash := fmt.Sprintf("%s:%s:%d", metric.ID, metric.MType, *metric.Delta)
-		return h.HashGenerator.Generate(stringToHash)
-
+		stringToHash = fmt.Sprintf("%s:%s:%d", metric.ID, metric.MType, *metric.Delta)
+	case MetricTypeHistogram:
+		if metric.Histogram == nil && metric.Value == nil {
+			return "", errors.New("histogram or value is required")
+		}
+		if metric.Histogram != nil {
+			stringToHash = fmt.Sprintf("%s:%s:%s", metric.ID, metric.MType, metric.Histogram.SignString())
+		} else {
+			stringToHash = fmt.Sprintf("%s:%s:%f", metric.ID, metric.MType, *metric.Value)
+		}
 	default:
-		stringToHash := fmt.Sprintf("%s:%s:%f", metric.ID, metric.MType, *metric.Value)
-		return h.HashGenerator.Generate(stringToHash)
+		stringToHash = fmt.Sprintf("%s:%s:%f", metric.ID, metric.MType, *metric.Value)
 	}
+
+	if len(metric.Labels) != 0 {
+		stringToHash += ":" + metric.Labels.String()
+	}
+
+	return stringToHash, nil
+}
+
+// getLabelsFromQuery treats every parameter of the query string as a label, e.g. /value/gauge/HeapAlloc?host=a
+func getLabelsFromQuery(r *http.Request) Labels {
+	if r.URL == nil || r.URL.RawQuery == "" {
+		return nil
+	}
+
+	labels := Labels{}
+	for key, values := range r.URL.Query() {
+		labels[key] = values[len(values)-1]
+	}
+
+	return labels
 }
@@ -11,6 +11,7 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 )
@@ -63,7 +64,7 @@ func TestGetMetricFromRequest(t *testing.T) {
 		expectedMetric: expected,
 	}
 
-	h := utils.NewHashGenerator("secret key")
+	h := utils.NewKeyring("", "secret key")
 	stringToHash := fmt.Sprintf("metric_name4:gauge:%f", expectedValue)
 	sign, err := h.Generate(stringToHash)
 	require.Nil(t, err)
@@ -188,6 +189,46 @@ func TestGetMetricFromRequest(t *testing.T) {
 		expectedMetric: expected,
 	}
 
+	histogram, err := utils.NewHistogram([]float64{0.1, 1})
+	require.Nil(t, err)
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	sign, err = h.Generate("latency:histogram:" + histogram.SignString())
+	require.Nil(t, err)
+	expected = Metrics{
+		MType:     MetricTypeHistogram,
+		ID:        "latency",
+		Histogram: &histogram,
+		Hash:      sign,
+	}
+	tests["with sign - update histogram - success"] = testCase{
+		request:        newJSONRequest(expected),
+		updateHandler:  NewUpdateHandlerWithHashGenerator(RepositoryMock{}, ParametersBagMock{}, h, false),
+		expectedMetric: expected,
+	}
+
+	observedValue := 0.25
+	expected = Metrics{
+		MType:  MetricTypeHistogram,
+		ID:     "latency",
+		Value:  &observedValue,
+		Labels: Labels{"host": "a"},
+	}
+	tests["text - update for histogram - quantile is not a label"] = testCase{
+		request: &http.Request{URL: &url.URL{RawQuery: "host=a&quantile=0.9"}},
+		updateHandler: NewUpdateHandlerDefault(
+			RepositoryMock{},
+			ParametersBagMock{
+				parameters: map[string]string{
+					paramNameMetricType:  expected.MType,
+					paramNameMetricName:  expected.ID,
+					paramNameMetricValue: "0.25",
+				},
+			},
+		),
+		expectedMetric: expected,
+	}
+
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			actual, err := tt.updateHandler.getMetricFromRequest(tt.request)
@@ -224,10 +265,10 @@ func (r RepositoryMock) UpsertGauge(metric GaugeMetric) error {
 func (r RepositoryMock) UpsertCounter(metric CounterMetric) error {
 	panic("must not be invoked")
 }
-func (r RepositoryMock) GetGauge(name string) (float64, error) {
+func (r RepositoryMock) GetGauge(name string, labels Labels) (float64, error) {
 	panic("must not be invoked")
 }
-func (r RepositoryMock) GetCounter(name string) (int64, error) {
+func (r RepositoryMock) GetCounter(name string, labels Labels) (int64, error) {
 	panic("must not be invoked")
 }
 func (r RepositoryMock) GetAllGauge() ([]GaugeMetric, error) {
@@ -239,3 +280,18 @@ func (r RepositoryMock) GetAllCounters() ([]CounterMetric, error) {
 func (r RepositoryMock) UpsertMany(ctx context.Context, metrics []interface{}) error {
 	panic("must not be invoked")
 }
+func (r RepositoryMock) IncrementCounter(metric CounterMetric) (int64, error) {
+	panic("must not be invoked")
+}
+func (r RepositoryMock) IncrementMany(ctx context.Context, metrics []interface{}) error {
+	panic("must not be invoked")
+}
+func (r RepositoryMock) MergeHistogram(metric HistogramMetric) (utils.Histogram, error) {
+	panic("must not be invoked")
+}
+func (r RepositoryMock) GetHistogram(name string, labels Labels) (utils.Histogram, error) {
+	panic("must not be invoked")
+}
+func (r RepositoryMock) GetAllHistograms() ([]HistogramMetric, error) {
+	panic("must not be invoked")
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smamykin/smetrics/internal/utils"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// defaultQuantiles are estimated for the histograms when the quantile is not requested explicitly.
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// ErrReservedHistogramLabel is returned for the histogram with the label le, which the exposition
+// of the histogram adds to its buckets, so the buckets of the different series would collide
+var ErrReservedHistogramLabel = errors.New("the label le is reserved for the buckets of the histogram")
+
+// ValidateHistogramLabels checks that the labels of the histogram don't collide with the labels of its buckets
+func ValidateHistogramLabels(labels Labels) error {
+	if _, ok := labels["le"]; ok {
+		return ErrReservedHistogramLabel
+	}
+
+	return nil
+}
+
+// validateHistogramUpdate checks that the update of the histogram carries either the histogram or the single value to observe.
+func validateHistogramUpdate(metric Metrics) error {
+	if metric.MType != MetricTypeHistogram {
+		return nil
+	}
+	if err := ValidateHistogramLabels(metric.Labels); err != nil {
+		return err
+	}
+	if metric.Histogram != nil {
+		return metric.Histogram.Validate()
+	}
+	if metric.Value == nil {
+		return errors.New("histogram or value is required")
+	}
+	if math.IsNaN(*metric.Value) || math.IsInf(*metric.Value, 0) {
+		return utils.ErrNonFiniteValue
+	}
+
+	return nil
+}
+
+// histogramToMerge returns the histogram of the update. The single value is observed into the histogram
+// with the bounds of the stored one, or with the default bounds if there is no stored histogram yet.
+func histogramToMerge(repository IRepository, metric Metrics) (utils.Histogram, error) {
+	if metric.Histogram != nil {
+		return *metric.Histogram, nil
+	}
+
+	bounds := utils.DefaultHistogramBounds
+	stored, err := repository.GetHistogram(metric.ID, metric.Labels)
+	if err == nil {
+		bounds = stored.Bounds
+	} else if !errors.Is(err, ErrMetricNotFound) {
+		return utils.Histogram{}, err
+	}
+
+	histogram, err := utils.NewHistogram(bounds)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+	if err = histogram.Observe(*metric.Value); err != nil {
+		return utils.Histogram{}, err
+	}
+
+	return histogram, nil
+}
+
+// getQuantilesFromQuery returns the quantiles requested with the quantile parameter, e.g. ?quantile=0.99
+func getQuantilesFromQuery(r *http.Request) ([]float64, error) {
+	if r.URL == nil {
+		return nil, nil
+	}
+
+	var quantiles []float64
+	for _, value := range r.URL.Query()[paramNameQuantile] {
+		quantile, err := strconv.ParseFloat(value, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			return nil, fmt.Errorf("invalid quantile %q, expected a number within [0, 1]", value)
+		}
+		quantiles = append(quantiles, quantile)
+	}
+
+	return quantiles, nil
+}
+
+// estimateQuantiles returns the estimates by the quantiles formatted as strings, e.g. {"0.99": 0.25}.
+// The estimates of the empty histogram are skipped, because NaN is not valid JSON.
+func estimateQuantiles(histogram utils.Histogram, quantiles []float64) map[string]float64 {
+	result := map[string]float64{}
+	for _, quantile := range quantiles {
+		estimate := histogram.Quantile(quantile)
+		if math.IsNaN(estimate) {
+			continue
+		}
+		result[strconv.FormatFloat(quantile, 'g', -1, 64)] = estimate
+	}
+
+	return result
+}
+
+// histogramSummary is the text representation of the histogram, e.g. count=10 sum=1.500 p50=0.100 p90=0.250 p99=0.500
+func histogramSummary(histogram utils.Histogram) string {
+	summary := fmt.Sprintf("count=%d sum=%.3f", histogram.Count, histogram.Sum)
+	for _, quantile := range defaultQuantiles {
+		summary += fmt.Sprintf(" p%s=%.3f", strconv.FormatFloat(quantile*100, 'g', -1, 64), histogram.Quantile(quantile))
+	}
+
+	return summary
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestEstimateQuantiles(t *testing.T) {
+	histogram, err := utils.NewHistogram([]float64{1, 2, 4})
+	require.Nil(t, err)
+	for _, value := range []float64{0.5, 1.5, 1.5, 3, 10} {
+		histogram.Observe(value)
+	}
+
+	require.Equal(t, map[string]float64{
+		"0":   0,
+		"0.2": 1,
+		"0.5": 1.75,
+		"0.8": 4,
+		"1":   4,
+	}, estimateQuantiles(histogram, []float64{0, 0.2, 0.5, 0.8, 1}))
+
+	empty, err := utils.NewHistogram([]float64{1})
+	require.Nil(t, err)
+	require.Equal(t, map[string]float64{}, estimateQuantiles(empty, defaultQuantiles))
+}
+
+func TestValidateHistogramUpdate(t *testing.T) {
+	value := 0.5
+	require.Nil(t, validateHistogramUpdate(Metrics{ID: "latency", MType: MetricTypeHistogram, Value: &value}))
+	require.NotNil(t, validateHistogramUpdate(Metrics{ID: "latency", MType: MetricTypeHistogram}))
+	// le is the label of the buckets in the exposition
+	require.ErrorIs(t, validateHistogramUpdate(Metrics{ID: "latency", MType: MetricTypeHistogram, Value: &value, Labels: Labels{"le": "1"}}), ErrReservedHistogramLabel)
+	require.Nil(t, ValidateMetric(Metrics{ID: "latency", MType: MetricTypeGauge, Value: &value, Labels: Labels{"le": "1"}}))
+
+	inconsistent := utils.Histogram{Bounds: []float64{1}, Counts: []int64{1, 1}, Count: 1}
+	require.NotNil(t, validateHistogramUpdate(Metrics{ID: "latency", MType: MetricTypeHistogram, Histogram: &inconsistent}))
+
+	descending := utils.Histogram{Bounds: []float64{2, 1}, Counts: []int64{0, 0, 0}}
+	require.NotNil(t, validateHistogramUpdate(Metrics{ID: "latency", MType: MetricTypeHistogram, Histogram: &descending}))
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		value := value
+		require.ErrorIs(t, validateHistogramUpdate(Metrics{ID: "latency", MType: MetricTypeHistogram, Value: &value}), utils.ErrNonFiniteValue)
+
+		histogram, err := utils.NewHistogram([]float64{1})
+		require.Nil(t, err)
+		require.ErrorIs(t, histogram.Observe(value), utils.ErrNonFiniteValue)
+		require.Equal(t, int64(0), histogram.Count)
+
+		histogram.Sum = value
+		require.ErrorIs(t, histogram.Validate(), utils.ErrNonFiniteValue)
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// maxReportedLineErrors limits the errors listed in the response, the rest are only counted
+const maxReportedLineErrors = 100
+
+// InfluxWriteHandler accepts the InfluxDB line protocol as the /api/v2/write endpoint of InfluxDB does, e.g. from Telegraf.
+// The integer fields become the counters and the float fields become the gauges named measurement_field,
+// or just measurement for the field named value, the tags become the labels. The counters are replaced,
+// since Telegraf reports the totals. The boolean and string fields are skipped, and so are the timestamps,
+// because the repository keeps only the current values.
+type InfluxWriteHandler struct {
+	Repository IRepository
+}
+
+func NewInfluxWriteHandler(repository IRepository) *InfluxWriteHandler {
+	return &InfluxWriteHandler{Repository: repository}
+}
+
+// InfluxWriteResponse is the body of the failed request. The valid lines are written even if some are rejected.
+type InfluxWriteResponse struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Errors  []InfluxLineError `json:"errors,omitempty"`
+}
+
+// InfluxLineError is the error of the line, the lines are numbered from 1
+type InfluxLineError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (h *InfluxWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("precision") {
+	case "", "ns", "us", "ms", "s":
+	default:
+		writeInfluxResponse(w, http.StatusBadRequest, InfluxWriteResponse{Code: "invalid", Message: "invalid precision"})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInfluxResponse(w, http.StatusBadRequest, InfluxWriteResponse{Code: "invalid", Message: err.Error()})
+		return
+	}
+	defer r.Body.Close()
+
+	metrics := make(map[string]interface{})
+	var lineErrors []InfluxLineError
+	rejected := 0
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		point, err := ParseLineProtocol(line)
+		if err == nil {
+			err = addLineProtocolMetrics(metrics, point)
+		}
+		if err != nil {
+			rejected++
+			if len(lineErrors) < maxReportedLineErrors {
+				lineErrors = append(lineErrors, InfluxLineError{Line: i + 1, Message: err.Error()})
+			}
+		}
+	}
+
+	if len(metrics) > 0 {
+		metricsToUpsert := make([]interface{}, 0, len(metrics))
+		for _, metric := range metrics {
+			metricsToUpsert = append(metricsToUpsert, metric)
+		}
+		if err = h.Repository.UpsertMany(r.Context(), metricsToUpsert); err != nil {
+			writeInfluxResponse(w, http.StatusInternalServerError, InfluxWriteResponse{Code: "internal error", Message: err.Error()})
+			return
+		}
+	}
+
+	if rejected > 0 {
+		writeInfluxResponse(w, http.StatusBadRequest, InfluxWriteResponse{
+			Code:    "invalid",
+			Message: fmt.Sprintf("partial write: %d lines rejected", rejected),
+			Errors:  lineErrors,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addLineProtocolMetrics converts the fields of the point to the metrics, the later point of the same series replaces the earlier one
+func addLineProtocolMetrics(metrics map[string]interface{}, point LineProtocolPoint) error {
+	for _, field := range point.Fields {
+		name := LineProtocolMetricName(point.Measurement, field.Key)
+		switch value := field.Value.(type) {
+		case int64:
+			metrics[MetricTypeCounter+":"+SeriesKey(name, point.Tags)] = CounterMetric{Name: name, Value: value, Labels: point.Tags}
+		case uint64:
+			if value > math.MaxInt64 {
+				return fmt.Errorf("the value of field %q overflows the counter", field.Key)
+			}
+			metrics[MetricTypeCounter+":"+SeriesKey(name, point.Tags)] = CounterMetric{Name: name, Value: int64(value), Labels: point.Tags}
+		case float64:
+			metrics[MetricTypeGauge+":"+SeriesKey(name, point.Tags)] = GaugeMetric{Name: name, Value: value, Labels: point.Tags}
+		}
+	}
+
+	return nil
+}
+
+// LineProtocolMetricName is the name of the metric of the field, e.g. cpu_usage, the field named value is named after the measurement
+func LineProtocolMetricName(measurement string, field string) string {
+	if field == "value" {
+		return measurement
+	}
+
+	return measurement + "_" + field
+}
+
+func writeInfluxResponse(w http.ResponseWriter, statusCode int, response InfluxWriteResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidLineProtocol = errors.New("invalid line protocol")
+
+// LineProtocolPoint is the parsed line of the InfluxDB line protocol, e.g. cpu,host=a usage=0.5,ticks=10i 1465839830100400200
+type LineProtocolPoint struct {
+	Measurement string
+	Tags        Labels
+	Fields      []LineProtocolField
+	// Timestamp is in the precision of the request, it is zero when the line has none
+	Timestamp int64
+}
+
+// LineProtocolField is the field of the point, Value is int64 for the integers, uint64 for the unsigned integers,
+// float64 for the floats, bool for the booleans and string for the strings.
+type LineProtocolField struct {
+	Key   string
+	Value interface{}
+}
+
+var lineProtocolUnescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`)
+
+// ParseLineProtocol parses the line in the format measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func ParseLineProtocol(line string) (LineProtocolPoint, error) {
+	var point LineProtocolPoint
+
+	measurement, stop, rest := cutUnescaped(line, ", ")
+	if measurement == "" {
+		return point, fmt.Errorf("%w: missing measurement", ErrInvalidLineProtocol)
+	}
+	point.Measurement = lineProtocolUnescaper.Replace(measurement)
+
+	for stop == ',' {
+		var key, value string
+		key, stop, rest = cutUnescaped(rest, "=, ")
+		if stop != '=' || key == "" {
+			return point, fmt.Errorf("%w: invalid tag %q", ErrInvalidLineProtocol, key)
+		}
+		value, stop, rest = cutUnescaped(rest, ", ")
+		if value == "" {
+			return point, fmt.Errorf("%w: missing value of tag %q", ErrInvalidLineProtocol, key)
+		}
+		if point.Tags == nil {
+			point.Tags = Labels{}
+		}
+		point.Tags[lineProtocolUnescaper.Replace(key)] = lineProtocolUnescaper.Replace(value)
+	}
+	if stop != ' ' {
+		return point, fmt.Errorf("%w: missing fields", ErrInvalidLineProtocol)
+	}
+
+	for {
+		var key string
+		key, stop, rest = cutUnescaped(rest, "=, ")
+		if stop != '=' || key == "" {
+			return point, fmt.Errorf("%w: invalid field %q", ErrInvalidLineProtocol, key)
+		}
+
+		var value interface{}
+		var err error
+		value, stop, rest, err = cutFieldValue(rest)
+		if err != nil {
+			return point, fmt.Errorf("%w: field %q: %v", ErrInvalidLineProtocol, key, err)
+		}
+		point.Fields = append(point.Fields, LineProtocolField{Key: lineProtocolUnescaper.Replace(key), Value: value})
+
+		if stop != ',' {
+			break
+		}
+	}
+
+	if stop == ' ' && rest != "" {
+		timestamp, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidLineProtocol, rest)
+		}
+		point.Timestamp = timestamp
+	}
+
+	return point, nil
+}
+
+// cutUnescaped returns the part of s before the first of the stop characters which is not escaped with the backslash,
+// the stop character and the part after it. The stop character is zero when there is none in s.
+func cutUnescaped(s string, stops string) (token string, stop byte, rest string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.IndexByte(stops, s[i]) >= 0 {
+			return s[:i], s[i], s[i+1:]
+		}
+	}
+
+	return s, 0, ""
+}
+
+// cutFieldValue parses the value at the beginning of s, which is followed by the comma, the space or the end of the line
+func cutFieldValue(s string) (value interface{}, stop byte, rest string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] != '"' {
+				continue
+			}
+
+			value = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s[1:i])
+			rest = s[i+1:]
+			if rest == "" {
+				return value, 0, "", nil
+			}
+			if rest[0] != ',' && rest[0] != ' ' {
+				return nil, 0, "", errors.New("unexpected characters after the string")
+			}
+			return value, rest[0], rest[1:], nil
+		}
+		return nil, 0, "", errors.New("unterminated string")
+	}
+
+	var raw string
+	raw, stop, rest = cutUnescaped(s, ", ")
+	switch {
+	case raw == "":
+		return nil, 0, "", errors.New("missing value")
+	case strings.HasSuffix(raw, "i"):
+		value, err = strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+	case strings.HasSuffix(raw, "u"):
+		value, err = strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+	default:
+		switch raw {
+		case "t", "T", "true", "True", "TRUE":
+			value = true
+		case "f", "F", "false", "False", "FALSE":
+			value = false
+		default:
+			var float float64
+			float, err = strconv.ParseFloat(raw, 64)
+			if err == nil && (math.IsNaN(float) || math.IsInf(float, 0)) {
+				err = errors.New("the float must be finite")
+			}
+			value = float
+		}
+	}
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("invalid value %q: %w", raw, err)
+	}
+
+	return value, stop, rest, nil
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	tests := map[string]LineProtocolPoint{
+		"cpu usage=0.5": {Measurement: "cpu", Fields: []LineProtocolField{{Key: "usage", Value: 0.5}}},
+		"cpu,host=a,region=eu usage=1,ticks=10i,free=3u 1465839830100400200": {
+			Measurement: "cpu",
+			Tags:        Labels{"host": "a", "region": "eu"},
+			Fields:      []LineProtocolField{{Key: "usage", Value: 1.0}, {Key: "ticks", Value: int64(10)}, {Key: "free", Value: uint64(3)}},
+			Timestamp:   1465839830100400200,
+		},
+		`disk\ io,path=C:\\,name=a\,b\ c=d read\ bytes=-2i`: {
+			Measurement: "disk io",
+			Tags:        Labels{"path": `C:\`, "name": "a,b c=d"},
+			Fields:      []LineProtocolField{{Key: "read bytes", Value: int64(-2)}},
+		},
+		`system uptime_format="1 day, \"01:02\"",up=true 10`: {
+			Measurement: "system",
+			Fields:      []LineProtocolField{{Key: "uptime_format", Value: `1 day, "01:02"`}, {Key: "up", Value: true}},
+			Timestamp:   10,
+		},
+	}
+	for line, expected := range tests {
+		point, err := ParseLineProtocol(line)
+		require.Nil(t, err, line)
+		require.Equal(t, expected, point, line)
+	}
+
+	for _, line := range []string{
+		"cpu",
+		",host=a usage=1",
+		"cpu,host usage=1",
+		"cpu,host= usage=1",
+		"cpu usage",
+		"cpu usage=",
+		"cpu usage=abc",
+		"cpu usage=1x",
+		"cpu usage=NaN",
+		"cpu ticks=1.5i",
+		`cpu name="unterminated`,
+		`cpu name="a"b`,
+		"cpu usage=1 now",
+	} {
+		_, err := ParseLineProtocol(line)
+		require.ErrorIs(t, err, ErrInvalidLineProtocol, line)
+	}
+}
@@ -12,13 +12,21 @@ type ListHandler struct {
 const listMetricsTmpl = `
 <html>
     <ol>{{ range .GaugeMetrics }}
-        <li>{{.Name}}:{{.Value}}</li>{{end}}
+        <li>{{.Key}}:{{.Value}}</li>{{end}}
     </ol>
     <ol>{{ range .CounterMetrics }}
-        <li>{{.Name}}:{{.Value}}</li>{{end}}
-    </ol>
+        <li>{{.Key}}:{{.Value}}</li>{{end}}
+    </ol>{{ if .HistogramMetrics }}
+    <ol>{{ range .HistogramMetrics }}
+        <li>{{.Key}}:{{.Summary}}</li>{{end}}
+    </ol>{{end}}
 </html>`
 
+type histogramListItem struct {
+	Key     string
+	Summary string
+}
+
 func (l *ListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 	w.Header().Set("Content-Type", "text/html")
@@ -38,12 +46,24 @@ func (l *ListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	histogramMetrics, err := l.Repository.GetAllHistograms()
+	if err != nil {
+		http.Error(w, "the error occurred while requesting the histogram metrics", http.StatusInternalServerError)
+		return
+	}
+	var histogramItems []histogramListItem
+	for _, metric := range histogramMetrics {
+		histogramItems = append(histogramItems, histogramListItem{Key: metric.Key(), Summary: histogramSummary(metric.Value)})
+	}
+
 	err = t.Execute(w, struct {
-		GaugeMetrics   []GaugeMetric
-		CounterMetrics []CounterMetric
+		GaugeMetrics     []GaugeMetric
+		CounterMetrics   []CounterMetric
+		HistogramMetrics []histogramListItem
 	}{
-		GaugeMetrics:   gaugeMetrics,
-		CounterMetrics: counterMetrics,
+		GaugeMetrics:     gaugeMetrics,
+		CounterMetrics:   counterMetrics,
+		HistogramMetrics: histogramItems,
 	})
 
 	if err != nil {
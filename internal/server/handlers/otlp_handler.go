@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// maxReportedOTLPErrors limits the distinct errors listed in the message of the partial success
+const maxReportedOTLPErrors = 10
+
+// OTLPHandler accepts the metrics of the OpenTelemetry SDKs as the /v1/metrics endpoint of OTLP/HTTP does,
+// encoded in protobuf or JSON. The monotonic sums become the counters: the delta ones are added to the stored counters,
+// the cumulative ones replace them. The gauges and the non-monotonic sums become the gauges.
+// The attributes of the resource and of the data point become the labels, except NamePrefixAttributes,
+// whose values prefix the name of the metric, e.g. api.http.server.requests for service.name=api.
+// The other types of the metrics are rejected and reported in the partial success.
+type OTLPHandler struct {
+	Repository           IRepository
+	NamePrefixAttributes []string
+}
+
+func NewOTLPHandler(repository IRepository, namePrefixAttributes []string) *OTLPHandler {
+	return &OTLPHandler{Repository: repository, NamePrefixAttributes: namePrefixAttributes}
+}
+
+func (h *OTLPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != contentTypeProtobuf && contentType != contentTypeJSON {
+		writeOTLPResponse(w, contentTypeProtobuf, http.StatusUnsupportedMediaType, status.New(codes.InvalidArgument, "unsupported content type").Proto())
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeOTLPResponse(w, contentType, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()).Proto())
+		return
+	}
+	defer r.Body.Close()
+
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if contentType == contentTypeJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, request)
+	} else {
+		err = proto.Unmarshal(body, request)
+	}
+	if err != nil {
+		writeOTLPResponse(w, contentType, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()).Proto())
+		return
+	}
+
+	batch := newOTLPBatch()
+	for _, resourceMetrics := range request.GetResourceMetrics() {
+		prefix, resourceLabels := h.splitResourceAttributes(resourceMetrics.GetResource().GetAttributes())
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				if metric.GetName() == "" {
+					batch.reject(dataPointsCount(metric), errors.New("the metric has no name"))
+					continue
+				}
+				batch.addMetric(prefix+metric.GetName(), resourceLabels, metric)
+			}
+		}
+	}
+
+	if err = batch.write(r, h.Repository); err != nil {
+		// the exporters retry on 503
+		writeOTLPResponse(w, contentType, http.StatusServiceUnavailable, status.New(codes.Unavailable, err.Error()).Proto())
+		return
+	}
+
+	response := &colmetricspb.ExportMetricsServiceResponse{}
+	if batch.rejected > 0 {
+		response.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: batch.rejected,
+			ErrorMessage:       strings.Join(batch.errors, "; "),
+		}
+	}
+	writeOTLPResponse(w, contentType, http.StatusOK, response)
+}
+
+// splitResourceAttributes returns the prefix of the names made of the values of NamePrefixAttributes, e.g. "api.",
+// and the labels made of the other attributes
+func (h *OTLPHandler) splitResourceAttributes(attributes []*commonpb.KeyValue) (string, Labels) {
+	labels := attributesToLabels(nil, attributes)
+
+	var prefix strings.Builder
+	for _, attribute := range h.NamePrefixAttributes {
+		value, ok := labels[attribute]
+		if !ok {
+			continue
+		}
+		delete(labels, attribute)
+		prefix.WriteString(value)
+		prefix.WriteString(".")
+	}
+
+	return prefix.String(), labels
+}
+
+// otlpBatch collects the metrics of the request, so they are written with one call per way of the writing
+type otlpBatch struct {
+	// replaced are the gauges and the cumulative counters, the data point with the latest time wins
+	replaced   map[string]interface{}
+	replacedAt map[string]uint64
+	// increments are the delta counters, they are added to the stored ones
+	increments map[string]CounterMetric
+	// gaugeIncrements are the delta non-monotonic sums, they are added to the stored gauges
+	gaugeIncrements map[string]GaugeMetric
+
+	rejected int64
+	errors   []string
+}
+
+func newOTLPBatch() *otlpBatch {
+	return &otlpBatch{
+		replaced:        map[string]interface{}{},
+		replacedAt:      map[string]uint64{},
+		increments:      map[string]CounterMetric{},
+		gaugeIncrements: map[string]GaugeMetric{},
+	}
+}
+
+func (b *otlpBatch) addMetric(name string, resourceLabels Labels, metric *metricspb.Metric) {
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		b.addDataPoints(name, resourceLabels, data.Gauge.GetDataPoints(), func(key string, point *metricspb.NumberDataPoint, labels Labels) error {
+			b.replace(MetricTypeGauge+":"+key, point.GetTimeUnixNano(), GaugeMetric{Name: name, Value: numberValue(point), Labels: labels})
+			return nil
+		})
+	case *metricspb.Metric_Sum:
+		temporality := data.Sum.GetAggregationTemporality()
+		isMonotonic := data.Sum.GetIsMonotonic()
+		b.addDataPoints(name, resourceLabels, data.Sum.GetDataPoints(), func(key string, point *metricspb.NumberDataPoint, labels Labels) error {
+			switch {
+			case temporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA &&
+				temporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+				return fmt.Errorf("the sum %q has no aggregation temporality", name)
+			case !isMonotonic && temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+				gauge := b.gaugeIncrements[key]
+				b.gaugeIncrements[key] = GaugeMetric{Name: name, Value: gauge.Value + numberValue(point), Labels: labels}
+			case !isMonotonic:
+				b.replace(MetricTypeGauge+":"+key, point.GetTimeUnixNano(), GaugeMetric{Name: name, Value: numberValue(point), Labels: labels})
+			default:
+				value, err := counterValue(point)
+				if err != nil {
+					return fmt.Errorf("the value of %q %w", name, err)
+				}
+				if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+					counter := b.increments[key]
+					b.increments[key] = CounterMetric{Name: name, Value: counter.Value + value, Labels: labels}
+				} else {
+					b.replace(MetricTypeCounter+":"+key, point.GetTimeUnixNano(), CounterMetric{Name: name, Value: value, Labels: labels})
+				}
+			}
+			return nil
+		})
+	case *metricspb.Metric_Histogram:
+		b.reject(dataPointsCount(metric), fmt.Errorf("the histogram %q is not supported", name))
+	case *metricspb.Metric_ExponentialHistogram:
+		b.reject(dataPointsCount(metric), fmt.Errorf("the exponential histogram %q is not supported", name))
+	case *metricspb.Metric_Summary:
+		b.reject(dataPointsCount(metric), fmt.Errorf("the summary %q is not supported", name))
+	default:
+		b.reject(0, fmt.Errorf("the metric %q has no data", name))
+	}
+}
+
+func dataPointsCount(metric *metricspb.Metric) int64 {
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		return int64(len(data.Gauge.GetDataPoints()))
+	case *metricspb.Metric_Sum:
+		return int64(len(data.Sum.GetDataPoints()))
+	case *metricspb.Metric_Histogram:
+		return int64(len(data.Histogram.GetDataPoints()))
+	case *metricspb.Metric_ExponentialHistogram:
+		return int64(len(data.ExponentialHistogram.GetDataPoints()))
+	case *metricspb.Metric_Summary:
+		return int64(len(data.Summary.GetDataPoints()))
+	}
+
+	return 0
+}
+
+// addDataPoints validates the data points and passes them to add with the key of their series and their labels
+func (b *otlpBatch) addDataPoints(name string, resourceLabels Labels, points []*metricspb.NumberDataPoint, add func(key string, point *metricspb.NumberDataPoint, labels Labels) error) {
+	for _, point := range points {
+		if point.GetFlags()&uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0 {
+			continue
+		}
+		if point.GetValue() == nil {
+			b.reject(1, fmt.Errorf("the data point of %q has no value", name))
+			continue
+		}
+		if value := numberValue(point); math.IsNaN(value) || math.IsInf(value, 0) {
+			b.reject(1, fmt.Errorf("the value of %q must be finite", name))
+			continue
+		}
+
+		labels := attributesToLabels(resourceLabels, point.GetAttributes())
+		if len(labels) == 0 {
+			labels = nil
+		}
+		if err := add(SeriesKey(name, labels), point, labels); err != nil {
+			b.reject(1, err)
+		}
+	}
+}
+
+func (b *otlpBatch) replace(key string, timeUnixNano uint64, metric interface{}) {
+	if at, ok := b.replacedAt[key]; ok && at > timeUnixNano {
+		return
+	}
+	b.replaced[key] = metric
+	b.replacedAt[key] = timeUnixNano
+}
+
+func (b *otlpBatch) reject(dataPoints int64, err error) {
+	b.rejected += dataPoints
+	message := err.Error()
+	for _, known := range b.errors {
+		if known == message {
+			return
+		}
+	}
+	if len(b.errors) < maxReportedOTLPErrors {
+		b.errors = append(b.errors, message)
+	}
+}
+
+// write applies the batch with one UpsertMany, so either all the metrics are written or none of them,
+// and the exporter retrying the failed request doesn't apply the deltas twice.
+// The replaced metrics are written first, then the deltas are atomically added to the stored values.
+func (b *otlpBatch) write(r *http.Request, repository IRepository) error {
+	metrics := make([]interface{}, 0, len(b.replaced)+len(b.gaugeIncrements)+len(b.increments))
+	for _, metric := range b.replaced {
+		metrics = append(metrics, metric)
+	}
+	for _, increment := range b.gaugeIncrements {
+		metrics = append(metrics, GaugeIncrement(increment))
+	}
+	for _, increment := range b.increments {
+		metrics = append(metrics, CounterIncrement(increment))
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	return repository.UpsertMany(r.Context(), metrics)
+}
+
+func numberValue(point *metricspb.NumberDataPoint) float64 {
+	if value, ok := point.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(value.AsInt)
+	}
+
+	return point.GetAsDouble()
+}
+
+// counterValue is the integer value of the data point, the doubles are rounded since the counters are integers
+func counterValue(point *metricspb.NumberDataPoint) (int64, error) {
+	if value, ok := point.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return value.AsInt, nil
+	}
+	if math.Abs(point.GetAsDouble()) >= math.MaxInt64 {
+		return 0, errors.New("overflows the counter")
+	}
+
+	return int64(math.Round(point.GetAsDouble())), nil
+}
+
+// attributesToLabels returns the copy of the labels with the attributes added, the arrays, the maps and the bytes are skipped
+func attributesToLabels(labels Labels, attributes []*commonpb.KeyValue) Labels {
+	result := make(Labels, len(labels)+len(attributes))
+	for key, value := range labels {
+		result[key] = value
+	}
+
+	for _, attribute := range attributes {
+		switch value := attribute.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			result[attribute.GetKey()] = value.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			result[attribute.GetKey()] = strconv.FormatBool(value.BoolValue)
+		case *commonpb.AnyValue_IntValue:
+			result[attribute.GetKey()] = strconv.FormatInt(value.IntValue, 10)
+		case *commonpb.AnyValue_DoubleValue:
+			result[attribute.GetKey()] = strconv.FormatFloat(value.DoubleValue, 'g', -1, 64)
+		}
+	}
+
+	return result
+}
+
+// writeOTLPResponse writes the message in the encoding of the request
+func writeOTLPResponse(w http.ResponseWriter, contentType string, statusCode int, message proto.Message) {
+	var body []byte
+	var err error
+	if contentType == contentTypeJSON {
+		body, err = protojson.Marshal(message)
+	} else {
+		body, err = proto.Marshal(message)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
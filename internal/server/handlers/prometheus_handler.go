@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/smamykin/smetrics/internal/utils"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusHandler renders all the metrics in the Prometheus text exposition format 0.0.4.
+type PrometheusHandler struct {
+	Repository IRepository
+}
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func (p *PrometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gaugeMetrics, err := p.Repository.GetAllGauge()
+	if err != nil {
+		http.Error(w, "the error occurred while requesting the gauge metrics", http.StatusInternalServerError)
+		return
+	}
+
+	counterMetrics, err := p.Repository.GetAllCounters()
+	if err != nil {
+		http.Error(w, "the error occurred while requesting the counter metrics", http.StatusInternalServerError)
+		return
+	}
+
+	var samples []prometheusSample
+	for _, metric := range gaugeMetrics {
+		samples = append(samples, prometheusSample{
+			name:       metric.Name,
+			metricType: MetricTypeGauge,
+			value:      formatPrometheusFloat(metric.Value),
+			labels:     metric.Labels,
+		})
+	}
+	for _, metric := range counterMetrics {
+		samples = append(samples, prometheusSample{
+			name:       metric.Name,
+			metricType: MetricTypeCounter,
+			value:      strconv.FormatInt(metric.Value, 10),
+			labels:     metric.Labels,
+		})
+	}
+
+	histogramMetrics, err := p.Repository.GetAllHistograms()
+	if err != nil {
+		http.Error(w, "the error occurred while requesting the histogram metrics", http.StatusInternalServerError)
+		return
+	}
+	for i := range histogramMetrics {
+		samples = append(samples, prometheusSample{
+			name:       histogramMetrics[i].Name,
+			metricType: MetricTypeHistogram,
+			labels:     histogramMetrics[i].Labels,
+			histogram:  &histogramMetrics[i].Value,
+		})
+	}
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(renderPrometheus(samples))
+}
+
+// prometheusSample is one line of the exposition, or the lines of the buckets, the sum and the count for the histogram
+type prometheusSample struct {
+	name       string
+	metricType string
+	value      string
+	labels     Labels
+	histogram  *utils.Histogram
+}
+
+func renderPrometheus(samples []prometheusSample) []byte {
+	names := make([]string, len(samples))
+	for i := range samples {
+		names[i] = SanitizePrometheusName(samples[i].name)
+	}
+	sort.Sort(prometheusSamplesByName{samples, names})
+
+	var buf bytes.Buffer
+	// the names of different metrics may become the same after sanitizing,
+	// the format doesn't allow a metric family to be described twice, so only the first one is kept.
+	// The metrics with the same name and type but different labels belong to the same family.
+	rendered := map[string]prometheusSample{}
+	for i, sample := range samples {
+		name := names[i]
+		if family, ok := rendered[name]; ok {
+			if family.name != sample.name || family.metricType != sample.metricType {
+				continue
+			}
+		} else {
+			rendered[name] = sample
+			buf.WriteString("# HELP " + name + " " + escapePrometheusHelp(sample.metricType+" metric "+sample.name) + "\n")
+			buf.WriteString("# TYPE " + name + " " + sample.metricType + "\n")
+		}
+
+		if sample.histogram != nil {
+			writePrometheusHistogram(&buf, name, sample.labels, *sample.histogram)
+			continue
+		}
+		buf.WriteString(name + formatPrometheusLabels(sample.labels) + " " + sample.value + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// writePrometheusHistogram writes the cumulative buckets with the le label, the sum and the count of the histogram.
+func writePrometheusHistogram(buf *bytes.Buffer, name string, labels Labels, histogram utils.Histogram) {
+	bucketLabels := Labels{}
+	for key, value := range labels {
+		bucketLabels[key] = value
+	}
+
+	var cumulative int64
+	for i, count := range histogram.Counts {
+		cumulative += count
+		bucketLabels["le"] = "+Inf"
+		if i < len(histogram.Bounds) {
+			bucketLabels["le"] = formatPrometheusFloat(histogram.Bounds[i])
+		}
+		buf.WriteString(name + "_bucket" + formatPrometheusLabels(bucketLabels) + " " + strconv.FormatInt(cumulative, 10) + "\n")
+	}
+	buf.WriteString(name + "_sum" + formatPrometheusLabels(labels) + " " + formatPrometheusFloat(histogram.Sum) + "\n")
+	buf.WriteString(name + "_count" + formatPrometheusLabels(labels) + " " + strconv.FormatInt(histogram.Count, 10) + "\n")
+}
+
+type prometheusSamplesByName struct {
+	samples []prometheusSample
+	names   []string
+}
+
+func (s prometheusSamplesByName) Len() int {
+	return len(s.samples)
+}
+
+func (s prometheusSamplesByName) Less(i, j int) bool {
+	if s.names[i] != s.names[j] {
+		return s.names[i] < s.names[j]
+	}
+	if s.samples[i].metricType != s.samples[j].metricType {
+		return s.samples[i].metricType < s.samples[j].metricType
+	}
+	if s.samples[i].name != s.samples[j].name {
+		return s.samples[i].name < s.samples[j].name
+	}
+	return s.samples[i].labels.String() < s.samples[j].labels.String()
+}
+
+func (s prometheusSamplesByName) Swap(i, j int) {
+	s.samples[i], s.samples[j] = s.samples[j], s.samples[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+// SanitizePrometheusName replaces all the characters that are not allowed in the names of Prometheus metrics with "_".
+// The result matches [a-zA-Z_:][a-zA-Z0-9_:]*
+func SanitizePrometheusName(name string) string {
+	if name == "" {
+		return "_"
+	}
+
+	var b strings.Builder
+	for i, c := range name {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == ':'
+		isDigit := c >= '0' && c <= '9'
+		switch {
+		case isLetter:
+			b.WriteRune(c)
+		case isDigit && i == 0:
+			b.WriteRune('_')
+			b.WriteRune(c)
+		case isDigit:
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
+
+func formatPrometheusLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		// unlike the names of the metrics, the names of the labels must not contain ":"
+		b.WriteString(strings.ReplaceAll(SanitizePrometheusName(key), ":", "_"))
+		b.WriteString(`="`)
+		b.WriteString(escapePrometheusLabelValue(labels[key]))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+func escapePrometheusLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func escapePrometheusHelp(help string) string {
+	help = strings.ReplaceAll(help, `\`, `\\`)
+	return strings.ReplaceAll(help, "\n", `\n`)
+}
+
+func formatPrometheusFloat(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
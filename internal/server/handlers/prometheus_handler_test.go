@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestSanitizePrometheusName(t *testing.T) {
+	tests := map[string]string{
+		"HeapAlloc":       "HeapAlloc",
+		"metric_name:sub": "metric_name:sub",
+		"metric.name-1":   "metric_name_1",
+		"1metric":         "_1metric",
+		"метрика":         "_______",
+		"":                "_",
+	}
+
+	for name, expected := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, expected, SanitizePrometheusName(name))
+		})
+	}
+}
+
+func TestRenderPrometheus(t *testing.T) {
+	samples := []prometheusSample{
+		{name: "b.metric", metricType: MetricTypeGauge, value: formatPrometheusFloat(math.Inf(1))},
+		{name: "b_metric", metricType: MetricTypeCounter, value: "1"},
+		{name: "a", metricType: MetricTypeGauge, value: formatPrometheusFloat(1.5)},
+		{name: "c", metricType: MetricTypeGauge, value: formatPrometheusFloat(math.NaN())},
+	}
+
+	expected := `# HELP a gauge metric a
+# TYPE a gauge
+a 1.5
+# HELP b_metric counter metric b_metric
+# TYPE b_metric counter
+b_metric 1
+# HELP c gauge metric c
+# TYPE c gauge
+c NaN
+`
+	require.Equal(t, expected, string(renderPrometheus(samples)))
+}
+
+func TestRenderPrometheus_Histogram(t *testing.T) {
+	histogram, err := utils.NewHistogram([]float64{0.1, 1})
+	require.Nil(t, err)
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	samples := []prometheusSample{
+		{name: "latency", metricType: MetricTypeHistogram, labels: Labels{"host": "a"}, histogram: &histogram},
+	}
+
+	expected := `# HELP latency histogram metric latency
+# TYPE latency histogram
+latency_bucket{host="a",le="0.1"} 1
+latency_bucket{host="a",le="1"} 2
+latency_bucket{host="a",le="+Inf"} 3
+latency_sum{host="a"} 5.55
+latency_count{host="a"} 3
+`
+	require.Equal(t, expected, string(renderPrometheus(samples)))
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smamykin/smetrics/internal/utils"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultQueryRange = time.Hour
+
+type QueryRangeHandler struct {
+	Repository IRepositoryWithHistory
+}
+
+func NewQueryRangeHandler(repository IRepositoryWithHistory) *QueryRangeHandler {
+	return &QueryRangeHandler{Repository: repository}
+}
+
+type QueryRangeResponse struct {
+	ID      string   `json:"id"`
+	MType   string   `json:"type"`
+	Labels  Labels   `json:"labels,omitempty"`
+	Samples []Sample `json:"samples"`
+}
+
+func (q *QueryRangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	labels, err := getLabelsFromParameter(query.Get("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metricType := query.Get("type")
+	if metricType != MetricTypeGauge && metricType != MetricTypeCounter {
+		http.Error(w, "unknown metric type", http.StatusNotImplemented)
+		return
+	}
+
+	to := time.Now()
+	if query.Get("to") != "" {
+		to, err = parseQueryTime(query.Get("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	from := to.Add(-defaultQueryRange)
+	if query.Get("from") != "" {
+		from, err = parseQueryTime(query.Get("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	var step time.Duration
+	if query.Get("step") != "" {
+		step, err = parseQueryDuration(query.Get("step"))
+		if err != nil || step <= 0 {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+
+	samples, err := q.Repository.GetRange(r.Context(), metricType, name, labels, from, to)
+	if err != nil {
+		if errors.Is(err, ErrHistoryDisabled) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if step > 0 {
+		samples = downsample(samples, from, step)
+	}
+	if samples == nil {
+		samples = []Sample{}
+	}
+
+	body, err := json.Marshal(QueryRangeResponse{ID: name, MType: metricType, Labels: labels, Samples: samples})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// downsample keeps only the last sample within every step starting from the beginning of the range.
+func downsample(samples []Sample, from time.Time, step time.Duration) []Sample {
+	var result []Sample
+	lastBucket := int64(-1)
+	for _, sample := range samples {
+		bucket := int64(sample.Timestamp.Sub(from) / step)
+		if bucket == lastBucket {
+			result[len(result)-1] = sample
+			continue
+		}
+		result = append(result, sample)
+		lastBucket = bucket
+	}
+
+	return result
+}
+
+// parseQueryTime accepts either RFC3339 or the unix timestamp in seconds.
+func parseQueryTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// parseQueryDuration accepts either the duration in the format of time.ParseDuration or the number of seconds.
+func parseQueryDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// getLabelsFromParameter parses the labels passed as the single parameter in the format key1=value1,key2=value2
+func getLabelsFromParameter(value string) (Labels, error) {
+	labels, err := utils.ParseLabels(value)
+	if err != nil || len(labels) == 0 {
+		return nil, err
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/smamykin/smetrics/internal/pb/prompb"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxRemoteWriteSize limits the decompressed body, Prometheus sends much smaller ones by default
+const maxRemoteWriteSize = 32 << 20
+
+// staleNaNBits is the value Prometheus marks the series with once they disappear
+const staleNaNBits = 0x7ff0000000000002
+
+// maxRemoteWriteTypes limits the remembered types of the metric families. Prometheus resends the metadata
+// of all the families periodically, so the types forgotten on overflow are learnt again
+const maxRemoteWriteTypes = 100000
+
+// familySuffixes are the suffixes of the series of the counters, the histograms and the summaries
+var familySuffixes = []string{"_total", "_bucket", "_count", "_sum"}
+
+// counterSuffixes are the suffixes of the series which are the counters, _sum isn't one since it's fractional
+// and may decrease, e.g. the sum of the negative observations
+var counterSuffixes = []string{"_total", "_bucket", "_count"}
+
+// RemoteWriteHandler accepts the remote write of Prometheus. The latest sample of every series becomes
+// the counter or the gauge named after __name__, the other labels become the labels. The counters are replaced,
+// since Prometheus sends the totals. The type of the series is taken from the metadata Prometheus sends periodically,
+// until it is received the series with the suffixes of the counters, e.g. _total, are the counters.
+// The _sum series of the histograms and the summaries are the gauges, so they aren't rounded to the integers.
+type RemoteWriteHandler struct {
+	Repository IRepository
+
+	mu sync.RWMutex
+	// types are the types of the metric families received in the metadata
+	types map[string]prompb.MetricMetadata_MetricType
+}
+
+func NewRemoteWriteHandler(repository IRepository) *RemoteWriteHandler {
+	return &RemoteWriteHandler{
+		Repository: repository,
+		types:      map[string]prompb.MetricMetadata_MetricType{},
+	}
+}
+
+func (h *RemoteWriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(snappy.MaxEncodedLen(maxRemoteWriteSize)))
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if size, err := snappy.DecodedLen(compressed); err != nil || size > maxRemoteWriteSize {
+		http.Error(w, "the body must be the snappy compressed request of at most 32MB", http.StatusBadRequest)
+		return
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request prompb.WriteRequest
+	if err = proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.learnTypes(request.GetMetadata())
+
+	metrics := make(map[string]interface{})
+	timestamps := make(map[string]int64)
+	var rejected []string
+	for _, series := range request.GetTimeseries() {
+		name, labels := splitRemoteWriteLabels(series.GetLabels())
+		if name == "" {
+			rejected = append(rejected, "the series has no __name__")
+			continue
+		}
+		sample := latestSample(series.GetSamples())
+		if sample == nil {
+			continue
+		}
+		// the stale markers are skipped by latestSample, the other NaNs are as invalid as the infinities
+		if math.IsNaN(sample.GetValue()) || math.IsInf(sample.GetValue(), 0) {
+			rejected = append(rejected, fmt.Sprintf("the value of %s is not finite", SeriesKey(name, labels)))
+			continue
+		}
+
+		metricType := h.metricType(name)
+		key := metricType + ":" + SeriesKey(name, labels)
+		if timestamp, ok := timestamps[key]; ok && timestamp > sample.GetTimestamp() {
+			continue
+		}
+		if metricType == MetricTypeCounter {
+			if math.Abs(sample.GetValue()) >= math.MaxInt64 {
+				rejected = append(rejected, fmt.Sprintf("the value of %s overflows the counter", SeriesKey(name, labels)))
+				continue
+			}
+			metrics[key] = CounterMetric{Name: name, Value: int64(math.Round(sample.GetValue())), Labels: labels}
+		} else {
+			metrics[key] = GaugeMetric{Name: name, Value: sample.GetValue(), Labels: labels}
+		}
+		timestamps[key] = sample.GetTimestamp()
+	}
+
+	if len(metrics) > 0 {
+		metricsToUpsert := make([]interface{}, 0, len(metrics))
+		for _, metric := range metrics {
+			metricsToUpsert = append(metricsToUpsert, metric)
+		}
+		// Prometheus retries on 5xx
+		if err = h.Repository.UpsertMany(r.Context(), metricsToUpsert); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Prometheus drops the request on 4xx, the valid series are already written
+	if len(rejected) > 0 {
+		if len(rejected) > maxReportedLineErrors {
+			rejected = rejected[:maxReportedLineErrors]
+		}
+		http.Error(w, fmt.Sprintf("partial write: %s", strings.Join(rejected, "; ")), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *RemoteWriteHandler) learnTypes(metadata []*prompb.MetricMetadata) {
+	if len(metadata) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range metadata {
+		switch m.GetType() {
+		case prompb.MetricMetadata_COUNTER, prompb.MetricMetadata_GAUGE, prompb.MetricMetadata_HISTOGRAM,
+			prompb.MetricMetadata_GAUGEHISTOGRAM, prompb.MetricMetadata_SUMMARY:
+		default:
+			// the series of the other types are typed by their suffixes
+			delete(h.types, m.GetMetricFamilyName())
+			continue
+		}
+
+		if _, ok := h.types[m.GetMetricFamilyName()]; !ok && len(h.types) >= maxRemoteWriteTypes {
+			h.types = map[string]prompb.MetricMetadata_MetricType{}
+		}
+		h.types[m.GetMetricFamilyName()] = m.GetType()
+	}
+}
+
+// metricType returns the type of the series by the type of its family, e.g. http_requests for http_requests_total,
+// the _bucket and _count series of the histograms and the summaries are the counters, their _sum and quantiles are the gauges
+func (h *RemoteWriteHandler) metricType(name string) string {
+	h.mu.RLock()
+	familyType, ok := h.types[name]
+	suffix := ""
+	if !ok {
+		for _, s := range familySuffixes {
+			if strings.HasSuffix(name, s) {
+				familyType, ok = h.types[strings.TrimSuffix(name, s)]
+				suffix = s
+				break
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	switch {
+	case !ok:
+		for _, s := range counterSuffixes {
+			if strings.HasSuffix(name, s) {
+				return MetricTypeCounter
+			}
+		}
+		return MetricTypeGauge
+	case familyType == prompb.MetricMetadata_COUNTER:
+		return MetricTypeCounter
+	case (familyType == prompb.MetricMetadata_HISTOGRAM || familyType == prompb.MetricMetadata_SUMMARY) && suffix != "" && suffix != "_sum":
+		return MetricTypeCounter
+	default:
+		return MetricTypeGauge
+	}
+}
+
+// splitRemoteWriteLabels returns the value of __name__ and the other labels
+func splitRemoteWriteLabels(labels []*prompb.Label) (string, Labels) {
+	var name string
+	var result Labels
+	for _, label := range labels {
+		if label.GetName() == "__name__" {
+			name = label.GetValue()
+			continue
+		}
+		if result == nil {
+			result = Labels{}
+		}
+		result[label.GetName()] = label.GetValue()
+	}
+
+	return name, result
+}
+
+// latestSample returns the sample with the latest timestamp, it is nil when there are no samples or the series is stale
+func latestSample(samples []*prompb.Sample) *prompb.Sample {
+	var latest *prompb.Sample
+	for _, sample := range samples {
+		if latest == nil || sample.GetTimestamp() >= latest.GetTimestamp() {
+			latest = sample
+		}
+	}
+	if latest == nil || math.Float64bits(latest.GetValue()) == staleNaNBits {
+		return nil
+	}
+
+	return latest
+}
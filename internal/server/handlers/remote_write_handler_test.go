@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/smamykin/smetrics/internal/pb/prompb"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRemoteWriteHandler_LearnTypes(t *testing.T) {
+	h := NewRemoteWriteHandler(nil)
+	h.learnTypes([]*prompb.MetricMetadata{
+		{MetricFamilyName: "http_requests", Type: prompb.MetricMetadata_GAUGE},
+		{MetricFamilyName: "build", Type: prompb.MetricMetadata_INFO},
+		{MetricFamilyName: "errors_total", Type: prompb.MetricMetadata_UNKNOWN},
+	})
+	// only the known types are remembered, the others are typed by the suffixes
+	require.Len(t, h.types, 1)
+	require.Equal(t, MetricTypeGauge, h.metricType("http_requests_total"))
+	require.Equal(t, MetricTypeCounter, h.metricType("errors_total"))
+
+	// the remembered types are forgotten on overflow
+	metadata := make([]*prompb.MetricMetadata, 0, maxRemoteWriteTypes)
+	for i := 0; i < maxRemoteWriteTypes; i++ {
+		metadata = append(metadata, &prompb.MetricMetadata{MetricFamilyName: fmt.Sprintf("family_%d", i), Type: prompb.MetricMetadata_COUNTER})
+	}
+	h.learnTypes(metadata)
+	require.LessOrEqual(t, len(h.types), maxRemoteWriteTypes)
+	require.Equal(t, MetricTypeCounter, h.metricType(fmt.Sprintf("family_%d", maxRemoteWriteTypes-1)))
+	require.Equal(t, MetricTypeCounter, h.metricType("http_requests_total"))
+}
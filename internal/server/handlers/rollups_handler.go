@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultRollupPoints is the number of the points returned when the beginning of the range is not specified.
+const defaultRollupPoints = 60
+
+type RollupsHandler struct {
+	Repository IRepositoryWithRollups
+}
+
+func NewRollupsHandler(repository IRepositoryWithRollups) *RollupsHandler {
+	return &RollupsHandler{Repository: repository}
+}
+
+type RollupsResponse struct {
+	ID         string        `json:"id"`
+	MType      string        `json:"type"`
+	Labels     Labels        `json:"labels,omitempty"`
+	Resolution string        `json:"resolution"`
+	Points     []RollupPoint `json:"points"`
+}
+
+func (h *RollupsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	labels, err := getLabelsFromParameter(query.Get("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metricType := query.Get("type")
+	if metricType != MetricTypeGauge && metricType != MetricTypeCounter {
+		http.Error(w, "unknown metric type", http.StatusNotImplemented)
+		return
+	}
+
+	resolution, err := parseQueryDuration(query.Get("resolution"))
+	if err != nil || resolution <= 0 {
+		http.Error(w, "invalid resolution", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if query.Get("to") != "" {
+		to, err = parseQueryTime(query.Get("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	from := to.Add(-defaultRollupPoints * resolution)
+	if query.Get("from") != "" {
+		from, err = parseQueryTime(query.Get("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.Repository.GetRollups(r.Context(), metricType, name, labels, resolution, from, to)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRollupsDisabled):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		case errors.Is(err, ErrUnknownResolution):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if points == nil {
+		points = []RollupPoint{}
+	}
+
+	body, err := json.Marshal(RollupsResponse{ID: name, MType: metricType, Labels: labels, Resolution: resolution.String(), Points: points})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
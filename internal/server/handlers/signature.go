@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+)
+
+type verifiedBodyKey struct{}
+
+// WithVerifiedBody marks the request whose whole body is verified by the signature,
+// so the hashes of the separate metrics are not checked.
+func WithVerifiedBody(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), verifiedBodyKey{}, true))
+}
+
+func isBodyVerified(r *http.Request) bool {
+	verified, _ := r.Context().Value(verifiedBodyKey{}).(bool)
+	return verified
+}
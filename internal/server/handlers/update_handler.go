@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"errors"
+	"github.com/smamykin/smetrics/internal/utils"
 	"net/http"
 )
 
@@ -36,6 +37,9 @@ func (u *UpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	u.handleHeaders(w, r)
 	metric, err := u.getMetricFromRequest(r)
+	if err == nil {
+		err = validateHistogramUpdate(metric)
+	}
 
 	if err != nil {
 		if err.Error() == "unknown metric type" {
@@ -50,11 +54,16 @@ func (u *UpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err = u.upsert(metric)
 
 	if err != nil {
+		if errors.Is(err, utils.ErrHistogramBoundsMismatch) || errors.Is(err, utils.ErrNonFiniteValue) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = u.handleBody(w, metric, r.Header.Get("Accept"))
+	err = u.handleBody(w, r, metric)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -63,13 +72,23 @@ func (u *UpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (u *UpdateHandler) upsert(metric Metrics) (err error) {
 	if MetricTypeGauge == metric.MType {
-		return u.Repository.UpsertGauge(GaugeMetric{Name: metric.ID, Value: *metric.Value})
+		return u.Repository.UpsertGauge(GaugeMetric{Name: metric.ID, Value: *metric.Value, Labels: metric.Labels})
 	}
 
 	if MetricTypeCounter == metric.MType {
-		prevValue, _ := u.Repository.GetCounter(metric.ID)
+		_, err = u.Repository.IncrementCounter(CounterMetric{Name: metric.ID, Value: *metric.Delta, Labels: metric.Labels})
+
+		return err
+	}
+
+	if MetricTypeHistogram == metric.MType {
+		histogram, err := histogramToMerge(u.Repository, metric)
+		if err != nil {
+			return err
+		}
+		_, err = u.Repository.MergeHistogram(HistogramMetric{Name: metric.ID, Value: histogram, Labels: metric.Labels})
 
-		return u.Repository.UpsertCounter(CounterMetric{Name: metric.ID, Value: prevValue + *metric.Delta})
+		return err
 	}
 
 	return errors.New("trying to upsert metric with unknown type, there is an error in logic of checking request")
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"github.com/smamykin/smetrics/internal/utils"
 	"io"
 	"net/http"
 )
@@ -39,9 +40,14 @@ func (u *UpdatesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.upsert(r.Context(), metrics)
+	err = UpsertMetrics(r.Context(), u.Repository, metrics)
 
 	if err != nil {
+		if errors.Is(err, utils.ErrHistogramBoundsMismatch) || errors.Is(err, utils.ErrNonFiniteValue) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -53,23 +59,30 @@ func (u *UpdatesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (u *UpdatesHandler) upsert(ctx context.Context, metrics []Metrics) (err error) {
+// UpsertMetrics applies the batch of the validated metrics: the gauges are replaced, the deltas of the counters
+// are added to the stored ones, and the histograms are merged into the stored ones.
+func UpsertMetrics(ctx context.Context, repository IRepository, metrics []Metrics) (err error) {
 	countersToUpsert := make(map[string]CounterMetric)
 	gaugeToUpsert := make(map[string]GaugeMetric)
+	histogramsToMerge := make(map[string]HistogramMetric)
 	for _, metric := range metrics {
+		key := SeriesKey(metric.ID, metric.Labels)
 		if MetricTypeGauge == metric.MType {
-			gaugeToUpsert[metric.ID] = GaugeMetric{Name: metric.ID, Value: *metric.Value}
+			gaugeToUpsert[key] = GaugeMetric{Name: metric.ID, Value: *metric.Value, Labels: metric.Labels}
 		}
 		if MetricTypeCounter == metric.MType {
-			var prevValue int64
-
-			if prevMetric, ok := countersToUpsert[metric.ID]; ok {
-				prevValue = prevMetric.Value
-			} else {
-				prevValue, _ = u.Repository.GetCounter(metric.ID)
+			countersToUpsert[key] = CounterMetric{Name: metric.ID, Value: countersToUpsert[key].Value + *metric.Delta, Labels: metric.Labels}
+		}
+		if MetricTypeHistogram == metric.MType {
+			histogram, err := histogramToMerge(repository, metric)
+			if err != nil {
+				return err
 			}
-
-			countersToUpsert[metric.ID] = CounterMetric{Name: metric.ID, Value: prevValue + *metric.Delta}
+			merged := histogramsToMerge[key].Value.Clone()
+			if err = merged.Merge(histogram); err != nil {
+				return err
+			}
+			histogramsToMerge[key] = HistogramMetric{Name: metric.ID, Value: merged, Labels: metric.Labels}
 		}
 	}
 
@@ -80,8 +93,11 @@ func (u *UpdatesHandler) upsert(ctx context.Context, metrics []Metrics) (err err
 	for _, metric := range countersToUpsert {
 		metricsToUpsert = append(metricsToUpsert, metric)
 	}
+	for _, metric := range histogramsToMerge {
+		metricsToUpsert = append(metricsToUpsert, metric)
+	}
 
-	return u.Repository.UpsertMany(ctx, metricsToUpsert)
+	return repository.IncrementMany(ctx, metricsToUpsert)
 }
 
 func (u *UpdatesHandler) getMetricFromRequest(r *http.Request) (metrics []Metrics, err error) {
@@ -95,11 +111,15 @@ func (u *UpdatesHandler) getMetricFromRequest(r *http.Request) (metrics []Metric
 	}
 
 	for _, metric := range metrics {
-		_, err = u.validateMetric(&metric)
+		_, err = u.validateMetric(r, &metric)
 
 		if err != nil {
 			return metrics, err
 		}
+
+		if err = validateHistogramUpdate(metric); err != nil {
+			return metrics, err
+		}
 	}
 
 	return metrics, nil
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"github.com/smamykin/smetrics/internal/utils"
+	"io"
+	"net/http"
+)
+
+// decryptHandle decrypts the body of the request encrypted by utils.Encrypt.
+// The requests with the unencrypted body are rejected, the metrics must not travel in plaintext.
+func decryptHandle(privateKey *rsa.PrivateKey, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := r.Header.Get(utils.EncryptionHeader)
+		if scheme == "" {
+			if r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "the body of the request must be encrypted", http.StatusBadRequest)
+			return
+		}
+		if scheme != utils.EncryptionScheme {
+			http.Error(w, "unsupported encryption: "+scheme, http.StatusBadRequest)
+			return
+		}
+
+		encrypted, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := utils.Decrypt(privateKey, encrypted)
+		if err != nil {
+			http.Error(w, "cannot decrypt the body of the request", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del(utils.EncryptionHeader)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,11 +2,30 @@ package server
 
 import (
 	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 )
 
+// acceptedEncodings are advertised in the Accept-Encoding header of the responses,
+// so the agents know they may compress the requests with zstd
+const acceptedEncodings = "gzip, zstd"
+
+// maxDecodedSize limits the memory the zstd decoder may allocate for the window of the compressed body
+const maxDecodedSize = 64 << 20
+
+var zstdDecoders = sync.Pool{
+	New: func() interface{} {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedSize))
+		if err != nil {
+			return nil
+		}
+		return decoder
+	},
+}
+
 type gzipWriter struct {
 	http.ResponseWriter
 	Writer io.Writer
@@ -18,7 +37,10 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 
 func gzipHandle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Content-Encoding") == "gzip" {
+		w.Header().Set("Accept-Encoding", acceptedEncodings)
+
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
 			// создаём *gzip.Reader, который будет читать тело запроса
 			// и распаковывать его
 			gz, err := gzip.NewReader(r.Body)
@@ -30,6 +52,24 @@ func gzipHandle(next http.Handler) http.Handler {
 			defer gz.Close()
 
 			r.Body = gz
+		case "zstd":
+			decoder, ok := zstdDecoders.Get().(*zstd.Decoder)
+			if !ok {
+				http.Error(w, "cannot create the zstd decoder", http.StatusInternalServerError)
+				return
+			}
+			if err := decoder.Reset(r.Body); err != nil {
+				zstdDecoders.Put(decoder)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// the decoder is returned to the pool only after the handler has read the body
+			defer func() {
+				decoder.Reset(nil)
+				zstdDecoders.Put(decoder)
+			}()
+
+			r.Body = io.NopCloser(decoder)
 		}
 
 		// проверяем, что клиент поддерживает gzip-сжатие
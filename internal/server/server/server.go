@@ -1,12 +1,55 @@
 package server
 
 import (
+	"crypto/rsa"
 	"github.com/go-chi/chi/v5"
 	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
 	"net/http"
 )
 
-func AddHandlers(r *chi.Mux, repository handlers.IRepository, hashGenerator handlers.IHashGenerator) http.Handler {
+// Option configures the middlewares of the server
+type Option func(*options)
+
+type options struct {
+	privateKey      *rsa.PrivateKey
+	trustedSubnets  utils.TrustedSubnets
+	checkRemoteAddr bool
+	// otlpNamePrefixAttributes are the resource attributes of OTLP, which prefix the names instead of being the labels
+	otlpNamePrefixAttributes []string
+}
+
+// WithPrivateKey makes the server decrypt the bodies of the requests encrypted with the matching public key
+// and reject the unencrypted ones.
+func WithPrivateKey(privateKey *rsa.PrivateKey) Option {
+	return func(o *options) {
+		o.privateKey = privateKey
+	}
+}
+
+// WithTrustedSubnets makes the server accept the metrics only from the agents whose X-Real-IP belongs to the subnets.
+// If checkRemoteAddr is set, the remote address of the connection must belong to them as well,
+// which only works when there is no proxy in front of the server.
+func WithTrustedSubnets(subnets utils.TrustedSubnets, checkRemoteAddr bool) Option {
+	return func(o *options) {
+		o.trustedSubnets = subnets
+		o.checkRemoteAddr = checkRemoteAddr
+	}
+}
+
+// WithOTLPNamePrefixAttributes makes the values of the resource attributes of OTLP, e.g. service.name,
+// prefix the names of the metrics instead of becoming the labels.
+func WithOTLPNamePrefixAttributes(attributes []string) Option {
+	return func(o *options) {
+		o.otlpNamePrefixAttributes = attributes
+	}
+}
+
+func AddHandlers(r *chi.Mux, repository handlers.IRepository, hashGenerator handlers.IHashGenerator, opts ...Option) http.Handler {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	r.Method("POST", "/update/{metricType}/{metricName}/{metricValue}", handlers.NewUpdateHandlerDefault(
 		repository,
@@ -19,6 +62,9 @@ func AddHandlers(r *chi.Mux, repository handlers.IRepository, hashGenerator hand
 	r.Method("GET", "/", &handlers.ListHandler{
 		Repository: repository,
 	})
+	r.Method("GET", "/metrics", &handlers.PrometheusHandler{
+		Repository: repository,
+	})
 
 	//region JSON-API
 	r.Method("POST", "/update/", handlers.NewUpdateHandlerWithHashGenerator(repository, ParameterBag{}, hashGenerator, hashGenerator == nil))
@@ -30,7 +76,44 @@ func AddHandlers(r *chi.Mux, repository handlers.IRepository, hashGenerator hand
 		r.Method("GET", "/ping", handlers.NewHealthcheckHandler(repositoryWithHealthCheck))
 	}
 
-	return gzipHandle(r)
+	if repositoryWithHistory, ok := repository.(handlers.IRepositoryWithHistory); ok {
+		r.Method("GET", "/api/v1/query_range", handlers.NewQueryRangeHandler(repositoryWithHistory))
+	}
+
+	if repositoryWithRollups, ok := repository.(handlers.IRepositoryWithRollups); ok {
+		r.Method("GET", "/api/v1/rollups", handlers.NewRollupsHandler(repositoryWithRollups))
+	}
+
+	var handler http.Handler = r
+	if hashGenerator != nil {
+		handler = signatureHandle(hashGenerator, handler)
+	}
+	handler = gzipHandle(handler)
+	if o.privateKey != nil {
+		handler = decryptHandle(o.privateKey, handler)
+	}
+	if len(o.trustedSubnets) != 0 {
+		handler = trustedSubnetHandle(o.trustedSubnets, o.checkRemoteAddr, handler)
+	}
+
+	// the writers of the other formats, e.g. Telegraf or Prometheus, can't encrypt or sign the metrics
+	// and don't report X-Real-IP, so their routes skip these middlewares and check the address of the connection instead
+	writers := chi.NewRouter()
+	writers.Method("POST", "/api/v2/write", handlers.NewInfluxWriteHandler(repository))
+	writers.Method("POST", "/v1/metrics", handlers.NewOTLPHandler(repository, o.otlpNamePrefixAttributes))
+	writers.Method("POST", "/api/v1/write", handlers.NewRemoteWriteHandler(repository))
+	var writersHandler http.Handler = gzipHandle(writers)
+	if len(o.trustedSubnets) != 0 {
+		writersHandler = remoteAddrSubnetHandle(o.trustedSubnets, writersHandler)
+	}
+
+	root := chi.NewRouter()
+	for _, route := range writers.Routes() {
+		root.Handle(route.Pattern, writersHandler)
+	}
+	root.Handle("/*", handler)
+
+	return root
 }
 
 type ParameterBag struct{}
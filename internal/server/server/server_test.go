@@ -3,17 +3,36 @@ package server
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/smamykin/smetrics/internal/pb/prompb"
 	"github.com/smamykin/smetrics/internal/server/handlers"
 	"github.com/smamykin/smetrics/internal/server/storage"
 	"github.com/smamykin/smetrics/internal/utils"
 	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type requestDefinition struct {
@@ -22,6 +41,7 @@ type requestDefinition struct {
 	body            string
 	contentType     string
 	contentEncoding string
+	headers         map[string]string
 }
 
 func testRequest(t *testing.T, ts *httptest.Server, request requestDefinition) (status int, responseContentType string, responseBody string) {
@@ -29,6 +49,9 @@ func testRequest(t *testing.T, ts *httptest.Server, request requestDefinition) (
 	req.Header.Set("Accept", request.contentType)
 	req.Header.Set("Content-Type", request.contentType)
 	req.Header.Set("Content-Encoding", request.contentEncoding)
+	for key, value := range request.headers {
+		req.Header.Set(key, value)
+	}
 
 	require.NoError(t, err)
 
@@ -53,6 +76,14 @@ const expectedListBody = `
     </ol>
 </html>`
 
+const expectedPrometheusBody = `# HELP metric_name1 counter metric metric_name1
+# TYPE metric_name1 counter
+metric_name1 43
+# HELP metric_name2 gauge metric metric.name2
+# TYPE metric_name2 gauge
+metric_name2 50.111
+`
+
 func TestRouter(t *testing.T) {
 
 	type expected struct {
@@ -66,7 +97,7 @@ func TestRouter(t *testing.T) {
 		name     string
 		requests []requestDefinition
 		expected
-		hashGenerator *utils.HashGenerator
+		hashGenerator *utils.Keyring
 	}
 
 	//region testcase
@@ -207,6 +238,20 @@ func TestRouter(t *testing.T) {
 				gaugeStore:   map[string]handlers.GaugeMetric{"metric_name2": {Value: 50.111, Name: "metric_name2"}},
 			},
 		},
+		"prometheus": {
+			requests: []requestDefinition{
+				{method: http.MethodPost, url: "/update/counter/metric_name1/43"},
+				{method: http.MethodPost, url: "/update/gauge/metric.name2/50.111"},
+				{method: http.MethodGet, url: "/metrics"},
+			},
+			expected: expected{
+				contentType:  "text/plain; version=0.0.4; charset=utf-8",
+				statusCode:   http.StatusOK,
+				body:         expectedPrometheusBody,
+				counterStore: map[string]handlers.CounterMetric{"metric_name1": {Value: 43, Name: "metric_name1"}},
+				gaugeStore:   map[string]handlers.GaugeMetric{"metric.name2": {Value: 50.111, Name: "metric.name2"}},
+			},
+		},
 		"JSON-API update gauge": {
 			requests: []requestDefinition{
 				{method: http.MethodPost, url: "/update/", body: `{"id":"metric_name3", "type":"gauge", "value":11.12}`, contentType: "application/json"},
@@ -259,6 +304,36 @@ func TestRouter(t *testing.T) {
 				gaugeStore:   map[string]handlers.GaugeMetric{},
 			},
 		},
+		"JSON-API get counter with labels": {
+			requests: []requestDefinition{
+				{method: http.MethodPost, url: "/update/", body: `{"id":"metric_name3", "type":"counter", "delta":11}`, contentType: "application/json"},
+				{method: http.MethodPost, url: "/update/", body: `{"id":"metric_name3", "type":"counter", "delta":7, "labels":{"host":"a"}}`, contentType: "application/json"},
+				{method: http.MethodPost, url: "/value/", body: `{"id":"metric_name3", "type":"counter", "labels":{"host":"a"}}`, contentType: "application/json"},
+			},
+			expected: expected{
+				contentType: "application/json",
+				statusCode:  http.StatusOK,
+				body:        `{"id":"metric_name3","type":"counter","delta":7,"labels":{"host":"a"}}`,
+				counterStore: map[string]handlers.CounterMetric{
+					"metric_name3":           {Value: 11, Name: "metric_name3"},
+					`metric_name3{host="a"}`: {Value: 7, Name: "metric_name3", Labels: handlers.Labels{"host": "a"}},
+				},
+				gaugeStore: map[string]handlers.GaugeMetric{},
+			},
+		},
+		"get gauge with labels": {
+			requests: []requestDefinition{
+				{method: http.MethodPost, url: "/update/gauge/metric_name/1.5?host=a"},
+				{method: http.MethodGet, url: "/value/gauge/metric_name?host=a"},
+			},
+			expected: expected{
+				contentType:  "text/plain",
+				statusCode:   http.StatusOK,
+				body:         "1.500",
+				counterStore: map[string]handlers.CounterMetric{},
+				gaugeStore:   map[string]handlers.GaugeMetric{`metric_name{host="a"}`: {Value: 1.5, Name: "metric_name", Labels: handlers.Labels{"host": "a"}}},
+			},
+		},
 	}
 
 	tests["gzip"] = testCase{
@@ -275,7 +350,21 @@ func TestRouter(t *testing.T) {
 		},
 	}
 
-	h := utils.NewHashGenerator("secret key")
+	tests["prometheus with gzip"] = testCase{
+		requests: []requestDefinition{
+			{method: http.MethodPost, url: "/update/", body: compress(t, `{"id":"metric_name3", "type":"counter", "delta":11}`), contentType: "application/json", contentEncoding: "gzip"},
+			{method: http.MethodGet, url: "/metrics"},
+		},
+		expected: expected{
+			contentType:  "text/plain; version=0.0.4; charset=utf-8",
+			statusCode:   http.StatusOK,
+			body:         "# HELP metric_name3 counter metric metric_name3\n# TYPE metric_name3 counter\nmetric_name3 11\n",
+			counterStore: map[string]handlers.CounterMetric{"metric_name3": {Value: 11, Name: "metric_name3"}},
+			gaugeStore:   map[string]handlers.GaugeMetric{},
+		},
+	}
+
+	h := utils.NewKeyring("", "secret key")
 	sign, err := h.Generate(fmt.Sprintf("metric_name3:counter:%d", 11))
 	require.Nil(t, err)
 	body := fmt.Sprintf(`{"id":"metric_name3","type":"counter","delta":11,"hash":"%s"}`, sign)
@@ -419,3 +508,827 @@ func compress(t *testing.T, s string) string {
 	gzipBodyUpdate := b.String()
 	return gzipBodyUpdate
 }
+
+func TestQueryRange(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	repository.EnableHistory(10)
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	from := time.Now().Add(-time.Minute).Unix()
+	testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/counter/metric_name/43"})
+	testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/counter/metric_name/7"})
+
+	statusCode, contentType, body := testRequest(t, ts, requestDefinition{
+		method: http.MethodGet,
+		url:    fmt.Sprintf("/api/v1/query_range?name=metric_name&type=counter&from=%d", from),
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "application/json", contentType)
+
+	var response handlers.QueryRangeResponse
+	require.Nil(t, json.Unmarshal([]byte(body), &response))
+	require.Equal(t, "metric_name", response.ID)
+	require.Equal(t, "counter", response.MType)
+	require.Len(t, response.Samples, 2)
+	require.Equal(t, int64(43), *response.Samples[0].Delta)
+	require.Equal(t, int64(50), *response.Samples[1].Delta)
+
+	statusCode, _, body = testRequest(t, ts, requestDefinition{
+		method: http.MethodGet,
+		url:    fmt.Sprintf("/api/v1/query_range?name=metric_name&type=counter&from=%d&step=1h", from),
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Nil(t, json.Unmarshal([]byte(body), &response))
+	require.Len(t, response.Samples, 1)
+	require.Equal(t, int64(50), *response.Samples[0].Delta)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method: http.MethodGet,
+		url:    "/api/v1/query_range?name=metric_name&type=unknown",
+	})
+	require.Equal(t, http.StatusNotImplemented, statusCode)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method: http.MethodGet,
+		url:    "/api/v1/query_range?name=metric_name&type=gauge&from=yesterday",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestRollups(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	repository.EnableRollups([]storage.RollupPolicy{{Resolution: time.Hour, Retention: 24 * time.Hour}})
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/gauge/metric_name/1"})
+	testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/gauge/metric_name/3"})
+
+	statusCode, contentType, body := testRequest(t, ts, requestDefinition{
+		method: http.MethodGet,
+		url:    "/api/v1/rollups?name=metric_name&type=gauge&resolution=1h",
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "application/json", contentType)
+
+	var response handlers.RollupsResponse
+	require.Nil(t, json.Unmarshal([]byte(body), &response))
+	require.Equal(t, "1h0m0s", response.Resolution)
+	require.Len(t, response.Points, 1)
+	require.Equal(t, int64(2), response.Points[0].Count)
+	require.Equal(t, 2.0, *response.Points[0].Avg)
+	require.Equal(t, 3.0, *response.Points[0].Last)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method: http.MethodGet,
+		url:    "/api/v1/rollups?name=metric_name&type=gauge&resolution=1m",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestHistogram(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	update := `[{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1,1,0],"sum":0.55,"count":2}},` +
+		`{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[0,1,1],"sum":5.5,"count":2}}]`
+	statusCode, _, _ := testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/updates/", body: update, contentType: "application/json"})
+	require.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/histogram/latency/0.05"})
+	require.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _, body := testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/value/", body: `{"id":"latency","type":"histogram"}`, contentType: "application/json"})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, `{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[2,2,1],"sum":6.1,"count":5},"quantiles":{"0.5":0.325,"0.9":1,"0.99":1}}`, body)
+
+	statusCode, _, body = testRequest(t, ts, requestDefinition{method: http.MethodGet, url: "/value/histogram/latency?quantile=0.5"})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "0.325", body)
+
+	statusCode, _, body = testRequest(t, ts, requestDefinition{method: http.MethodGet, url: "/value/histogram/latency"})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "count=5 sum=6.100 p50=0.325 p90=1.000 p99=1.000", body)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{method: http.MethodGet, url: "/value/histogram/latency?quantile=2"})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	mismatch := `{"id":"latency","type":"histogram","histogram":{"bounds":[0.5],"counts":[1,0],"sum":0.1,"count":1}}`
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/", body: mismatch, contentType: "application/json"})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	for _, value := range []string{"NaN", "Inf", "-Inf"} {
+		statusCode, _, _ = testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/update/histogram/latency/" + value})
+		require.Equal(t, http.StatusBadRequest, statusCode, value)
+	}
+
+	_, _, body = testRequest(t, ts, requestDefinition{method: http.MethodGet, url: "/metrics"})
+	require.Contains(t, body, "# TYPE latency histogram\nlatency_bucket{le=\"0.1\"} 2\nlatency_bucket{le=\"1\"} 4\nlatency_bucket{le=\"+Inf\"} 5\n")
+
+	_, _, body = testRequest(t, ts, requestDefinition{method: http.MethodGet, url: "/"})
+	require.Contains(t, body, "<li>latency:count=5 sum=6.100 p50=0.325 p90=1.000 p99=1.000</li>")
+}
+
+func TestEncryption(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	repository := storage.NewMemStorageDefault()
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil, WithPrivateKey(privateKey)))
+	defer ts.Close()
+
+	encrypt := func(publicKey *rsa.PublicKey, body string) string {
+		encrypted, err := utils.Encrypt(publicKey, []byte(body))
+		require.Nil(t, err)
+		return string(encrypted)
+	}
+	encrypted := map[string]string{utils.EncryptionHeader: utils.EncryptionScheme}
+
+	// the body is compressed before the encryption, so it's decrypted before the decompression
+	statusCode, _, _ := testRequest(t, ts, requestDefinition{
+		method:          http.MethodPost,
+		url:             "/updates/",
+		body:            encrypt(&privateKey.PublicKey, compress(t, `[{"id":"PollCount","type":"counter","delta":3}]`)),
+		contentType:     "application/json",
+		contentEncoding: "gzip",
+		headers:         encrypted,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, map[string]handlers.CounterMetric{"PollCount": {Name: "PollCount", Value: 3}}, repository.CounterStore())
+
+	tests := map[string]requestDefinition{
+		"plaintext": {
+			method:      http.MethodPost,
+			url:         "/updates/",
+			body:        `[{"id":"PollCount","type":"counter","delta":3}]`,
+			contentType: "application/json",
+		},
+		"other key": {
+			method:      http.MethodPost,
+			url:         "/updates/",
+			body:        encrypt(&otherKey.PublicKey, `[{"id":"PollCount","type":"counter","delta":3}]`),
+			contentType: "application/json",
+			headers:     encrypted,
+		},
+		"unknown scheme": {
+			method:      http.MethodPost,
+			url:         "/updates/",
+			body:        encrypt(&privateKey.PublicKey, `[{"id":"PollCount","type":"counter","delta":3}]`),
+			contentType: "application/json",
+			headers:     map[string]string{utils.EncryptionHeader: "rot13"},
+		},
+	}
+	for name, request := range tests {
+		t.Run(name, func(t *testing.T) {
+			statusCode, _, _ := testRequest(t, ts, request)
+			require.Equal(t, http.StatusBadRequest, statusCode)
+		})
+	}
+	require.Equal(t, int64(3), repository.CounterStore()["PollCount"].Value)
+
+	// the requests without the body don't need the encryption
+	statusCode, _, body := testRequest(t, ts, requestDefinition{method: http.MethodGet, url: "/value/counter/PollCount"})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "3", body)
+}
+
+func TestLoadKeys(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	dir := t.TempDir()
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.Nil(t, err)
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.Nil(t, err)
+	files := map[string]*pem.Block{
+		"public.pem":        {Type: "PUBLIC KEY", Bytes: publicKeyBytes},
+		"public-pkcs1.pem":  {Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)},
+		"private.pem":       {Type: "PRIVATE KEY", Bytes: privateKeyBytes},
+		"private-pkcs1.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)},
+	}
+	for name, block := range files {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+	}
+
+	for _, name := range []string{"public.pem", "public-pkcs1.pem"} {
+		publicKey, err := utils.LoadPublicKey(filepath.Join(dir, name))
+		require.Nil(t, err)
+		require.True(t, privateKey.PublicKey.Equal(publicKey))
+	}
+	for _, name := range []string{"private.pem", "private-pkcs1.pem"} {
+		loaded, err := utils.LoadPrivateKey(filepath.Join(dir, name))
+		require.Nil(t, err)
+		require.True(t, privateKey.Equal(loaded))
+	}
+
+	_, err = utils.LoadPublicKey(filepath.Join(dir, "missing.pem"))
+	require.NotNil(t, err)
+	_, err = utils.LoadPrivateKey(filepath.Join(dir, "public.pem"))
+	require.NotNil(t, err)
+}
+
+func TestBodySignature(t *testing.T) {
+	h := utils.NewKeyring("", "secret")
+	repository := storage.NewMemStorageDefault()
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, h))
+	defer ts.Close()
+
+	sign := func(body string) map[string]string {
+		sign, err := h.Generate(body)
+		require.Nil(t, err)
+		return map[string]string{utils.HashSHA256Header: sign}
+	}
+
+	// the signed body doesn't need the hashes of the metrics
+	body := `[{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge","value":0.123456789}]`
+	statusCode, _, _ := testRequest(t, ts, requestDefinition{
+		method:          http.MethodPost,
+		url:             "/updates/",
+		body:            compress(t, body),
+		contentType:     "application/json",
+		contentEncoding: "gzip",
+		headers:         sign(body),
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, int64(3), repository.CounterStore()["PollCount"].Value)
+	require.Equal(t, 0.123456789, repository.GaugeStore()["Alloc"].Value)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method:      http.MethodPost,
+		url:         "/updates/",
+		body:        `[{"id":"PollCount","type":"counter","delta":100}]`,
+		contentType: "application/json",
+		headers:     sign(body),
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	// without the signature the hashes of the metrics are required as before
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method:      http.MethodPost,
+		url:         "/updates/",
+		body:        `[{"id":"PollCount","type":"counter","delta":100}]`,
+		contentType: "application/json",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+	require.Equal(t, int64(3), repository.CounterStore()["PollCount"].Value)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/value/counter/PollCount", nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "3", string(responseBody))
+	require.Equal(t, sign("3")[utils.HashSHA256Header], resp.Header.Get(utils.HashSHA256Header))
+}
+
+func TestKeyRotation(t *testing.T) {
+	current := utils.NewHashGenerator("new secret")
+	previous := utils.NewHashGenerator("old secret")
+	keyring := utils.NewKeyring("v2", "new secret")
+	require.Nil(t, keyring.AddKeys("v1:old secret"))
+	require.NotNil(t, keyring.AddKeys("v1:old secret"))
+	require.NotNil(t, keyring.AddKeys("v3"))
+
+	repository := storage.NewMemStorageDefault()
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, keyring))
+	defer ts.Close()
+
+	body := `[{"id":"PollCount","type":"counter","delta":1}]`
+	oldSign, err := previous.Generate(body)
+	require.Nil(t, err)
+	tests := []struct {
+		keyID              string
+		expectedStatusCode int
+	}{
+		{"v1", http.StatusOK},
+		// the agents which don't send the id are verified with every key
+		{"", http.StatusOK},
+		{"v2", http.StatusBadRequest},
+		{"v0", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		headers := map[string]string{utils.HashSHA256Header: oldSign}
+		if tt.keyID != "" {
+			headers[utils.HashKeyIDHeader] = tt.keyID
+		}
+		statusCode, _, _ := testRequest(t, ts, requestDefinition{
+			method:      http.MethodPost,
+			url:         "/updates/",
+			body:        body,
+			contentType: "application/json",
+			headers:     headers,
+		})
+		require.Equal(t, tt.expectedStatusCode, statusCode, tt.keyID)
+	}
+
+	// the hash of the metric is verified with the key of its id as well
+	metricSign, err := previous.Generate("PollCount:counter:1")
+	require.Nil(t, err)
+	statusCode, _, _ := testRequest(t, ts, requestDefinition{
+		method:      http.MethodPost,
+		url:         "/update/",
+		body:        fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"hash":"%s","key_id":"v1"}`, metricSign),
+		contentType: "application/json",
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, int64(3), repository.CounterStore()["PollCount"].Value)
+	require.Equal(t, map[string]int64{"v1": 3}, keyring.TakeUses())
+	require.Empty(t, keyring.TakeUses())
+
+	// the responses are signed with the current key
+	resp, err := http.Get(ts.URL + "/value/counter/PollCount")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	expectedSign, err := current.Generate(string(responseBody))
+	require.Nil(t, err)
+	require.Equal(t, expectedSign, resp.Header.Get(utils.HashSHA256Header))
+	require.Equal(t, "v2", resp.Header.Get(utils.HashKeyIDHeader))
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	_, err := utils.ParseTrustedSubnets("10.0.0.0/8,not a subnet")
+	require.NotNil(t, err)
+	subnets, err := utils.ParseTrustedSubnets("10.0.0.0/8, 192.168.1.0/24")
+	require.Nil(t, err)
+
+	tests := []struct {
+		name               string
+		checkRemoteAddr    bool
+		method             string
+		url                string
+		realIP             string
+		expectedStatusCode int
+	}{
+		{"trusted", false, http.MethodPost, "/update/counter/PollCount/1", "192.168.1.15", http.StatusOK},
+		{"untrusted", false, http.MethodPost, "/update/counter/PollCount/1", "192.168.2.15", http.StatusForbidden},
+		{"without the header", false, http.MethodPost, "/update/counter/PollCount/1", "", http.StatusForbidden},
+		{"reading", false, http.MethodGet, "/value/counter/PollCount", "", http.StatusOK},
+		// the test client connects from 127.0.0.1, which isn't trusted
+		{"untrusted connection", true, http.MethodPost, "/update/counter/PollCount/1", "10.1.2.3", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := storage.NewMemStorageDefault()
+			require.Nil(t, repository.UpsertCounter(handlers.CounterMetric{Name: "PollCount", Value: 1}))
+			ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil, WithTrustedSubnets(subnets, tt.checkRemoteAddr)))
+			defer ts.Close()
+
+			statusCode, _, _ := testRequest(t, ts, requestDefinition{
+				method:  tt.method,
+				url:     tt.url,
+				headers: map[string]string{utils.RealIPHeader: tt.realIP},
+			})
+			require.Equal(t, tt.expectedStatusCode, statusCode)
+		})
+	}
+}
+
+func TestWritersProtection(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	// the test client connects from 127.0.0.1
+	localSubnets, err := utils.ParseTrustedSubnets("127.0.0.0/8")
+	require.Nil(t, err)
+	otherSubnets, err := utils.ParseTrustedSubnets("10.0.0.0/8")
+	require.Nil(t, err)
+
+	otlpBody, err := proto.Marshal(&colmetricspb.ExportMetricsServiceRequest{})
+	require.Nil(t, err)
+	remoteWriteBody, err := proto.Marshal(&prompb.WriteRequest{})
+	require.Nil(t, err)
+	writes := []requestDefinition{
+		{method: http.MethodPost, url: "/api/v2/write", body: "cpu value=1"},
+		{method: http.MethodPost, url: "/v1/metrics", body: string(otlpBody), contentType: "application/x-protobuf"},
+		{method: http.MethodPost, url: "/api/v1/write", body: string(snappy.Encode(nil, remoteWriteBody)), contentType: "application/x-protobuf", contentEncoding: "snappy"},
+	}
+
+	tests := []struct {
+		name          string
+		hashGenerator handlers.IHashGenerator
+		opts          []Option
+		// the writes are expected to succeed
+		isAccepted bool
+		// the agent endpoints stay protected, the plain unsigned batch without X-Real-IP is rejected with the status
+		agentStatusCode int
+	}{
+		{"without protection", nil, nil, true, http.StatusOK},
+		{"key", utils.NewKeyring("", "secret"), nil, true, http.StatusBadRequest},
+		{"private key", nil, []Option{WithPrivateKey(privateKey)}, true, http.StatusBadRequest},
+		{"trusted connection", nil, []Option{WithTrustedSubnets(localSubnets, false)}, true, http.StatusForbidden},
+		{"untrusted connection", nil, []Option{WithTrustedSubnets(otherSubnets, false)}, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(AddHandlers(chi.NewRouter(), storage.NewMemStorageDefault(), tt.hashGenerator, tt.opts...))
+			defer ts.Close()
+
+			for _, write := range writes {
+				// X-Real-IP is ignored, only the address of the connection is checked
+				write.headers = map[string]string{utils.RealIPHeader: "10.0.0.1"}
+				statusCode, _, body := testRequest(t, ts, write)
+				if tt.isAccepted {
+					require.Less(t, statusCode, 300, write.url+": "+body)
+				} else {
+					require.Equal(t, http.StatusForbidden, statusCode, write.url)
+				}
+			}
+
+			statusCode, _, _ := testRequest(t, ts, requestDefinition{
+				method:      http.MethodPost,
+				url:         "/updates/",
+				body:        `[{"id":"PollCount","type":"counter","delta":1}]`,
+				contentType: "application/json",
+			})
+			require.Equal(t, tt.agentStatusCode, statusCode)
+		})
+	}
+}
+
+func TestZstdRequest(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	encoder, err := zstd.NewWriter(nil)
+	require.Nil(t, err)
+	body := encoder.EncodeAll([]byte(`[{"id":"PollCount","type":"counter","delta":3}]`), nil)
+	require.Nil(t, encoder.Close())
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(body))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "zstd")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "gzip, zstd", resp.Header.Get("Accept-Encoding"))
+	require.Equal(t, int64(3), repository.CounterStore()["PollCount"].Value)
+
+	statusCode, _, _ := testRequest(t, ts, requestDefinition{
+		method:          http.MethodPost,
+		url:             "/updates/",
+		body:            "not zstd",
+		contentType:     "application/json",
+		contentEncoding: "zstd",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestInfluxWrite(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	require.Nil(t, repository.UpsertCounter(handlers.CounterMetric{Name: "net_bytes_recv", Value: 100, Labels: handlers.Labels{"host": "a"}}))
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	statusCode, _, _ := testRequest(t, ts, requestDefinition{
+		method: http.MethodPost,
+		url:    "/api/v2/write?org=smetrics&bucket=telegraf&precision=s",
+		body: "# comment\n" +
+			"net,host=a bytes_recv=150i,bytes_sent=20u 1700000000\n" +
+			"cpu,host=a usage_idle=97.5,usage_user=1 1700000000\n" +
+			"temperature,host=a value=21.5,status=\"ok\",alarm=false\n" +
+			"cpu,host=a usage_idle=98.5 1700000001\n",
+	})
+	require.Equal(t, http.StatusNoContent, statusCode)
+
+	counter, err := repository.GetCounter("net_bytes_recv", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, int64(150), counter)
+	counter, err = repository.GetCounter("net_bytes_sent", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, int64(20), counter)
+	gauge, err := repository.GetGauge("cpu_usage_idle", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, 98.5, gauge)
+	gauge, err = repository.GetGauge("cpu_usage_user", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, 1.0, gauge)
+	gauge, err = repository.GetGauge("temperature", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, 21.5, gauge)
+	_, err = repository.GetGauge("temperature_status", handlers.Labels{"host": "a"})
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	// the valid lines are written, the invalid ones are reported
+	statusCode, contentType, body := testRequest(t, ts, requestDefinition{
+		method: http.MethodPost,
+		url:    "/api/v2/write",
+		body:   "mem used=10i\nmem\nmem free=abc\nmem total=18446744073709551615u",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+	require.Equal(t, "application/json", contentType)
+	var response handlers.InfluxWriteResponse
+	require.Nil(t, json.Unmarshal([]byte(body), &response))
+	require.Equal(t, "invalid", response.Code)
+	require.Equal(t, "partial write: 3 lines rejected", response.Message)
+	require.Len(t, response.Errors, 3)
+	require.Equal(t, []int{2, 3, 4}, []int{response.Errors[0].Line, response.Errors[1].Line, response.Errors[2].Line})
+	counter, err = repository.GetCounter("mem_used", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(10), counter)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method: http.MethodPost,
+		url:    "/api/v2/write?precision=h",
+		body:   "mem used=10i",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	require.Nil(t, repository.UpsertCounter(handlers.CounterMetric{Name: "api.http.requests", Value: 10, Labels: handlers.Labels{"env": "prod", "route": "/"}}))
+	require.Nil(t, repository.UpsertGauge(handlers.GaugeMetric{Name: "api.queue.size", Value: 5, Labels: handlers.Labels{"env": "prod"}}))
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil, WithOTLPNamePrefixAttributes([]string{"service.name"})))
+	defer ts.Close()
+
+	stringAttribute := func(key, value string) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+	}
+	intPoint := func(value int64, timeUnixNano uint64, attributes ...*commonpb.KeyValue) *metricspb.NumberDataPoint {
+		return &metricspb.NumberDataPoint{Value: &metricspb.NumberDataPoint_AsInt{AsInt: value}, TimeUnixNano: timeUnixNano, Attributes: attributes}
+	}
+	doublePoint := func(value float64, timeUnixNano uint64) *metricspb.NumberDataPoint {
+		return &metricspb.NumberDataPoint{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: value}, TimeUnixNano: timeUnixNano}
+	}
+	request := &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", "api"), stringAttribute("env", "prod")}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+			{Name: "http.requests", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints:             []*metricspb.NumberDataPoint{intPoint(2, 1, stringAttribute("route", "/")), intPoint(3, 2, stringAttribute("route", "/"))},
+			}}},
+			{Name: "cpu.time", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints:             []*metricspb.NumberDataPoint{intPoint(120, 2), intPoint(100, 1)},
+			}}},
+			{Name: "queue.size", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints:             []*metricspb.NumberDataPoint{intPoint(-2, 1)},
+			}}},
+			{Name: "connections", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints:             []*metricspb.NumberDataPoint{intPoint(7, 1)},
+			}}},
+			{Name: "memory.usage", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{doublePoint(0.5, 1), {TimeUnixNano: 2, Flags: uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE)}},
+			}}},
+			{Name: "http.duration", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				DataPoints: []*metricspb.HistogramDataPoint{{Count: 1}, {Count: 2}},
+			}}},
+			{Name: "errors", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				IsMonotonic: true,
+				DataPoints:  []*metricspb.NumberDataPoint{intPoint(1, 1)},
+			}}},
+			{Name: "bytes.sent", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints:             []*metricspb.NumberDataPoint{doublePoint(1e19, 1)},
+			}}},
+		}}},
+	}}}
+	body, err := proto.Marshal(request)
+	require.Nil(t, err)
+
+	statusCode, contentType, responseBody := testRequest(t, ts, requestDefinition{
+		method:      http.MethodPost,
+		url:         "/v1/metrics",
+		body:        string(body),
+		contentType: "application/x-protobuf",
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "application/x-protobuf", contentType)
+	var response colmetricspb.ExportMetricsServiceResponse
+	require.Nil(t, proto.Unmarshal([]byte(responseBody), &response))
+	require.Equal(t, int64(4), response.GetPartialSuccess().GetRejectedDataPoints())
+	require.Equal(t, `the histogram "api.http.duration" is not supported; the sum "api.errors" has no aggregation temporality; the value of "api.bytes.sent" overflows the counter`, response.GetPartialSuccess().GetErrorMessage())
+
+	prod := handlers.Labels{"env": "prod"}
+	counter, err := repository.GetCounter("api.http.requests", handlers.Labels{"env": "prod", "route": "/"})
+	require.Nil(t, err)
+	require.Equal(t, int64(15), counter)
+	counter, err = repository.GetCounter("api.cpu.time", prod)
+	require.Nil(t, err)
+	require.Equal(t, int64(120), counter)
+	gauge, err := repository.GetGauge("api.queue.size", prod)
+	require.Nil(t, err)
+	require.Equal(t, 3.0, gauge)
+	gauge, err = repository.GetGauge("api.connections", prod)
+	require.Nil(t, err)
+	require.Equal(t, 7.0, gauge)
+	gauge, err = repository.GetGauge("api.memory.usage", prod)
+	require.Nil(t, err)
+	require.Equal(t, 0.5, gauge)
+	_, err = repository.GetCounter("api.bytes.sent", prod)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	// the JSON encoding of OTLP has the integers in strings and the enums as numbers
+	statusCode, contentType, responseBody = testRequest(t, ts, requestDefinition{
+		method:      http.MethodPost,
+		url:         "/v1/metrics",
+		contentType: "application/json",
+		body: `{"resourceMetrics":[{"resource":{"attributes":[{"key":"host","value":{"stringValue":"a"}}]},
+			"scopeMetrics":[{"scope":{"name":"test"},"metrics":[{"name":"jobs","sum":{"isMonotonic":true,"aggregationTemporality":2,
+			"dataPoints":[{"asInt":"42","timeUnixNano":"1700000000000000000"}]}}]}]}]}`,
+	})
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, "application/json", contentType)
+	require.Equal(t, "{}", responseBody)
+	counter, err = repository.GetCounter("jobs", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, int64(42), counter)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/v1/metrics", body: "{", contentType: "application/json"})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{method: http.MethodPost, url: "/v1/metrics", body: "{}", contentType: "text/plain"})
+	require.Equal(t, http.StatusUnsupportedMediaType, statusCode)
+}
+
+// failingOnceRepository fails the first batch without writing anything, as the rolled back transaction does
+type failingOnceRepository struct {
+	*storage.MemStorage
+	isFailed bool
+}
+
+func (r *failingOnceRepository) UpsertMany(ctx context.Context, metrics []interface{}) error {
+	if !r.isFailed {
+		r.isFailed = true
+		return errors.New("connection reset")
+	}
+
+	return r.MemStorage.UpsertMany(ctx, metrics)
+}
+
+func TestOTLPMetrics_Retry(t *testing.T) {
+	repository := &failingOnceRepository{MemStorage: storage.NewMemStorageDefault()}
+	require.Nil(t, repository.UpsertGauge(handlers.GaugeMetric{Name: "queue.size", Value: 5}))
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	deltaPoint := func(value int64) []*metricspb.NumberDataPoint {
+		return []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsInt{AsInt: value}, TimeUnixNano: 1}}
+	}
+	body, err := proto.Marshal(&colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+			{Name: "queue.size", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints:             deltaPoint(-2),
+			}}},
+			{Name: "http.requests", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints:             deltaPoint(3),
+			}}},
+			{Name: "memory.usage", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: deltaPoint(7)}}},
+		}}},
+	}}})
+	require.Nil(t, err)
+	export := func() int {
+		statusCode, _, _ := testRequest(t, ts, requestDefinition{
+			method:      http.MethodPost,
+			url:         "/v1/metrics",
+			body:        string(body),
+			contentType: "application/x-protobuf",
+		})
+		return statusCode
+	}
+
+	// nothing is written by the failed export, so its retry applies the deltas once
+	require.Equal(t, http.StatusServiceUnavailable, export())
+	gauge, err := repository.GetGauge("queue.size", nil)
+	require.Nil(t, err)
+	require.Equal(t, 5.0, gauge)
+	_, err = repository.GetCounter("http.requests", nil)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	require.Equal(t, http.StatusOK, export())
+	gauge, err = repository.GetGauge("queue.size", nil)
+	require.Nil(t, err)
+	require.Equal(t, 3.0, gauge)
+	counter, err := repository.GetCounter("http.requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), counter)
+	gauge, err = repository.GetGauge("memory.usage", nil)
+	require.Nil(t, err)
+	require.Equal(t, 7.0, gauge)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	ts := httptest.NewServer(AddHandlers(chi.NewRouter(), repository, nil))
+	defer ts.Close()
+
+	series := func(labels map[string]string, samples ...*prompb.Sample) *prompb.TimeSeries {
+		result := &prompb.TimeSeries{Samples: samples}
+		for name, value := range labels {
+			result.Labels = append(result.Labels, &prompb.Label{Name: name, Value: value})
+		}
+		return result
+	}
+	write := func(request *prompb.WriteRequest) (int, string) {
+		body, err := proto.Marshal(request)
+		require.Nil(t, err)
+		statusCode, _, responseBody := testRequest(t, ts, requestDefinition{
+			method:          http.MethodPost,
+			url:             "/api/v1/write",
+			body:            string(snappy.Encode(nil, body)),
+			contentType:     "application/x-protobuf",
+			contentEncoding: "snappy",
+		})
+		return statusCode, responseBody
+	}
+	staleNaN := math.Float64frombits(0x7ff0000000000002)
+
+	// without the metadata the type is guessed by the suffix
+	statusCode, body := write(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		series(map[string]string{"__name__": "http_requests_total", "job": "api"}, &prompb.Sample{Value: 12.2, Timestamp: 2000}, &prompb.Sample{Value: 10, Timestamp: 1000}),
+		series(map[string]string{"__name__": "temperature"}, &prompb.Sample{Value: 21.5, Timestamp: 1000}),
+		series(map[string]string{"__name__": "rpc_duration_seconds_count"}, &prompb.Sample{Value: 7, Timestamp: 1000}),
+		series(map[string]string{"__name__": "rpc_duration_seconds_sum"}, &prompb.Sample{Value: 3.5, Timestamp: 1000}),
+		series(map[string]string{"__name__": "removed"}, &prompb.Sample{Value: staleNaN, Timestamp: 1000}),
+	}})
+	require.Equal(t, http.StatusNoContent, statusCode, body)
+
+	counter, err := repository.GetCounter("http_requests_total", handlers.Labels{"job": "api"})
+	require.Nil(t, err)
+	require.Equal(t, int64(12), counter)
+	counter, err = repository.GetCounter("rpc_duration_seconds_count", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(7), counter)
+	gauge, err := repository.GetGauge("temperature", nil)
+	require.Nil(t, err)
+	require.Equal(t, 21.5, gauge)
+	gauge, err = repository.GetGauge("rpc_duration_seconds_sum", nil)
+	require.Nil(t, err)
+	require.Equal(t, 3.5, gauge)
+	_, err = repository.GetGauge("removed", nil)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	// the types of the families are learned from the metadata, the invalid series are rejected
+	statusCode, body = write(&prompb.WriteRequest{
+		Metadata: []*prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "queue_total"},
+			{Type: prompb.MetricMetadata_SUMMARY, MetricFamilyName: "rpc_duration_seconds"},
+			{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "jobs"},
+		},
+		Timeseries: []*prompb.TimeSeries{
+			series(map[string]string{"__name__": "queue_total"}, &prompb.Sample{Value: 3, Timestamp: 1000}),
+			series(map[string]string{"__name__": "rpc_duration_seconds", "quantile": "0.5"}, &prompb.Sample{Value: 0.25, Timestamp: 1000}),
+			series(map[string]string{"__name__": "rpc_duration_seconds_sum"}, &prompb.Sample{Value: 4.25, Timestamp: 1000}),
+			series(map[string]string{"__name__": "jobs"}, &prompb.Sample{Value: 5, Timestamp: 1000}),
+			series(map[string]string{"job": "api"}, &prompb.Sample{Value: 1, Timestamp: 1000}),
+			series(map[string]string{"__name__": "jobs", "job": "api"}, &prompb.Sample{Value: math.NaN(), Timestamp: 1000}),
+			series(map[string]string{"__name__": "jobs", "job": "batch"}, &prompb.Sample{Value: 1e19, Timestamp: 1000}),
+			series(map[string]string{"__name__": "temperature", "room": "a"}, &prompb.Sample{Value: math.NaN(), Timestamp: 1000}),
+		},
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+	require.Equal(t, "partial write: the series has no __name__; the value of jobs{job=\"api\"} is not finite; "+
+		"the value of jobs{job=\"batch\"} overflows the counter; the value of temperature{room=\"a\"} is not finite\n", body)
+
+	gauge, err = repository.GetGauge("queue_total", nil)
+	require.Nil(t, err)
+	require.Equal(t, 3.0, gauge)
+	gauge, err = repository.GetGauge("rpc_duration_seconds", handlers.Labels{"quantile": "0.5"})
+	require.Nil(t, err)
+	require.Equal(t, 0.25, gauge)
+	gauge, err = repository.GetGauge("rpc_duration_seconds_sum", nil)
+	require.Nil(t, err)
+	require.Equal(t, 4.25, gauge)
+	counter, err = repository.GetCounter("jobs", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), counter)
+	_, err = repository.GetGauge("temperature", handlers.Labels{"room": "a"})
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	statusCode, _, _ = testRequest(t, ts, requestDefinition{
+		method:          http.MethodPost,
+		url:             "/api/v1/write",
+		body:            "not snappy",
+		contentEncoding: "snappy",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	// the body is limited before it's read
+	statusCode, _, body = testRequest(t, ts, requestDefinition{
+		method:          http.MethodPost,
+		url:             "/api/v1/write",
+		body:            strings.Repeat("a", snappy.MaxEncodedLen(32<<20)+1),
+		contentEncoding: "snappy",
+	})
+	require.Equal(t, http.StatusBadRequest, statusCode)
+	require.Contains(t, body, "request body too large")
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+	"io"
+	"net/http"
+)
+
+// signatureHandle verifies the HashSHA256 header of the request, the HMAC-SHA256 of the uncompressed body
+// with the key of the HashSHA256-Key-ID header, and signs the response with the current key. The requests without the header are passed to the handlers,
+// which check the hashes of the separate metrics.
+func signatureHandle(hashGenerator handlers.IHashGenerator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sign := r.Header.Get(utils.HashSHA256Header); sign != "" {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !hashGenerator.Verify(r.Header.Get(utils.HashKeyIDHeader), string(body), sign) {
+				http.Error(w, "the signature of the request is not correct", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r = handlers.WithVerifiedBody(r)
+		}
+
+		sw := &signingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		if sign, err := hashGenerator.Generate(sw.body.String()); err == nil {
+			w.Header().Set(utils.HashSHA256Header, sign)
+			if keyID := hashGenerator.KeyID(); keyID != "" {
+				w.Header().Set(utils.HashKeyIDHeader, keyID)
+			}
+		}
+		w.WriteHeader(sw.statusCode)
+		w.Write(sw.body.Bytes())
+	})
+}
+
+// signingResponseWriter keeps the response until the whole body is known and can be signed
+type signingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *signingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+func (w *signingResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"github.com/smamykin/smetrics/internal/utils"
+	"net"
+	"net/http"
+)
+
+// trustedSubnetHandle rejects the requests changing the metrics unless the X-Real-IP header reported by the agent,
+// and the remote address of the connection if checkRemoteAddr is set, belong to the trusted subnets.
+// The reading requests, e.g. the scraping of /metrics, are passed as is.
+func trustedSubnetHandle(subnets utils.TrustedSubnets, checkRemoteAddr bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := net.ParseIP(r.Header.Get(utils.RealIPHeader))
+		if ip == nil || !subnets.Contains(ip) {
+			http.Error(w, "the address is not in the trusted subnet", http.StatusForbidden)
+			return
+		}
+		if checkRemoteAddr && !isRemoteAddrTrusted(subnets, r.RemoteAddr) {
+			http.Error(w, "the address is not in the trusted subnet", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteAddrSubnetHandle rejects the requests unless the remote address of the connection belongs to the trusted subnets,
+// as the StatsD and Graphite listeners do. It protects the writers which don't report X-Real-IP.
+func remoteAddrSubnetHandle(subnets utils.TrustedSubnets, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRemoteAddrTrusted(subnets, r.RemoteAddr) {
+			http.Error(w, "the address is not in the trusted subnet", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isRemoteAddrTrusted(subnets utils.TrustedSubnets, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+
+	return err == nil && subnets.Contains(net.ParseIP(host))
+}
@@ -0,0 +1,459 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxPacketSize is the largest UDP datagram
+	maxPacketSize = 65535
+	// maxLineSize limits the line read from the TCP connection
+	maxLineSize = 64 << 10
+	// DefaultMaxPending is how many samples are kept until the flush, the others are dropped
+	DefaultMaxPending = 100000
+)
+
+// Limits protect the server from the misbehaving clients
+type Limits struct {
+	// MaxPending is how many samples are kept until the flush, the others are dropped
+	MaxPending int
+	// MaxConnections is how many TCP connections are served at once, the others are closed right after accepting
+	MaxConnections int
+	// IdleTimeout is how long to wait for the next line before closing the TCP connection
+	IdleTimeout time.Duration
+}
+
+var DefaultLimits = Limits{
+	MaxPending:     DefaultMaxPending,
+	MaxConnections: 100,
+	IdleTimeout:    time.Minute,
+}
+
+// the self-metrics of the listener, they are written with the flushed batch
+const (
+	metricSamples        = "StatsdSamples"
+	metricParseErrors    = "StatsdParseErrors"
+	metricDroppedSamples = "StatsdDroppedSamples"
+)
+
+// Listener receives the StatsD lines and keeps the samples until Flush writes them to the repository in one batch.
+type Listener struct {
+	repository     handlers.IRepository
+	logger         *zerolog.Logger
+	limits         Limits
+	trustedSubnets utils.TrustedSubnets
+
+	mu      sync.Mutex
+	pending *batch
+
+	slots   chan struct{}
+	wg      sync.WaitGroup
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+
+	samples     int64
+	parseErrors int64
+	dropped     int64
+}
+
+// batch aggregates the samples of the series between the flushes
+type batch struct {
+	size     int
+	counters map[string]*counterSample
+	gauges   map[string]*gaugeSample
+	timings  map[string]*timingSample
+}
+
+type counterSample struct {
+	name   string
+	labels handlers.Labels
+	delta  float64
+}
+
+type gaugeSample struct {
+	name   string
+	labels handlers.Labels
+	value  float64
+	// isSet tells whether the value is absolute, otherwise it's the change of the stored gauge
+	isSet bool
+}
+
+type timingSample struct {
+	name   string
+	labels handlers.Labels
+	values []float64
+}
+
+func newBatch() *batch {
+	return &batch{
+		counters: map[string]*counterSample{},
+		gauges:   map[string]*gaugeSample{},
+		timings:  map[string]*timingSample{},
+	}
+}
+
+// NewListener creates the listener. If trustedSubnets is not empty, the packets and the connections
+// from the other addresses are dropped.
+func NewListener(logger *zerolog.Logger, repository handlers.IRepository, limits Limits, trustedSubnets utils.TrustedSubnets) *Listener {
+	return &Listener{
+		repository:     repository,
+		logger:         logger,
+		limits:         limits,
+		trustedSubnets: trustedSubnets,
+		pending:        newBatch(),
+		slots:          make(chan struct{}, limits.MaxConnections),
+		conns:          map[net.Conn]struct{}{},
+	}
+}
+
+// ServeUDP reads the packets until the connection is closed, every packet may contain several lines
+func (l *Listener) ServeUDP(conn net.PacketConn) error {
+	l.connsMu.Lock()
+	if l.closed {
+		l.connsMu.Unlock()
+		return nil
+	}
+	l.wg.Add(1)
+	l.connsMu.Unlock()
+	defer l.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !l.isTrusted(addr) {
+			atomic.AddInt64(&l.dropped, 1)
+			continue
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handleLine(line)
+		}
+	}
+}
+
+// ServeTCP accepts the connections until the listener is closed, the lines are separated by the newlines
+func (l *Listener) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			atomic.AddInt64(&l.dropped, 1)
+			conn.Close()
+			continue
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.logger.Warn().Msgf("the statsd connection from %s is rejected, the limit of %d connections is reached", conn.RemoteAddr(), l.limits.MaxConnections)
+			conn.Close()
+			continue
+		}
+
+		l.connsMu.Lock()
+		if l.closed {
+			l.connsMu.Unlock()
+			conn.Close()
+			<-l.slots
+			continue
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.connsMu.Unlock()
+		go l.serveConn(conn)
+	}
+}
+
+// Close closes the TCP connections being served and waits until their lines and the packet being read are handled,
+// so the final Flush gets all the received samples. The sockets passed to ServeUDP and ServeTCP are closed by the caller.
+func (l *Listener) Close() error {
+	l.connsMu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.connsMu.Unlock()
+	l.wg.Wait()
+
+	return nil
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer func() {
+		l.connsMu.Lock()
+		delete(l.conns, conn)
+		l.connsMu.Unlock()
+		conn.Close()
+		<-l.slots
+		l.wg.Done()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(l.limits.IdleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		l.handleLine(scanner.Text())
+	}
+
+	var netErr net.Error
+	switch err := scanner.Err(); {
+	case err == nil, errors.Is(err, net.ErrClosed):
+	case errors.As(err, &netErr) && netErr.Timeout():
+		l.logger.Debug().Msgf("the idle statsd connection from %s is closed", conn.RemoteAddr())
+	default:
+		atomic.AddInt64(&l.parseErrors, 1)
+		l.logger.Warn().Err(err).Msgf("the statsd connection from %s is closed", conn.RemoteAddr())
+	}
+}
+
+// Run flushes the samples with the interval until the context is done.
+// The last samples are flushed by the caller once the sockets are closed.
+func (l *Listener) Run(ctx context.Context, interval time.Duration) {
+	utils.InvokeFunctionWithInterval(ctx, interval, func() {
+		if err := l.Flush(ctx); err != nil {
+			l.logger.Error().Err(err).Msg("cannot flush the statsd metrics")
+		}
+	})
+}
+
+// Flush writes the samples received since the previous flush and the self-metrics of the listener with IncrementMany,
+// so the counters are added to the stored ones, the absolute gauges are replaced and the relative ones are added.
+// If the write fails, the samples are kept to be written by the next flush.
+func (l *Listener) Flush(ctx context.Context) error {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = newBatch()
+	l.mu.Unlock()
+
+	var metrics []interface{}
+	for key, counter := range pending.counters {
+		// the huge values scaled by the sample rate may overflow the counter
+		if !(math.Abs(counter.delta) < math.MaxInt64) {
+			delete(pending.counters, key)
+			atomic.AddInt64(&l.parseErrors, 1)
+			l.logger.Warn().Msgf("the delta of the statsd counter %s overflows the counter, it is dropped", counter.name)
+			continue
+		}
+		metrics = append(metrics, handlers.CounterMetric{Name: counter.name, Value: int64(math.Round(counter.delta)), Labels: counter.labels})
+	}
+	for key, gauge := range pending.gauges {
+		if math.IsInf(gauge.value, 0) {
+			delete(pending.gauges, key)
+			atomic.AddInt64(&l.parseErrors, 1)
+			l.logger.Warn().Msgf("the value of the statsd gauge %s overflows, it is dropped", gauge.name)
+			continue
+		}
+		if gauge.isSet {
+			metrics = append(metrics, handlers.GaugeMetric{Name: gauge.name, Value: gauge.value, Labels: gauge.labels})
+		} else {
+			metrics = append(metrics, handlers.GaugeIncrement{Name: gauge.name, Value: gauge.value, Labels: gauge.labels})
+		}
+	}
+
+	selfMetrics := map[string]int64{}
+	for name, value := range map[string]*int64{metricSamples: &l.samples, metricParseErrors: &l.parseErrors, metricDroppedSamples: &l.dropped} {
+		if delta := atomic.SwapInt64(value, 0); delta != 0 {
+			selfMetrics[name] = delta
+			metrics = append(metrics, handlers.CounterMetric{Name: name, Value: delta})
+		}
+	}
+
+	var err error
+	for _, timing := range pending.timings {
+		var histogram utils.Histogram
+		if histogram, err = l.newHistogram(timing); err != nil {
+			break
+		}
+		metrics = append(metrics, handlers.HistogramMetric{Name: timing.name, Value: histogram, Labels: timing.labels})
+	}
+	if err == nil && len(metrics) > 0 {
+		err = l.repository.IncrementMany(ctx, metrics)
+	}
+	if err != nil {
+		l.restore(pending, selfMetrics)
+	}
+
+	return err
+}
+
+// restore returns the batch which failed to be written to the pending samples, they are older than the pending ones.
+// If the pending samples are too many, the timings of the batch are dropped, the counters and the gauges take
+// no more room since they are aggregated with the pending ones.
+func (l *Listener) restore(older *batch, selfMetrics map[string]int64) {
+	l.mu.Lock()
+	if l.pending.size+older.size > l.limits.MaxPending {
+		for key, timing := range older.timings {
+			older.size -= len(timing.values)
+			atomic.AddInt64(&l.dropped, int64(len(timing.values)))
+			delete(older.timings, key)
+		}
+	}
+	l.pending.mergeOlder(older)
+	l.mu.Unlock()
+
+	for name, value := range map[string]*int64{metricSamples: &l.samples, metricParseErrors: &l.parseErrors, metricDroppedSamples: &l.dropped} {
+		atomic.AddInt64(value, selfMetrics[name])
+	}
+}
+
+// mergeOlder adds the samples of the batch received before this one
+func (b *batch) mergeOlder(older *batch) {
+	b.size += older.size
+	for key, counter := range older.counters {
+		if merged, ok := b.counters[key]; ok {
+			merged.delta += counter.delta
+		} else {
+			b.counters[key] = counter
+		}
+	}
+	for key, gauge := range older.gauges {
+		merged, ok := b.gauges[key]
+		switch {
+		case !ok:
+			b.gauges[key] = gauge
+		case !merged.isSet:
+			// the later changes apply to the older value
+			merged.value += gauge.value
+			merged.isSet = gauge.isSet
+		}
+	}
+	for key, timing := range older.timings {
+		if merged, ok := b.timings[key]; ok {
+			merged.values = append(timing.values, merged.values...)
+		} else {
+			b.timings[key] = timing
+		}
+	}
+}
+
+// newHistogram observes the timings into the histogram with the bounds of the stored one, so they can be merged
+func (l *Listener) newHistogram(timing *timingSample) (utils.Histogram, error) {
+	bounds := utils.DefaultHistogramBounds
+	stored, err := l.repository.GetHistogram(timing.name, timing.labels)
+	if err == nil {
+		bounds = stored.Bounds
+	} else if !errors.Is(err, handlers.ErrMetricNotFound) {
+		return utils.Histogram{}, err
+	}
+
+	histogram, err := utils.NewHistogram(bounds)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+	for _, value := range timing.values {
+		if err = histogram.Observe(value); err != nil {
+			return utils.Histogram{}, err
+		}
+	}
+
+	return histogram, nil
+}
+
+func (l *Listener) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	sample, err := ParseLine(line)
+	if err != nil {
+		atomic.AddInt64(&l.parseErrors, 1)
+		l.logger.Debug().Err(err).Msg("")
+		return
+	}
+	if !l.add(sample) {
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&l.samples, 1)
+}
+
+// add aggregates the sample into the pending batch, false is returned when the batch is full
+func (l *Listener) add(sample Sample) bool {
+	key := handlers.SeriesKey(sample.Name, sample.Labels)
+	// the sampled timing stands for 1/rate of the events, each of them is kept
+	weight := 1
+	if sample.MType == handlers.MetricTypeHistogram {
+		weight = int(math.Max(1, math.Round(1/sample.SampleRate)))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending.size+weight > l.limits.MaxPending {
+		return false
+	}
+	l.pending.size += weight
+
+	switch sample.MType {
+	case handlers.MetricTypeCounter:
+		counter, ok := l.pending.counters[key]
+		if !ok {
+			counter = &counterSample{name: sample.Name, labels: sample.Labels}
+			l.pending.counters[key] = counter
+		}
+		counter.delta += sample.Value / sample.SampleRate
+	case handlers.MetricTypeGauge:
+		gauge, ok := l.pending.gauges[key]
+		if !ok {
+			gauge = &gaugeSample{name: sample.Name, labels: sample.Labels}
+			l.pending.gauges[key] = gauge
+		}
+		if sample.IsRelative {
+			gauge.value += sample.Value
+		} else {
+			gauge.value = sample.Value
+			gauge.isSet = true
+		}
+	case handlers.MetricTypeHistogram:
+		timing, ok := l.pending.timings[key]
+		if !ok {
+			timing = &timingSample{name: sample.Name, labels: sample.Labels}
+			l.pending.timings[key] = timing
+		}
+		for i := 0; i < weight; i++ {
+			timing.values = append(timing.values, sample.Value)
+		}
+	}
+
+	return true
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	if len(l.trustedSubnets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	return l.trustedSubnets.Contains(net.ParseIP(host))
+}
@@ -0,0 +1,301 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/server/storage"
+	"github.com/smamykin/smetrics/internal/utils"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListener_ServeUDP(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	require.Nil(t, repository.UpsertCounter(handlers.CounterMetric{Name: "requests", Value: 100}))
+	require.Nil(t, repository.UpsertGauge(handlers.GaugeMetric{Name: "connections", Value: 10}))
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, DefaultLimits, nil)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go listener.ServeUDP(conn)
+	defer conn.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	for _, packet := range []string{
+		"requests:1|c\nrequests:2|c|@0.5\nrequests:1|c|#host:a",
+		"connections:+5|g\nconnections:-2|g",
+		"temperature:20|g\ntemperature:21.5|g",
+		"latency:0.3|ms\nlatency:7|ms|@0.5",
+		"broken line\nrequests:x|c",
+	} {
+		_, err = client.Write([]byte(packet))
+		require.Nil(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&listener.samples)+atomic.LoadInt64(&listener.parseErrors) == 11
+	}, time.Second, 5*time.Millisecond)
+
+	require.Nil(t, listener.Flush(context.Background()))
+
+	// the counters are added to the stored ones, the sampled one is scaled
+	requests, err := repository.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(105), requests)
+	requests, err = repository.GetCounter("requests", handlers.Labels{"host": "a"})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), requests)
+
+	connections, err := repository.GetGauge("connections", nil)
+	require.Nil(t, err)
+	require.Equal(t, 13.0, connections)
+	temperature, err := repository.GetGauge("temperature", nil)
+	require.Nil(t, err)
+	require.Equal(t, 21.5, temperature)
+
+	latency, err := repository.GetHistogram("latency", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), latency.Count)
+	require.InDelta(t, 14.3, latency.Sum, 1e-9)
+
+	samples, err := repository.GetCounter(metricSamples, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(9), samples)
+	parseErrors, err := repository.GetCounter(metricParseErrors, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), parseErrors)
+
+	// nothing is received since the previous flush
+	require.Nil(t, listener.Flush(context.Background()))
+	requests, err = repository.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(105), requests)
+}
+
+func TestListener_ServeTCP(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, Limits{MaxPending: 3, MaxConnections: 1, IdleTimeout: time.Minute}, nil)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go listener.ServeTCP(tcpListener)
+	defer tcpListener.Close()
+
+	client, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = fmt.Fprintf(client, "requests:1|c\n")
+		require.Nil(t, err)
+	}
+	require.Nil(t, client.Close())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&listener.samples)+atomic.LoadInt64(&listener.dropped) == 5
+	}, time.Second, 5*time.Millisecond)
+
+	require.Nil(t, listener.Flush(context.Background()))
+
+	// only 3 samples are kept until the flush
+	requests, err := repository.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), requests)
+	dropped, err := repository.GetCounter(metricDroppedSamples, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), dropped)
+}
+
+func TestListener_Limits(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, Limits{MaxPending: DefaultMaxPending, MaxConnections: 1, IdleTimeout: 100 * time.Millisecond}, nil)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go listener.ServeTCP(tcpListener)
+	defer tcpListener.Close()
+
+	first, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	defer first.Close()
+	_, err = fmt.Fprint(first, "first:1|c\n")
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&listener.samples) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// the limit of the connections is reached
+	second, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	defer second.Close()
+	requireClosed(t, second)
+
+	// the slot is released once the first connection is idle for too long
+	requireClosed(t, first)
+	require.Eventually(t, func() bool {
+		listener.connsMu.Lock()
+		defer listener.connsMu.Unlock()
+		return len(listener.conns) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	third, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	defer third.Close()
+	_, err = fmt.Fprint(third, "third:1|c\n")
+	require.Nil(t, err)
+	requireClosed(t, third)
+
+	require.Nil(t, listener.Flush(context.Background()))
+	counter, err := repository.GetCounter("third", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), counter)
+}
+
+func TestListener_Close(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, DefaultLimits, nil)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go listener.ServeTCP(tcpListener)
+	defer tcpListener.Close()
+
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "requests:1|c\n")
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&listener.samples) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// the connection is closed before the final flush, so nothing is received after it
+	require.Nil(t, tcpListener.Close())
+	require.Nil(t, listener.Close())
+	requireClosed(t, conn)
+	require.Nil(t, listener.Flush(context.Background()))
+
+	requests, err := repository.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), requests)
+}
+
+// failingOnceRepository fails the first batch without writing anything, as the rolled back transaction does
+type failingOnceRepository struct {
+	*storage.MemStorage
+	isFailed bool
+}
+
+func (r *failingOnceRepository) IncrementMany(ctx context.Context, metrics []interface{}) error {
+	if !r.isFailed {
+		r.isFailed = true
+		return errors.New("connection reset")
+	}
+
+	return r.MemStorage.IncrementMany(ctx, metrics)
+}
+
+func TestListener_Flush_Retry(t *testing.T) {
+	repository := &failingOnceRepository{MemStorage: storage.NewMemStorageDefault()}
+	require.Nil(t, repository.UpsertGauge(handlers.GaugeMetric{Name: "connections", Value: 10}))
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, DefaultLimits, nil)
+
+	for _, line := range []string{"requests:1|c", "connections:+5|g", "latency:0.3|ms", "broken line"} {
+		listener.handleLine(line)
+	}
+	require.NotNil(t, listener.Flush(context.Background()))
+	_, err := repository.GetCounter("requests", nil)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	// the samples of the failed flush are written with the later ones
+	for _, line := range []string{"requests:2|c", "connections:-2|g", "latency:0.5|ms"} {
+		listener.handleLine(line)
+	}
+	// the relative gauge is added to the stored value at the moment of the write
+	require.Nil(t, repository.UpsertGauge(handlers.GaugeMetric{Name: "connections", Value: 20}))
+	require.Nil(t, listener.Flush(context.Background()))
+
+	requests, err := repository.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), requests)
+	connections, err := repository.GetGauge("connections", nil)
+	require.Nil(t, err)
+	require.Equal(t, 23.0, connections)
+	latency, err := repository.GetHistogram("latency", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), latency.Count)
+	samples, err := repository.GetCounter(metricSamples, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(6), samples)
+	parseErrors, err := repository.GetCounter(metricParseErrors, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), parseErrors)
+}
+
+func TestListener_Flush_Overflow(t *testing.T) {
+	repository := storage.NewMemStorageDefault()
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, DefaultLimits, nil)
+
+	for _, line := range []string{"requests:1|c", "huge:1e300|c|@0.0001", "level:1e308|g", "level:+1e308|g"} {
+		listener.handleLine(line)
+	}
+	require.Nil(t, listener.Flush(context.Background()))
+
+	// the overflowing counter and gauge are dropped, the other metrics are written
+	requests, err := repository.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), requests)
+	_, err = repository.GetCounter("huge", nil)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+	_, err = repository.GetGauge("level", nil)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+	parseErrors, err := repository.GetCounter(metricParseErrors, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), parseErrors)
+}
+
+func TestListener_TrustedSubnets(t *testing.T) {
+	subnets, err := utils.ParseTrustedSubnets("10.0.0.0/8")
+	require.Nil(t, err)
+	repository := storage.NewMemStorageDefault()
+	logger := zerolog.Nop()
+	listener := NewListener(&logger, repository, DefaultLimits, subnets)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go listener.ServeUDP(conn)
+	defer conn.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("requests:1|c"))
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&listener.dropped) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	require.Nil(t, listener.Flush(context.Background()))
+	_, err = repository.GetCounter("requests", nil)
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+}
+
+// requireClosed waits until the server closes the connection, it's reset if the server hasn't read everything
+func requireClosed(t *testing.T, conn net.Conn) {
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := bufio.NewReader(conn).ReadByte()
+	var netErr net.Error
+	require.NotNil(t, err)
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the connection isn't closed")
+}
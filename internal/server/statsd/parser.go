@@ -0,0 +1,101 @@
+// Package statsd receives the metrics in the StatsD format over UDP and TCP
+// and writes them to the repository in periodic batches.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidLine = errors.New("invalid statsd line")
+
+// Sample is the parsed line, e.g. requests:1|c|@0.1|#host:a
+type Sample struct {
+	Name  string
+	MType string
+	Value float64
+	// SampleRate is the share of the events the client has sent, the counters are scaled by it
+	SampleRate float64
+	// IsRelative is set for the gauges with the sign, e.g. -10|g, which change the gauge instead of setting it
+	IsRelative bool
+	Labels     handlers.Labels
+}
+
+// ParseLine parses the line in the format name:value|type[|@sample_rate][|#tag:value,...], where the type is
+// c for the counters, g for the gauges, ms or h for the histograms. The DogStatsD tags become the labels.
+func ParseLine(line string) (Sample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Sample{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return Sample{}, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+
+	sample := Sample{Name: name, SampleRate: 1}
+	switch fields[1] {
+	case "c":
+		sample.MType = handlers.MetricTypeCounter
+	case "g":
+		sample.MType = handlers.MetricTypeGauge
+		sample.IsRelative = strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-")
+	case "ms", "h":
+		sample.MType = handlers.MetricTypeHistogram
+	default:
+		return Sample{}, fmt.Errorf("%w: unknown type %q", ErrInvalidLine, fields[1])
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return Sample{}, fmt.Errorf("%w: %q: %v", ErrInvalidLine, line, err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Sample{}, fmt.Errorf("%w: the value is not finite: %q", ErrInvalidLine, line)
+	}
+	sample.Value = value
+
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Sample{}, fmt.Errorf("%w: invalid sample rate %q", ErrInvalidLine, field)
+			}
+			sample.SampleRate = rate
+		case strings.HasPrefix(field, "#"):
+			sample.Labels = parseTags(field[1:])
+		default:
+			return Sample{}, fmt.Errorf("%w: unknown field %q", ErrInvalidLine, field)
+		}
+	}
+	if sample.MType == handlers.MetricTypeHistogram {
+		if err = handlers.ValidateHistogramLabels(sample.Labels); err != nil {
+			return Sample{}, fmt.Errorf("%w: %q: %v", ErrInvalidLine, line, err)
+		}
+	}
+
+	return sample, nil
+}
+
+// parseTags converts the tags to the labels, the tag without the value becomes the label with the empty one
+func parseTags(value string) handlers.Labels {
+	labels := handlers.Labels{}
+	for _, tag := range strings.Split(value, ",") {
+		if tag == "" {
+			continue
+		}
+		key, tagValue, _ := strings.Cut(tag, ":")
+		labels[key] = tagValue
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	return labels
+}
@@ -0,0 +1,30 @@
+package statsd
+
+import (
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := map[string]Sample{
+		"requests:1|c":                   {Name: "requests", MType: handlers.MetricTypeCounter, Value: 1, SampleRate: 1},
+		"requests:2|c|@0.5":              {Name: "requests", MType: handlers.MetricTypeCounter, Value: 2, SampleRate: 0.5},
+		"queue.size:42.5|g":              {Name: "queue.size", MType: handlers.MetricTypeGauge, Value: 42.5, SampleRate: 1},
+		"queue.size:-3|g":                {Name: "queue.size", MType: handlers.MetricTypeGauge, Value: -3, SampleRate: 1, IsRelative: true},
+		"queue.size:+3|g":                {Name: "queue.size", MType: handlers.MetricTypeGauge, Value: 3, SampleRate: 1, IsRelative: true},
+		"latency:320|ms|@0.1":            {Name: "latency", MType: handlers.MetricTypeHistogram, Value: 320, SampleRate: 0.1},
+		"latency:0.3|h|#host:a,region:b": {Name: "latency", MType: handlers.MetricTypeHistogram, Value: 0.3, SampleRate: 1, Labels: handlers.Labels{"host": "a", "region": "b"}},
+	}
+	for line, expected := range tests {
+		sample, err := ParseLine(line)
+		require.Nil(t, err, line)
+		require.Equal(t, expected, sample, line)
+	}
+
+	for _, line := range []string{"requests", ":1|c", "requests:1", "requests:one|c", "requests:1|s", "requests:1|c|@2", "requests:1|c|x",
+		"requests:NaN|c", "queue.size:Inf|g", "queue.size:+Inf|g", "latency:-Inf|ms", "requests:1e400|c", "latency:1|ms|#le:1"} {
+		_, err := ParseLine(line)
+		require.ErrorIs(t, err, ErrInvalidLine, line)
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+)
+
+// the row is created beforehand, so the concurrent merges of the new histogram wait for each other on SELECT FOR UPDATE
+var ensureHistogramSQL = `
+	INSERT INTO metric (name, type, labels) 
+	VALUES ($1, $2, $3)
+	ON CONFLICT (name, type, labels) DO NOTHING
+`
+var selectHistogramForUpdateSQL = `
+	SELECT histogram
+	FROM metric
+	WHERE type = $1 AND name = $2 AND labels = $3
+	FOR UPDATE
+`
+var updateHistogramSQL = `
+	UPDATE metric
+	SET histogram = $4
+	WHERE type = $1 AND name = $2 AND labels = $3
+`
+
+// MergeHistogram merges the histogram with the stored one. The histograms are stored as JSON,
+// so they are merged by the application within the transaction which locks the row.
+func (d *DBStorage) MergeHistogram(metric handlers.HistogramMetric) (utils.Histogram, error) {
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+	defer tx.Rollback()
+
+	histogram, err := writeHistogram(ctx, tx, metric, true)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return utils.Histogram{}, err
+	}
+
+	return histogram, d.notifyObservers(AfterUpsertEvent{
+		Event{handlers.HistogramMetric{Name: metric.Name, Value: histogram.Clone(), Labels: metric.Labels}},
+	})
+}
+
+// writeHistogram replaces the stored histogram or merges with it if isMerge is set. It returns the stored histogram.
+func writeHistogram(ctx context.Context, tx *sql.Tx, metric handlers.HistogramMetric, isMerge bool) (utils.Histogram, error) {
+	labels, err := labelsToDB(metric.Labels)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+
+	if _, err = tx.ExecContext(ctx, ensureHistogramSQL, metric.Name, handlers.MetricTypeHistogram, labels); err != nil {
+		return utils.Histogram{}, err
+	}
+
+	histogram := metric.Value.Clone()
+	if isMerge {
+		var stored sql.NullString
+		err = tx.QueryRowContext(ctx, selectHistogramForUpdateSQL, handlers.MetricTypeHistogram, metric.Name, labels).Scan(&stored)
+		if err != nil {
+			return utils.Histogram{}, err
+		}
+		if stored.Valid {
+			var storedHistogram utils.Histogram
+			if err = json.Unmarshal([]byte(stored.String), &storedHistogram); err != nil {
+				return utils.Histogram{}, err
+			}
+			if err = storedHistogram.Merge(metric.Value); err != nil {
+				return utils.Histogram{}, err
+			}
+			histogram = storedHistogram
+		}
+	}
+
+	data, err := json.Marshal(histogram)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+	if _, err = tx.ExecContext(ctx, updateHistogramSQL, handlers.MetricTypeHistogram, metric.Name, labels, string(data)); err != nil {
+		return utils.Histogram{}, err
+	}
+
+	return histogram, nil
+}
+
+func (d *DBStorage) GetHistogram(name string, labels handlers.Labels) (utils.Histogram, error) {
+	labelsValue, err := labelsToDB(labels)
+	if err != nil {
+		return utils.Histogram{}, err
+	}
+
+	getOneSQL := `
+		SELECT histogram
+		FROM metric
+		WHERE type = $1 AND name = $2 AND labels = $3 AND histogram IS NOT NULL
+	`
+	var data string
+	err = d.db.QueryRow(getOneSQL, handlers.MetricTypeHistogram, name, labelsValue).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return utils.Histogram{}, handlers.ErrMetricNotFound
+		}
+		return utils.Histogram{}, err
+	}
+
+	var histogram utils.Histogram
+	err = json.Unmarshal([]byte(data), &histogram)
+
+	return histogram, err
+}
+
+func (d *DBStorage) GetAllHistograms() (metrics []handlers.HistogramMetric, err error) {
+	getAllSQL := `
+		SELECT name, histogram, labels
+		FROM metric
+		WHERE type = $1 AND histogram IS NOT NULL
+	`
+	rows, err := d.db.Query(getAllSQL, handlers.MetricTypeHistogram)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m handlers.HistogramMetric
+		var data, labels string
+		err = rows.Scan(&m.Name, &data, &labels)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &m.Value); err != nil {
+			return nil, err
+		}
+		m.Labels, err = labelsFromDB(labels)
+		if err != nil {
+			return nil, err
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, err
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"time"
+)
+
+// EnableRollups makes the storage aggregate the metrics with the given resolutions in the metric_rollup table.
+func (d *DBStorage) EnableRollups(policies []RollupPolicy) error {
+	_, err := d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS metric_rollup (name varchar(255) NOT NULL, type varchar(255) NOT NULL, labels TEXT NOT NULL DEFAULT '', resolution BIGINT NOT NULL, bucket_start TIMESTAMP WITH TIME ZONE NOT NULL, count BIGINT NOT NULL, min DOUBLE PRECISION, max DOUBLE PRECISION, sum DOUBLE PRECISION, last DOUBLE PRECISION, delta BIGINT, PRIMARY KEY(name, type, labels, resolution, bucket_start));
+	`)
+	if err != nil {
+		return err
+	}
+
+	counters, err := d.GetAllCounters()
+	if err != nil {
+		return err
+	}
+
+	d.rollupPolicies = policies
+	d.AddObserver(newRollupObserver(counters, d.addToRollups))
+
+	return nil
+}
+
+var upsertRollupSQL = `
+	INSERT INTO metric_rollup (name, type, labels, resolution, bucket_start, count, min, max, sum, last, delta)
+	VALUES ($1, $2, $3, $4, $5, 1, $6, $6, $6, $6, $7)
+	ON CONFLICT (name, type, labels, resolution, bucket_start) DO UPDATE
+		SET count = metric_rollup.count + 1,
+			min = LEAST(metric_rollup.min, EXCLUDED.min),
+			max = GREATEST(metric_rollup.max, EXCLUDED.max),
+			sum = metric_rollup.sum + EXCLUDED.sum,
+			last = EXCLUDED.last,
+			delta = metric_rollup.delta + EXCLUDED.delta
+`
+
+func (d *DBStorage) addToRollups(sample rollupSample) error {
+	var value, delta interface{}
+	if sample.metricType == handlers.MetricTypeCounter {
+		delta = sample.delta
+	} else {
+		value = sample.value
+	}
+
+	labels, err := labelsToDB(sample.labels)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range d.rollupPolicies {
+		start := sample.at.UTC().Truncate(policy.Resolution)
+		_, err := d.db.Exec(upsertRollupSQL, sample.name, sample.metricType, labels, int64(policy.Resolution/time.Second), start, value, delta)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DBStorage) GetRollups(ctx context.Context, metricType string, name string, labels handlers.Labels, resolution time.Duration, from time.Time, to time.Time) (points []handlers.RollupPoint, err error) {
+	if d.rollupPolicies == nil {
+		return nil, handlers.ErrRollupsDisabled
+	}
+	if _, ok := findRollupPolicy(d.rollupPolicies, resolution); !ok {
+		return nil, handlers.ErrUnknownResolution
+	}
+
+	labelsValue, err := labelsToDB(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	getRollupsSQL := `
+		SELECT bucket_start, count, min, max, sum, last, delta
+		FROM metric_rollup
+		WHERE type = $1 AND name = $2 AND labels = $3 AND resolution = $4 AND bucket_start BETWEEN $5 AND $6
+		ORDER BY bucket_start
+	`
+	rows, err := d.db.QueryContext(ctx, getRollupsSQL, metricType, name, labelsValue, int64(resolution/time.Second), from.Truncate(resolution), to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket rollupBucket
+		var min, max, sum, last sql.NullFloat64
+		var delta sql.NullInt64
+		err = rows.Scan(&bucket.Start, &bucket.Count, &min, &max, &sum, &last, &delta)
+		if err != nil {
+			return nil, err
+		}
+		bucket.Min, bucket.Max, bucket.Sum, bucket.Last = min.Float64, max.Float64, sum.Float64, last.Float64
+		bucket.Delta = delta.Int64
+
+		points = append(points, bucket.toPoint(metricType))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// CleanupRollups removes the aggregates which are older than the retention of their resolution.
+func (d *DBStorage) CleanupRollups(ctx context.Context, now time.Time) error {
+	if d.rollupPolicies == nil {
+		return handlers.ErrRollupsDisabled
+	}
+
+	for _, policy := range d.rollupPolicies {
+		_, err := d.db.ExecContext(
+			ctx,
+			"DELETE FROM metric_rollup WHERE resolution = $1 AND bucket_start < $2",
+			int64(policy.Resolution/time.Second),
+			now.Add(-policy.Retention),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"github.com/smamykin/smetrics/internal/server/handlers"
 	"time"
@@ -15,8 +16,10 @@ func NewDBStorage(db *sql.DB) (*DBStorage, error) {
 }
 
 type DBStorage struct {
-	db        *sql.DB
-	observers []Observer
+	db               *sql.DB
+	observers        []Observer
+	isHistoryEnabled bool
+	rollupPolicies   []RollupPolicy
 }
 
 func (d *DBStorage) init() error {
@@ -27,12 +30,19 @@ func (d *DBStorage) init() error {
 		return err
 	}
 	if isTableExists {
-		return nil
+		// the table might be created before the labels and the histograms were introduced
+		_, err = d.db.Exec(`
+			ALTER TABLE metric ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '';
+			ALTER TABLE metric ADD COLUMN IF NOT EXISTS histogram TEXT;
+			DROP INDEX IF EXISTS name_type_unique;
+			CREATE UNIQUE INDEX IF NOT EXISTS name_type_labels_unique ON metric (name, type, labels);
+		`)
+		return err
 	}
 
 	_, err = d.db.Exec(`
-		CREATE TABLE metric (id SERIAL, name varchar(255) NOT NULL, type varchar(255) NOT NULL, value DOUBLE PRECISION, delta BIGINT, PRIMARY KEY(id));
-		CREATE UNIQUE INDEX name_type_unique ON metric (name, type);
+		CREATE TABLE metric (id SERIAL, name varchar(255) NOT NULL, type varchar(255) NOT NULL, labels TEXT NOT NULL DEFAULT '', value DOUBLE PRECISION, delta BIGINT, histogram TEXT, PRIMARY KEY(id));
+		CREATE UNIQUE INDEX name_type_labels_unique ON metric (name, type, labels);
 	`)
 
 	if err != nil {
@@ -42,22 +52,106 @@ func (d *DBStorage) init() error {
 	return nil
 }
 
+// EnableHistory makes the storage record every update of the metrics to the metric_sample table.
+func (d *DBStorage) EnableHistory() error {
+	_, err := d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS metric_sample (id BIGSERIAL, name varchar(255) NOT NULL, type varchar(255) NOT NULL, labels TEXT NOT NULL DEFAULT '', value DOUBLE PRECISION, delta BIGINT, created_at TIMESTAMP WITH TIME ZONE NOT NULL, PRIMARY KEY(id));
+		CREATE INDEX IF NOT EXISTS metric_sample_name_type_created_at ON metric_sample (name, type, labels, created_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	d.isHistoryEnabled = true
+
+	return nil
+}
+
 var upsertCounterSQL = `
-	INSERT INTO metric (name, type, delta) 
-	VALUES ($1, $2, $3)
-	ON CONFLICT (name, type) DO UPDATE 
+	INSERT INTO metric (name, type, delta, labels) 
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (name, type, labels) DO UPDATE 
 		SET delta = EXCLUDED.delta
+	RETURNING delta
+`
+var incrementCounterSQL = `
+	INSERT INTO metric (name, type, delta, labels) 
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (name, type, labels) DO UPDATE 
+		SET delta = metric.delta + EXCLUDED.delta
+	RETURNING delta
 `
 var upsertGaugeSQL = `
-	INSERT INTO metric (name, type, value) 
-	VALUES ($1, $2, $3)
-	ON CONFLICT (name, type) DO UPDATE 
+	INSERT INTO metric (name, type, value, labels) 
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (name, type, labels) DO UPDATE 
 		SET value = EXCLUDED.value
 `
+var incrementGaugeSQL = `
+	INSERT INTO metric (name, type, value, labels) 
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (name, type, labels) DO UPDATE 
+		SET value = metric.value + EXCLUDED.value
+	RETURNING value
+`
+var insertSampleSQL = `
+	INSERT INTO metric_sample (name, type, value, delta, created_at, labels) 
+	VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+// labelsToDB converts the labels to the JSON with the sorted keys. The metrics without labels have the empty string.
+func labelsToDB(labels handlers.Labels) (string, error) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+
+	data, err := json.Marshal(labels)
+
+	return string(data), err
+}
+
+func labelsFromDB(value string) (handlers.Labels, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var labels handlers.Labels
+	err := json.Unmarshal([]byte(value), &labels)
+
+	return labels, err
+}
+
+// inTx runs f in the transaction, so the sample of the history is recorded together with the value of the metric
+func (d *DBStorage) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
 func (d *DBStorage) UpsertGauge(metric handlers.GaugeMetric) error {
-	_, err := d.db.Exec(upsertGaugeSQL, metric.Name, handlers.MetricTypeGauge, metric.Value)
+	labels, err := labelsToDB(metric.Labels)
+	if err != nil {
+		return err
+	}
 
+	err = d.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(upsertGaugeSQL, metric.Name, handlers.MetricTypeGauge, metric.Value, labels); err != nil {
+			return err
+		}
+		if d.isHistoryEnabled {
+			_, err := tx.Exec(insertSampleSQL, metric.Name, handlers.MetricTypeGauge, metric.Value, nil, time.Now(), labels)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -68,7 +162,21 @@ func (d *DBStorage) UpsertGauge(metric handlers.GaugeMetric) error {
 }
 
 func (d *DBStorage) UpsertCounter(metric handlers.CounterMetric) error {
-	_, err := d.db.Exec(upsertCounterSQL, metric.Name, handlers.MetricTypeCounter, metric.Value)
+	labels, err := labelsToDB(metric.Labels)
+	if err != nil {
+		return err
+	}
+
+	err = d.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(upsertCounterSQL, metric.Name, handlers.MetricTypeCounter, metric.Value, labels); err != nil {
+			return err
+		}
+		if d.isHistoryEnabled {
+			_, err := tx.Exec(insertSampleSQL, metric.Name, handlers.MetricTypeCounter, nil, metric.Value, time.Now(), labels)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -78,18 +186,49 @@ func (d *DBStorage) UpsertCounter(metric handlers.CounterMetric) error {
 	})
 }
 
-func (d *DBStorage) GetGauge(name string) (float64, error) {
+func (d *DBStorage) IncrementCounter(metric handlers.CounterMetric) (int64, error) {
+	labels, err := labelsToDB(metric.Labels)
+	if err != nil {
+		return 0, err
+	}
+
+	var value int64
+	err = d.inTx(func(tx *sql.Tx) error {
+		if err := tx.QueryRow(incrementCounterSQL, metric.Name, handlers.MetricTypeCounter, metric.Value, labels).Scan(&value); err != nil {
+			return err
+		}
+		if d.isHistoryEnabled {
+			_, err := tx.Exec(insertSampleSQL, metric.Name, handlers.MetricTypeCounter, nil, value, time.Now(), labels)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return value, d.notifyObservers(AfterUpsertEvent{
+		Event{handlers.CounterMetric{Name: metric.Name, Value: value, Labels: metric.Labels}},
+	})
+}
+
+func (d *DBStorage) GetGauge(name string, labels handlers.Labels) (float64, error) {
+	labelsValue, err := labelsToDB(labels)
+	if err != nil {
+		return 0, err
+	}
+
 	getOneSQL := `
 		SELECT value
 		FROM metric
-		WHERE type = $1 AND name = $2
+		WHERE type = $1 AND name = $2 AND labels = $3
 	`
-	row := d.db.QueryRow(getOneSQL, handlers.MetricTypeGauge, name)
+	row := d.db.QueryRow(getOneSQL, handlers.MetricTypeGauge, name, labelsValue)
 	if row.Err() != nil {
 		return 0, row.Err()
 	}
 	var gauge float64
-	err := row.Scan(&gauge)
+	err = row.Scan(&gauge)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return 0, handlers.ErrMetricNotFound
@@ -100,18 +239,23 @@ func (d *DBStorage) GetGauge(name string) (float64, error) {
 	return gauge, nil
 }
 
-func (d *DBStorage) GetCounter(name string) (int64, error) {
+func (d *DBStorage) GetCounter(name string, labels handlers.Labels) (int64, error) {
+	labelsValue, err := labelsToDB(labels)
+	if err != nil {
+		return 0, err
+	}
+
 	getOneSQL := `
 		SELECT delta
 		FROM metric
-		WHERE type = $1 AND name = $2
+		WHERE type = $1 AND name = $2 AND labels = $3
 	`
-	row := d.db.QueryRow(getOneSQL, handlers.MetricTypeCounter, name)
+	row := d.db.QueryRow(getOneSQL, handlers.MetricTypeCounter, name, labelsValue)
 	if row.Err() != nil {
 		return 0, row.Err()
 	}
 	var counter int64
-	err := row.Scan(&counter)
+	err = row.Scan(&counter)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return 0, handlers.ErrMetricNotFound
@@ -124,7 +268,7 @@ func (d *DBStorage) GetCounter(name string) (int64, error) {
 
 func (d *DBStorage) GetAllGauge() (metrics []handlers.GaugeMetric, err error) {
 	getAllSQL := `
-		SELECT name, value
+		SELECT name, value, labels
 		FROM metric
 		WHERE type = $1
 	`
@@ -136,7 +280,12 @@ func (d *DBStorage) GetAllGauge() (metrics []handlers.GaugeMetric, err error) {
 
 	for rows.Next() {
 		var m handlers.GaugeMetric
-		err = rows.Scan(&m.Name, &m.Value)
+		var labels string
+		err = rows.Scan(&m.Name, &m.Value, &labels)
+		if err != nil {
+			return nil, err
+		}
+		m.Labels, err = labelsFromDB(labels)
 		if err != nil {
 			return nil, err
 		}
@@ -154,7 +303,7 @@ func (d *DBStorage) GetAllGauge() (metrics []handlers.GaugeMetric, err error) {
 
 func (d *DBStorage) GetAllCounters() (metrics []handlers.CounterMetric, err error) {
 	getAllSQL := `
-		SELECT name, delta
+		SELECT name, delta, labels
 		FROM metric
 		WHERE type = $1
 	`
@@ -166,7 +315,12 @@ func (d *DBStorage) GetAllCounters() (metrics []handlers.CounterMetric, err erro
 
 	for rows.Next() {
 		var m handlers.CounterMetric
-		err = rows.Scan(&m.Name, &m.Value)
+		var labels string
+		err = rows.Scan(&m.Name, &m.Value, &labels)
+		if err != nil {
+			return nil, err
+		}
+		m.Labels, err = labelsFromDB(labels)
 		if err != nil {
 			return nil, err
 		}
@@ -183,6 +337,20 @@ func (d *DBStorage) GetAllCounters() (metrics []handlers.CounterMetric, err erro
 }
 
 func (d *DBStorage) UpsertMany(ctx context.Context, metrics []interface{}) error {
+	return d.execMany(ctx, metrics, false)
+}
+
+func (d *DBStorage) IncrementMany(ctx context.Context, metrics []interface{}) error {
+	return d.execMany(ctx, metrics, true)
+}
+
+// execMany writes the metrics in one transaction. If isIncrement is set, the counters are incremented
+// and the histograms are merged, otherwise they are replaced. GaugeIncrement and CounterIncrement are always added.
+func (d *DBStorage) execMany(ctx context.Context, metrics []interface{}, isIncrement bool) error {
+	counterSQL := upsertCounterSQL
+	if isIncrement {
+		counterSQL = incrementCounterSQL
+	}
 
 	// шаг 1 — объявляем транзакцию
 	tx, err := d.db.Begin()
@@ -198,23 +366,96 @@ func (d *DBStorage) UpsertMany(ctx context.Context, metrics []interface{}) error
 		return err
 	}
 	defer stmtGauge.Close()
-	stmtCounter, err := tx.PrepareContext(ctx, upsertCounterSQL)
+	stmtCounter, err := tx.PrepareContext(ctx, counterSQL)
 	if err != nil {
 		return err
 	}
 	defer stmtCounter.Close()
+	var stmtSample *sql.Stmt
+	if d.isHistoryEnabled {
+		stmtSample, err = tx.PrepareContext(ctx, insertSampleSQL)
+		if err != nil {
+			return err
+		}
+		defer stmtSample.Close()
+	}
+
+	now := time.Now()
+	// the observers get the actual values of the metrics, not the increments
+	upserted := make([]interface{}, 0, len(metrics))
 
 	// шаг 3 — указываем, что каждое видео будет добавлено в транзакцию
 	for _, metric := range metrics {
 		switch metric := metric.(type) {
 		case handlers.GaugeMetric:
-			if _, err = stmtGauge.ExecContext(ctx, metric.Name, handlers.MetricTypeGauge, metric.Value); err != nil {
+			labels, err := labelsToDB(metric.Labels)
+			if err != nil {
+				return err
+			}
+			if _, err = stmtGauge.ExecContext(ctx, metric.Name, handlers.MetricTypeGauge, metric.Value, labels); err != nil {
+				return err
+			}
+			upserted = append(upserted, metric)
+			if !d.isHistoryEnabled {
+				continue
+			}
+			if _, err = stmtSample.ExecContext(ctx, metric.Name, handlers.MetricTypeGauge, metric.Value, nil, now, labels); err != nil {
 				return err
 			}
 		case handlers.CounterMetric:
-			if _, err = stmtCounter.ExecContext(ctx, metric.Name, handlers.MetricTypeCounter, metric.Value); err != nil {
+			labels, err := labelsToDB(metric.Labels)
+			if err != nil {
+				return err
+			}
+			var value int64
+			if err = stmtCounter.QueryRowContext(ctx, metric.Name, handlers.MetricTypeCounter, metric.Value, labels).Scan(&value); err != nil {
+				return err
+			}
+			upserted = append(upserted, handlers.CounterMetric{Name: metric.Name, Value: value, Labels: metric.Labels})
+			if !d.isHistoryEnabled {
+				continue
+			}
+			if _, err = stmtSample.ExecContext(ctx, metric.Name, handlers.MetricTypeCounter, nil, value, now, labels); err != nil {
+				return err
+			}
+		case handlers.GaugeIncrement:
+			labels, err := labelsToDB(metric.Labels)
+			if err != nil {
+				return err
+			}
+			var value float64
+			if err = tx.QueryRowContext(ctx, incrementGaugeSQL, metric.Name, handlers.MetricTypeGauge, metric.Value, labels).Scan(&value); err != nil {
+				return err
+			}
+			upserted = append(upserted, handlers.GaugeMetric{Name: metric.Name, Value: value, Labels: metric.Labels})
+			if !d.isHistoryEnabled {
+				continue
+			}
+			if _, err = stmtSample.ExecContext(ctx, metric.Name, handlers.MetricTypeGauge, value, nil, now, labels); err != nil {
 				return err
 			}
+		case handlers.CounterIncrement:
+			labels, err := labelsToDB(metric.Labels)
+			if err != nil {
+				return err
+			}
+			var value int64
+			if err = tx.QueryRowContext(ctx, incrementCounterSQL, metric.Name, handlers.MetricTypeCounter, metric.Value, labels).Scan(&value); err != nil {
+				return err
+			}
+			upserted = append(upserted, handlers.CounterMetric{Name: metric.Name, Value: value, Labels: metric.Labels})
+			if !d.isHistoryEnabled {
+				continue
+			}
+			if _, err = stmtSample.ExecContext(ctx, metric.Name, handlers.MetricTypeCounter, nil, value, now, labels); err != nil {
+				return err
+			}
+		case handlers.HistogramMetric:
+			histogram, err := writeHistogram(ctx, tx, metric, isIncrement)
+			if err != nil {
+				return err
+			}
+			upserted = append(upserted, handlers.HistogramMetric{Name: metric.Name, Value: histogram, Labels: metric.Labels})
 		default:
 			return errors.New("unknown metric type")
 		}
@@ -227,10 +468,58 @@ func (d *DBStorage) UpsertMany(ctx context.Context, metrics []interface{}) error
 	}
 
 	return d.notifyObservers(AfterUpsertEvent{
-		Event{metrics},
+		Event{upserted},
 	})
 }
 
+func (d *DBStorage) GetRange(ctx context.Context, metricType string, name string, labels handlers.Labels, from time.Time, to time.Time) (samples []handlers.Sample, err error) {
+	if !d.isHistoryEnabled {
+		return nil, handlers.ErrHistoryDisabled
+	}
+
+	labelsValue, err := labelsToDB(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	getRangeSQL := `
+		SELECT value, delta, created_at
+		FROM metric_sample
+		WHERE type = $1 AND name = $2 AND labels = $3 AND created_at BETWEEN $4 AND $5
+		ORDER BY created_at, id
+	`
+	rows, err := d.db.QueryContext(ctx, getRangeSQL, metricType, name, labelsValue, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sample handlers.Sample
+		var value sql.NullFloat64
+		var delta sql.NullInt64
+		err = rows.Scan(&value, &delta, &sample.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			sample.Value = &value.Float64
+		}
+		if delta.Valid {
+			sample.Delta = &delta.Int64
+		}
+
+		samples = append(samples, sample)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
 func (d *DBStorage) AddObserver(o Observer) {
 	d.observers = append(d.observers, o)
 }
@@ -6,9 +6,11 @@ import (
 	"database/sql"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
 	"github.com/stretchr/testify/require"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDBStorage_GetAllCounters(t *testing.T) {
@@ -64,11 +66,11 @@ func TestDBStorage_GetCounter(t *testing.T) {
 	require.Nil(t, err)
 	prepareDBBeforeTest(db, t)
 
-	counter, err := dbStorage.GetCounter("metric-a")
+	counter, err := dbStorage.GetCounter("metric-a", nil)
 	require.Nil(t, err)
 	require.Equal(t, int64(11), counter)
 
-	_, err = dbStorage.GetCounter("metric-non-existed")
+	_, err = dbStorage.GetCounter("metric-non-existed", nil)
 	require.NotNil(t, err)
 	require.Equal(t, handlers.ErrMetricNotFound, err)
 }
@@ -84,11 +86,11 @@ func TestDBStorage_GetGauge(t *testing.T) {
 	require.Nil(t, err)
 	prepareDBBeforeTest(db, t)
 
-	counter, err := dbStorage.GetGauge("metric-c")
+	counter, err := dbStorage.GetGauge("metric-c", nil)
 	require.Nil(t, err)
 	require.Equal(t, 33.44, counter)
 
-	_, err = dbStorage.GetGauge("metric-non-existed")
+	_, err = dbStorage.GetGauge("metric-non-existed", nil)
 	require.NotNil(t, err)
 	require.Equal(t, handlers.ErrMetricNotFound, err)
 }
@@ -109,7 +111,7 @@ func TestDBStorage_UpsertCounter(t *testing.T) {
 	err = dbStorage.UpsertCounter(metric)
 	require.Nil(t, err)
 
-	actual, err := dbStorage.GetCounter("metric-z")
+	actual, err := dbStorage.GetCounter("metric-z", nil)
 	require.Nil(t, err)
 	require.Equal(t, metric.Value, actual)
 
@@ -118,7 +120,7 @@ func TestDBStorage_UpsertCounter(t *testing.T) {
 	err = dbStorage.UpsertCounter(metric)
 	require.Nil(t, err)
 
-	actual, err = dbStorage.GetCounter("metric-z")
+	actual, err = dbStorage.GetCounter("metric-z", nil)
 	require.Nil(t, err)
 	require.Equal(t, metric.Value, actual)
 
@@ -140,7 +142,7 @@ func TestDBStorage_UpsertGauge(t *testing.T) {
 	err = dbStorage.UpsertGauge(metric)
 	require.Nil(t, err)
 
-	actual, err := dbStorage.GetGauge("metric-z")
+	actual, err := dbStorage.GetGauge("metric-z", nil)
 	require.Nil(t, err)
 	require.Equal(t, metric.Value, actual)
 
@@ -149,7 +151,7 @@ func TestDBStorage_UpsertGauge(t *testing.T) {
 	err = dbStorage.UpsertGauge(metric)
 	require.Nil(t, err)
 
-	actual, err = dbStorage.GetGauge("metric-z")
+	actual, err = dbStorage.GetGauge("metric-z", nil)
 	require.Nil(t, err)
 	require.Equal(t, metric.Value, actual)
 
@@ -172,10 +174,10 @@ func TestDBStorage_UpsertMany(t *testing.T) {
 	err = dbStorage.UpsertMany(context.Background(), metrics)
 	require.Nil(t, err)
 
-	actualGauge, err := dbStorage.GetGauge("metric-z")
+	actualGauge, err := dbStorage.GetGauge("metric-z", nil)
 	require.Nil(t, err)
 	require.Equal(t, metricGauge.Value, actualGauge)
-	actualCounter, err := dbStorage.GetCounter("metric-y")
+	actualCounter, err := dbStorage.GetCounter("metric-y", nil)
 	require.Nil(t, err)
 	require.Equal(t, metricCounter.Value, actualCounter)
 
@@ -186,14 +188,221 @@ func TestDBStorage_UpsertMany(t *testing.T) {
 	err = dbStorage.UpsertMany(context.Background(), metrics)
 	require.Nil(t, err)
 
-	actualGauge, err = dbStorage.GetGauge("metric-z")
+	actualGauge, err = dbStorage.GetGauge("metric-z", nil)
 	require.Nil(t, err)
 	require.Equal(t, metricGauge.Value, actualGauge)
-	actualCounter, err = dbStorage.GetCounter("metric-y")
+	actualCounter, err = dbStorage.GetCounter("metric-y", nil)
 	require.Nil(t, err)
 	require.Equal(t, metricCounter.Value, actualCounter)
 }
 
+func TestDBStorage_IncrementCounter(t *testing.T) {
+	skipIfNoDatabaseURL(t)
+
+	db, err := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	dbStorage, err := NewDBStorage(db)
+	require.Nil(t, err)
+	prepareDBBeforeTest(db, t)
+
+	//insert
+	actual, err := dbStorage.IncrementCounter(handlers.CounterMetric{Name: "metric-z", Value: 222})
+	require.Nil(t, err)
+	require.Equal(t, int64(222), actual)
+
+	//update
+	actual, err = dbStorage.IncrementCounter(handlers.CounterMetric{Name: "metric-z", Value: 111})
+	require.Nil(t, err)
+	require.Equal(t, int64(333), actual)
+
+	actual, err = dbStorage.GetCounter("metric-z", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(333), actual)
+}
+
+func TestDBStorage_IncrementMany(t *testing.T) {
+	skipIfNoDatabaseURL(t)
+
+	db, err := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	dbStorage, err := NewDBStorage(db)
+	require.Nil(t, err)
+	prepareDBBeforeTest(db, t)
+
+	metrics := []interface{}{
+		handlers.GaugeMetric{Name: "metric-c", Value: 444.555},
+		handlers.CounterMetric{Name: "metric-a", Value: 100},
+		handlers.CounterMetric{Name: "metric-y", Value: 7},
+	}
+	err = dbStorage.IncrementMany(context.Background(), metrics)
+	require.Nil(t, err)
+
+	actualGauge, err := dbStorage.GetGauge("metric-c", nil)
+	require.Nil(t, err)
+	require.Equal(t, 444.555, actualGauge)
+	actualCounter, err := dbStorage.GetCounter("metric-a", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(111), actualCounter)
+	actualCounter, err = dbStorage.GetCounter("metric-y", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(7), actualCounter)
+}
+
+func TestDBStorage_UpsertMany_Increments(t *testing.T) {
+	skipIfNoDatabaseURL(t)
+
+	db, err := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	dbStorage, err := NewDBStorage(db)
+	require.Nil(t, err)
+	prepareDBBeforeTest(db, t)
+
+	metrics := []interface{}{
+		handlers.CounterMetric{Name: "metric-b", Value: 5},
+		handlers.CounterIncrement{Name: "metric-a", Value: 100},
+		handlers.GaugeIncrement{Name: "metric-c", Value: 1.5},
+		handlers.GaugeIncrement{Name: "metric-z", Value: 2},
+	}
+	err = dbStorage.UpsertMany(context.Background(), metrics)
+	require.Nil(t, err)
+
+	actualCounter, err := dbStorage.GetCounter("metric-a", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(111), actualCounter)
+	actualCounter, err = dbStorage.GetCounter("metric-b", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), actualCounter)
+	actualGauge, err := dbStorage.GetGauge("metric-c", nil)
+	require.Nil(t, err)
+	require.InDelta(t, 34.94, actualGauge, 1e-9)
+	actualGauge, err = dbStorage.GetGauge("metric-z", nil)
+	require.Nil(t, err)
+	require.Equal(t, 2.0, actualGauge)
+}
+
+func TestDBStorage_MergeHistogram(t *testing.T) {
+	skipIfNoDatabaseURL(t)
+
+	db, err := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	dbStorage, err := NewDBStorage(db)
+	require.Nil(t, err)
+	prepareDBBeforeTest(db, t)
+
+	histogram, err := utils.NewHistogram([]float64{1, 2})
+	require.Nil(t, err)
+	histogram.Observe(0.5)
+
+	//insert
+	_, err = dbStorage.MergeHistogram(handlers.HistogramMetric{Name: "latency", Value: histogram})
+	require.Nil(t, err)
+
+	//merge
+	err = dbStorage.IncrementMany(context.Background(), []interface{}{
+		handlers.HistogramMetric{Name: "latency", Value: histogram},
+	})
+	require.Nil(t, err)
+
+	actual, err := dbStorage.GetHistogram("latency", nil)
+	require.Nil(t, err)
+	require.Equal(t, []int64{2, 0, 0}, actual.Counts)
+	require.Equal(t, int64(2), actual.Count)
+
+	other, err := utils.NewHistogram([]float64{5})
+	require.Nil(t, err)
+	_, err = dbStorage.MergeHistogram(handlers.HistogramMetric{Name: "latency", Value: other})
+	require.ErrorIs(t, err, utils.ErrHistogramBoundsMismatch)
+
+	all, err := dbStorage.GetAllHistograms()
+	require.Nil(t, err)
+	require.Equal(t, []handlers.HistogramMetric{{Name: "latency", Value: actual}}, all)
+}
+
+func TestDBStorage_GetRange(t *testing.T) {
+	skipIfNoDatabaseURL(t)
+
+	db, err := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	dbStorage, err := NewDBStorage(db)
+	require.Nil(t, err)
+	prepareDBBeforeTest(db, t)
+
+	_, err = dbStorage.GetRange(context.Background(), handlers.MetricTypeGauge, "metric-z", nil, time.Time{}, time.Now())
+	require.Equal(t, handlers.ErrHistoryDisabled, err)
+
+	require.Nil(t, dbStorage.EnableHistory())
+	_, err = db.Exec("TRUNCATE TABLE metric_sample")
+	require.Nil(t, err)
+
+	from := time.Now()
+	require.Nil(t, dbStorage.UpsertGauge(handlers.GaugeMetric{Name: "metric-z", Value: 1.5}))
+	require.Nil(t, dbStorage.IncrementMany(context.Background(), []interface{}{
+		handlers.GaugeMetric{Name: "metric-z", Value: 2.5},
+		handlers.CounterMetric{Name: "metric-a", Value: 1},
+	}))
+
+	samples, err := dbStorage.GetRange(context.Background(), handlers.MetricTypeGauge, "metric-z", nil, from, time.Now())
+	require.Nil(t, err)
+	require.Len(t, samples, 2)
+	require.Equal(t, 1.5, *samples[0].Value)
+	require.Equal(t, 2.5, *samples[1].Value)
+
+	samples, err = dbStorage.GetRange(context.Background(), handlers.MetricTypeCounter, "metric-a", nil, from, time.Now())
+	require.Nil(t, err)
+	require.Len(t, samples, 1)
+	require.Equal(t, int64(12), *samples[0].Delta)
+}
+
+func TestDBStorage_Rollups(t *testing.T) {
+	skipIfNoDatabaseURL(t)
+
+	db, err := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	dbStorage, err := NewDBStorage(db)
+	require.Nil(t, err)
+	prepareDBBeforeTest(db, t)
+
+	require.Nil(t, dbStorage.EnableRollups([]RollupPolicy{{Resolution: time.Hour, Retention: 24 * time.Hour}}))
+	_, err = db.Exec("TRUNCATE TABLE metric_rollup")
+	require.Nil(t, err)
+
+	from := time.Now()
+	require.Nil(t, dbStorage.UpsertGauge(handlers.GaugeMetric{Name: "metric-z", Value: 1}))
+	require.Nil(t, dbStorage.IncrementMany(context.Background(), []interface{}{
+		handlers.GaugeMetric{Name: "metric-z", Value: 3},
+		handlers.CounterMetric{Name: "metric-a", Value: 5},
+	}))
+
+	points, err := dbStorage.GetRollups(context.Background(), handlers.MetricTypeGauge, "metric-z", nil, time.Hour, from, time.Now())
+	require.Nil(t, err)
+	require.Len(t, points, 1)
+	require.Equal(t, int64(2), points[0].Count)
+	require.Equal(t, 2.0, *points[0].Avg)
+	require.Equal(t, 3.0, *points[0].Last)
+
+	points, err = dbStorage.GetRollups(context.Background(), handlers.MetricTypeCounter, "metric-a", nil, time.Hour, from, time.Now())
+	require.Nil(t, err)
+	require.Len(t, points, 1)
+	require.Equal(t, int64(5), *points[0].Delta)
+
+	require.Nil(t, dbStorage.CleanupRollups(context.Background(), time.Now().Add(48*time.Hour)))
+	points, err = dbStorage.GetRollups(context.Background(), handlers.MetricTypeCounter, "metric-a", nil, time.Hour, from, time.Now())
+	require.Nil(t, err)
+	require.Empty(t, points)
+}
+
 func TestDBStorage_init(t *testing.T) {
 	skipIfNoDatabaseURL(t)
 
@@ -204,7 +413,7 @@ func TestDBStorage_init(t *testing.T) {
 	defer db.Close()
 	dropTableIfExists(db, t)
 
-	dbStorage := DBStorage{db, nil}
+	dbStorage := DBStorage{db: db}
 	err = dbStorage.init()
 	if err != nil {
 		t.Error(err)
@@ -212,7 +421,7 @@ func TestDBStorage_init(t *testing.T) {
 	assertTableExist(db, t)
 
 	//second run, table already exists
-	dbStorage = DBStorage{db, nil}
+	dbStorage = DBStorage{db: db}
 	err = dbStorage.init()
 	if err != nil {
 		t.Error(err)
@@ -5,6 +5,7 @@ import (
 	"github.com/smamykin/smetrics/internal/server/handlers"
 	"io"
 	"os"
+	"sync"
 )
 
 func newFsPersister(fileName string) (*fsPersister, error) {
@@ -19,13 +20,17 @@ func newFsPersister(fileName string) (*fsPersister, error) {
 }
 
 type fsPersister struct {
+	mu   sync.Mutex
 	file *os.File
 }
 
 func (f *fsPersister) flush(memStorage *MemStorage) (err error) {
-	dump := memStorageDump{
-		GaugeStore:   memStorage.GaugeStore(),
-		CounterStore: memStorage.CounterStore(),
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dump := memStorage.snapshot()
+	if memStorage.rollups != nil {
+		dump.Rollups = memStorage.rollups.dump()
 	}
 
 	data, err := json.MarshalIndent(dump, "", "  ")
@@ -46,7 +51,21 @@ func (f *fsPersister) flush(memStorage *MemStorage) (err error) {
 	return err
 }
 
+func (f *fsPersister) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	return f.file.Close()
+}
+
 func (f *fsPersister) restore(memStorage *MemStorage) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	data, err := io.ReadAll(f.file)
 	if err != nil {
 		return err
@@ -61,13 +80,19 @@ func (f *fsPersister) restore(memStorage *MemStorage) (err error) {
 		return err
 	}
 
-	memStorage.gaugeStore = dump.GaugeStore
-	memStorage.counterStore = dump.CounterStore
+	memStorage.load(*dump)
+	if memStorage.rollups != nil {
+		memStorage.rollups.load(dump.Rollups)
+	} else {
+		memStorage.restoredRollups = dump.Rollups
+	}
 
 	return nil
 }
 
 type memStorageDump struct {
-	GaugeStore   map[string]handlers.GaugeMetric
-	CounterStore map[string]handlers.CounterMetric
+	GaugeStore     map[string]handlers.GaugeMetric
+	CounterStore   map[string]handlers.CounterMetric
+	HistogramStore map[string]handlers.HistogramMetric `json:",omitempty"`
+	Rollups        []memRollupSeries                   `json:",omitempty"`
 }
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"sync"
+	"time"
+)
+
+func newMemHistory(capacity int) *memHistory {
+	h := &memHistory{
+		capacity: capacity,
+		now:      time.Now,
+	}
+	for i := range h.shards {
+		h.shards[i] = &historyShard{series: map[string]*sampleRing{}}
+	}
+
+	return h
+}
+
+// memHistory keeps the last samples of every series in a ring buffer of the fixed capacity.
+// It is split into the shards the same way as the MemStorage, so the writes to the different shards don't wait for each other.
+type memHistory struct {
+	capacity int
+	shards   [shardCount]*historyShard
+	now      func() time.Time
+}
+
+type historyShard struct {
+	mu     sync.RWMutex
+	series map[string]*sampleRing
+}
+
+// recordGauge adds the sample to the series identified by handlers.SeriesKey
+func (h *memHistory) recordGauge(seriesKey string, value float64) {
+	h.record(handlers.MetricTypeGauge, seriesKey, handlers.Sample{Value: &value})
+}
+
+// recordCounter adds the sample to the series identified by handlers.SeriesKey
+func (h *memHistory) recordCounter(seriesKey string, value int64) {
+	h.record(handlers.MetricTypeCounter, seriesKey, handlers.Sample{Delta: &value})
+}
+
+func (h *memHistory) record(metricType string, seriesKey string, sample handlers.Sample) {
+	shard := h.shards[shardIndex(seriesKey)]
+	key := metricType + ":" + seriesKey
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	sample.Timestamp = h.now()
+	ring, ok := shard.series[key]
+	if !ok {
+		ring = &sampleRing{samples: make([]handlers.Sample, h.capacity)}
+		shard.series[key] = ring
+	}
+	ring.push(sample)
+}
+
+func (h *memHistory) getRange(metricType string, seriesKey string, from time.Time, to time.Time) []handlers.Sample {
+	shard := h.shards[shardIndex(seriesKey)]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	ring, ok := shard.series[metricType+":"+seriesKey]
+	if !ok {
+		return nil
+	}
+
+	var result []handlers.Sample
+	for i := 0; i < ring.size; i++ {
+		sample := ring.get(i)
+		if sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, sample)
+	}
+
+	return result
+}
+
+// sampleRing overwrites the oldest sample when it is full.
+type sampleRing struct {
+	samples []handlers.Sample
+	start   int
+	size    int
+}
+
+func (r *sampleRing) push(sample handlers.Sample) {
+	if len(r.samples) == 0 {
+		return
+	}
+	if r.size < len(r.samples) {
+		r.samples[(r.start+r.size)%len(r.samples)] = sample
+		r.size++
+		return
+	}
+	r.samples[r.start] = sample
+	r.start = (r.start + 1) % len(r.samples)
+}
+
+// get returns i-th sample starting from the oldest one.
+func (r *sampleRing) get(i int) handlers.Sample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemStorage_GetRange(t *testing.T) {
+	m := NewMemStorageDefault()
+
+	_, err := m.GetRange(context.Background(), handlers.MetricTypeGauge, "metric_name", nil, time.Time{}, time.Now())
+	require.Equal(t, handlers.ErrHistoryDisabled, err)
+
+	m.EnableHistory(3)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	m.history.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for i := 1; i <= 4; i++ {
+		require.Nil(t, m.UpsertGauge(handlers.GaugeMetric{Name: "metric_name", Value: float64(i)}))
+		_, err = m.IncrementCounter(handlers.CounterMetric{Name: "metric_name", Value: 1})
+		require.Nil(t, err)
+	}
+
+	// the capacity is 3, so the first gauge has been overwritten
+	samples, err := m.GetRange(context.Background(), handlers.MetricTypeGauge, "metric_name", nil, start, now)
+	require.Nil(t, err)
+	require.Equal(t, []handlers.Sample{
+		gaugeSample(start.Add(3*time.Second), 2),
+		gaugeSample(start.Add(5*time.Second), 3),
+		gaugeSample(start.Add(7*time.Second), 4),
+	}, samples)
+
+	samples, err = m.GetRange(context.Background(), handlers.MetricTypeCounter, "metric_name", nil, start.Add(5*time.Second), start.Add(6*time.Second))
+	require.Nil(t, err)
+	require.Equal(t, []handlers.Sample{counterSample(start.Add(6*time.Second), 3)}, samples)
+
+	samples, err = m.GetRange(context.Background(), handlers.MetricTypeCounter, "unknown_metric", nil, start, now)
+	require.Nil(t, err)
+	require.Empty(t, samples)
+}
+
+func gaugeSample(timestamp time.Time, value float64) handlers.Sample {
+	return handlers.Sample{Timestamp: timestamp, Value: &value}
+}
+
+func counterSample(timestamp time.Time, delta int64) handlers.Sample {
+	return handlers.Sample{Timestamp: timestamp, Delta: &delta}
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"sort"
+	"sync"
+	"time"
+)
+
+func newMemRollups(policies []RollupPolicy) *memRollups {
+	return &memRollups{
+		policies: policies,
+		series:   map[rollupKey]*memRollupSeries{},
+	}
+}
+
+type rollupKey struct {
+	metricType string
+	seriesKey  string
+	resolution time.Duration
+}
+
+type memRollups struct {
+	mu       sync.RWMutex
+	policies []RollupPolicy
+	series   map[rollupKey]*memRollupSeries
+}
+
+func (r *memRollups) add(sample rollupSample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, policy := range r.policies {
+		key := rollupKey{sample.metricType, handlers.SeriesKey(sample.name, sample.labels), policy.Resolution}
+		start := sample.at.UTC().Truncate(policy.Resolution)
+		series, ok := r.series[key]
+		if !ok {
+			series = &memRollupSeries{
+				Type:       sample.metricType,
+				Name:       sample.name,
+				Labels:     sample.labels,
+				Resolution: policy.Resolution,
+			}
+			r.series[key] = series
+		}
+		buckets := series.Buckets
+
+		// the samples come almost always in chronological order, so the bucket is searched from the end
+		i := len(buckets) - 1
+		for i >= 0 && buckets[i].Start.After(start) {
+			i--
+		}
+		if i >= 0 && buckets[i].Start.Equal(start) {
+			buckets[i].add(sample)
+			continue
+		}
+
+		buckets = append(buckets, rollupBucket{})
+		copy(buckets[i+2:], buckets[i+1:])
+		buckets[i+1] = newRollupBucket(start, sample)
+		series.Buckets = buckets
+	}
+
+	return nil
+}
+
+func (r *memRollups) get(metricType string, seriesKey string, resolution time.Duration, from time.Time, to time.Time) ([]handlers.RollupPoint, error) {
+	if _, ok := findRollupPolicy(r.policies, resolution); !ok {
+		return nil, handlers.ErrUnknownResolution
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	series, ok := r.series[rollupKey{metricType, seriesKey, resolution}]
+	if !ok {
+		return nil, nil
+	}
+
+	var result []handlers.RollupPoint
+	for _, bucket := range series.Buckets {
+		if bucket.Start.Before(from.Truncate(resolution)) || bucket.Start.After(to) {
+			continue
+		}
+		result = append(result, bucket.toPoint(metricType))
+	}
+
+	return result, nil
+}
+
+// cleanup removes the buckets which are older than the retention of their resolution.
+func (r *memRollups) cleanup(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, series := range r.series {
+		policy, _ := findRollupPolicy(r.policies, key.resolution)
+		threshold := now.Add(-policy.Retention)
+
+		buckets := series.Buckets
+		i := sort.Search(len(buckets), func(i int) bool {
+			return !buckets[i].Start.Before(threshold)
+		})
+		if i == len(buckets) {
+			delete(r.series, key)
+			continue
+		}
+		series.Buckets = append([]rollupBucket(nil), buckets[i:]...)
+	}
+}
+
+// memRollupSeries is the buckets of one series of one resolution, it is dumped as is with the MemStorage.
+type memRollupSeries struct {
+	Type       string
+	Name       string
+	Labels     handlers.Labels `json:",omitempty"`
+	Resolution time.Duration
+	Buckets    []rollupBucket
+}
+
+func (r *memRollups) dump() []memRollupSeries {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := []memRollupSeries{}
+	for _, series := range r.series {
+		dumped := *series
+		dumped.Buckets = append([]rollupBucket(nil), series.Buckets...)
+		result = append(result, dumped)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		if result[i].Labels.String() != result[j].Labels.String() {
+			return result[i].Labels.String() < result[j].Labels.String()
+		}
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Resolution < result[j].Resolution
+	})
+
+	return result
+}
+
+// load replaces the rollups with the dumped ones. The series of the resolutions which are not configured anymore are skipped.
+func (r *memRollups) load(dump []memRollupSeries) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.series = map[rollupKey]*memRollupSeries{}
+	for i := range dump {
+		series := dump[i]
+		if _, ok := findRollupPolicy(r.policies, series.Resolution); !ok {
+			continue
+		}
+		r.series[rollupKey{series.Type, handlers.SeriesKey(series.Name, series.Labels), series.Resolution}] = &series
+	}
+}
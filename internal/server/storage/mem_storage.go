@@ -5,18 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
+	"hash/fnv"
+	"sync"
+	"time"
 )
 
+// shardCount is the number of independent parts of the MemStorage, each of them has its own lock.
+const shardCount = 16
+
 func NewMemStorage(storeFile string, isRestore bool, isPersistSynchronouslyToFile bool) (memStorage *MemStorage, err error) {
 	persister, err := newFsPersister(storeFile)
 	if err != nil {
 		return memStorage, err
 	}
-	memStorage = &MemStorage{
-		counterStore: map[string]handlers.CounterMetric{},
-		gaugeStore:   map[string]handlers.GaugeMetric{},
-		fsPersister:  persister,
-	}
+	memStorage = NewMemStorageDefault()
+	memStorage.fsPersister = persister
 
 	if isRestore {
 		if err := memStorage.restore(); err != nil {
@@ -31,35 +35,108 @@ func NewMemStorage(storeFile string, isRestore bool, isPersistSynchronouslyToFil
 }
 
 func NewMemStorageDefault() *MemStorage {
-	return &MemStorage{
-		counterStore: map[string]handlers.CounterMetric{},
-		gaugeStore:   map[string]handlers.GaugeMetric{},
+	memStorage := &MemStorage{}
+	for i := range memStorage.shards {
+		memStorage.shards[i] = newMemShard()
 	}
+
+	return memStorage
 }
 
 type MemStorage struct {
-	gaugeStore   map[string]handlers.GaugeMetric
-	counterStore map[string]handlers.CounterMetric
-	observers    []Observer
-	fsPersister  *fsPersister
+	shards      [shardCount]*memShard
+	observers   []Observer
+	fsPersister *fsPersister
+	history     *memHistory
+	rollups     *memRollups
+	// restoredRollups keeps the rollups read from the dump until they are enabled
+	restoredRollups []memRollupSeries
+}
+
+type memShard struct {
+	mu             sync.RWMutex
+	gaugeStore     map[string]handlers.GaugeMetric
+	counterStore   map[string]handlers.CounterMetric
+	histogramStore map[string]handlers.HistogramMetric
+}
+
+func newMemShard() *memShard {
+	return &memShard{
+		gaugeStore:     map[string]handlers.GaugeMetric{},
+		counterStore:   map[string]handlers.CounterMetric{},
+		histogramStore: map[string]handlers.HistogramMetric{},
+	}
 }
 
 func (m *MemStorage) AddObserver(o Observer) {
 	m.observers = append(m.observers, o)
 }
 
+// EnableHistory makes the storage keep the last historySize samples of every metric.
+func (m *MemStorage) EnableHistory(historySize int) {
+	m.history = newMemHistory(historySize)
+}
+
+func (m *MemStorage) GetRange(ctx context.Context, metricType string, name string, labels handlers.Labels, from time.Time, to time.Time) ([]handlers.Sample, error) {
+	if m.history == nil {
+		return nil, handlers.ErrHistoryDisabled
+	}
+
+	return m.history.getRange(metricType, handlers.SeriesKey(name, labels), from, to), nil
+}
+
+// EnableRollups makes the storage aggregate the metrics with the given resolutions.
+// The rollups restored from the dump are loaded here.
+func (m *MemStorage) EnableRollups(policies []RollupPolicy) {
+	m.rollups = newMemRollups(policies)
+	m.rollups.load(m.restoredRollups)
+	m.restoredRollups = nil
+
+	var counters []handlers.CounterMetric
+	for _, counter := range m.snapshot().CounterStore {
+		counters = append(counters, counter)
+	}
+	m.AddObserver(newRollupObserver(counters, m.rollups.add))
+}
+
+func (m *MemStorage) GetRollups(ctx context.Context, metricType string, name string, labels handlers.Labels, resolution time.Duration, from time.Time, to time.Time) ([]handlers.RollupPoint, error) {
+	if m.rollups == nil {
+		return nil, handlers.ErrRollupsDisabled
+	}
+
+	return m.rollups.get(metricType, handlers.SeriesKey(name, labels), resolution, from, to)
+}
+
+// CleanupRollups removes the aggregates which are older than the retention of their resolution.
+func (m *MemStorage) CleanupRollups(ctx context.Context, now time.Time) error {
+	if m.rollups == nil {
+		return handlers.ErrRollupsDisabled
+	}
+
+	m.rollups.cleanup(now)
+
+	return nil
+}
+
+// GaugeStore returns a copy of all the gauges by their series keys.
 func (m *MemStorage) GaugeStore() map[string]handlers.GaugeMetric {
-	return m.gaugeStore
+	return m.snapshot().GaugeStore
 }
 
+// CounterStore returns a copy of all the counters by their series keys.
 func (m *MemStorage) CounterStore() map[string]handlers.CounterMetric {
-	return m.counterStore
+	return m.snapshot().CounterStore
+}
+
+// HistogramStore returns a copy of all the histograms by their series keys.
+func (m *MemStorage) HistogramStore() map[string]handlers.HistogramMetric {
+	return m.snapshot().HistogramStore
 }
 
 func (m *MemStorage) GetAllGauge() ([]handlers.GaugeMetric, error) {
 	var result []handlers.GaugeMetric
 
-	for _, value := range m.gaugeStore {
+	for _, value := range m.snapshot().GaugeStore {
 		result = append(result, value)
 	}
 	return result, nil
@@ -68,14 +145,27 @@ func (m *MemStorage) GetAllGauge() ([]handlers.GaugeMetric, error) {
 func (m *MemStorage) GetAllCounters() ([]handlers.CounterMetric, error) {
 	var result []handlers.CounterMetric
 
-	for _, value := range m.counterStore {
+	for _, value := range m.snapshot().CounterStore {
 		result = append(result, value)
 	}
 	return result, nil
 }
 
-func (m *MemStorage) GetGauge(name string) (float64, error) {
-	metric, ok := m.gaugeStore[name]
+func (m *MemStorage) GetAllHistograms() ([]handlers.HistogramMetric, error) {
+	var result []handlers.HistogramMetric
+
+	for _, value := range m.snapshot().HistogramStore {
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+func (m *MemStorage) GetGauge(name string, labels handlers.Labels) (float64, error) {
+	key := handlers.SeriesKey(name, labels)
+	shard := m.shard(key)
+	shard.mu.RLock()
+	metric, ok := shard.gaugeStore[key]
+	shard.mu.RUnlock()
 	if !ok {
 		return .0, handlers.ErrMetricNotFound
 	}
@@ -83,8 +173,12 @@ func (m *MemStorage) GetGauge(name string) (float64, error) {
 	return metric.Value, nil
 }
 
-func (m *MemStorage) GetCounter(name string) (int64, error) {
-	metric, ok := m.counterStore[name]
+func (m *MemStorage) GetCounter(name string, labels handlers.Labels) (int64, error) {
+	key := handlers.SeriesKey(name, labels)
+	shard := m.shard(key)
+	shard.mu.RLock()
+	metric, ok := shard.counterStore[key]
+	shard.mu.RUnlock()
 	if !ok {
 		return 0, handlers.ErrMetricNotFound
 	}
@@ -92,8 +186,28 @@ func (m *MemStorage) GetCounter(name string) (int64, error) {
 	return metric.Value, nil
 }
 
+func (m *MemStorage) GetHistogram(name string, labels handlers.Labels) (utils.Histogram, error) {
+	key := handlers.SeriesKey(name, labels)
+	shard := m.shard(key)
+	shard.mu.RLock()
+	metric, ok := shard.histogramStore[key]
+	shard.mu.RUnlock()
+	if !ok {
+		return utils.Histogram{}, handlers.ErrMetricNotFound
+	}
+
+	return metric.Value.Clone(), nil
+}
+
 func (m *MemStorage) UpsertGauge(metric handlers.GaugeMetric) error {
-	m.gaugeStore[metric.Name] = metric
+	key := metric.Key()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	shard.gaugeStore[key] = metric
+	if m.history != nil {
+		m.history.recordGauge(key, metric.Value)
+	}
+	shard.mu.Unlock()
 
 	return m.notifyObservers(AfterUpsertEvent{
 		Event{metric},
@@ -101,21 +215,117 @@ func (m *MemStorage) UpsertGauge(metric handlers.GaugeMetric) error {
 }
 
 func (m *MemStorage) UpsertCounter(metric handlers.CounterMetric) error {
-	m.counterStore[metric.Name] = metric
+	key := metric.Key()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	shard.counterStore[key] = metric
+	if m.history != nil {
+		m.history.recordCounter(key, metric.Value)
+	}
+	shard.mu.Unlock()
 
 	return m.notifyObservers(AfterUpsertEvent{
 		Event{metric},
 	})
 }
 
+func (m *MemStorage) IncrementCounter(metric handlers.CounterMetric) (int64, error) {
+	key := metric.Key()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	metric.Value += shard.counterStore[key].Value
+	shard.counterStore[key] = metric
+	if m.history != nil {
+		m.history.recordCounter(key, metric.Value)
+	}
+	shard.mu.Unlock()
+
+	return metric.Value, m.notifyObservers(AfterUpsertEvent{
+		Event{metric},
+	})
+}
+
+// IncrementGauge atomically adds the Value of the metric to the stored gauge and returns the new value
+func (m *MemStorage) IncrementGauge(metric handlers.GaugeMetric) (float64, error) {
+	key := metric.Key()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	metric.Value += shard.gaugeStore[key].Value
+	shard.gaugeStore[key] = metric
+	if m.history != nil {
+		m.history.recordGauge(key, metric.Value)
+	}
+	shard.mu.Unlock()
+
+	return metric.Value, m.notifyObservers(AfterUpsertEvent{
+		Event{metric},
+	})
+}
+
+// UpsertHistogram replaces the stored histogram.
+func (m *MemStorage) UpsertHistogram(metric handlers.HistogramMetric) error {
+	metric.Value = metric.Value.Clone()
+	key := metric.Key()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	shard.histogramStore[key] = metric
+	shard.mu.Unlock()
+
+	return m.notifyObservers(AfterUpsertEvent{
+		Event{metric},
+	})
+}
+
+func (m *MemStorage) MergeHistogram(metric handlers.HistogramMetric) (utils.Histogram, error) {
+	key := metric.Key()
+	shard := m.shard(key)
+	shard.mu.Lock()
+	merged := shard.histogramStore[key].Value.Clone()
+	if err := merged.Merge(metric.Value); err != nil {
+		shard.mu.Unlock()
+		return utils.Histogram{}, err
+	}
+	metric.Value = merged
+	shard.histogramStore[key] = metric
+	shard.mu.Unlock()
+
+	return merged.Clone(), m.notifyObservers(AfterUpsertEvent{
+		Event{handlers.HistogramMetric{Name: metric.Name, Value: merged.Clone(), Labels: metric.Labels}},
+	})
+}
+
 func (m *MemStorage) UpsertMany(ctx context.Context, metrics []interface{}) error {
+	if err := checkMetricTypes(metrics); err != nil {
+		return err
+	}
 	for _, metric := range metrics {
-		_, isCounterMetric := metric.(handlers.CounterMetric)
-		_, isGaugeMetric := metric.(handlers.GaugeMetric)
-		if !isCounterMetric && !isGaugeMetric {
-			return errors.New("unknown metric type")
+		switch metric := metric.(type) {
+		case handlers.GaugeMetric:
+			if err := m.UpsertGauge(metric); err != nil {
+				return err
+			}
+		case handlers.CounterMetric:
+			if err := m.UpsertCounter(metric); err != nil {
+				return err
+			}
+		case handlers.HistogramMetric:
+			if err := m.UpsertHistogram(metric); err != nil {
+				return err
+			}
+		default:
+			if err := m.increment(metric); err != nil {
+				return err
+			}
 		}
 	}
+
+	return nil
+}
+
+func (m *MemStorage) IncrementMany(ctx context.Context, metrics []interface{}) error {
+	if err := checkMetricTypes(metrics); err != nil {
+		return err
+	}
 	for _, metric := range metrics {
 		switch metric := metric.(type) {
 		case handlers.GaugeMetric:
@@ -123,7 +333,15 @@ func (m *MemStorage) UpsertMany(ctx context.Context, metrics []interface{}) erro
 				return err
 			}
 		case handlers.CounterMetric:
-			if err := m.UpsertCounter(metric); err != nil {
+			if _, err := m.IncrementCounter(metric); err != nil {
+				return err
+			}
+		case handlers.HistogramMetric:
+			if _, err := m.MergeHistogram(metric); err != nil {
+				return err
+			}
+		default:
+			if err := m.increment(metric); err != nil {
 				return err
 			}
 		}
@@ -132,6 +350,31 @@ func (m *MemStorage) UpsertMany(ctx context.Context, metrics []interface{}) erro
 	return nil
 }
 
+// increment adds GaugeIncrement and CounterIncrement, which are written the same way by UpsertMany and IncrementMany
+func (m *MemStorage) increment(metric interface{}) (err error) {
+	switch metric := metric.(type) {
+	case handlers.GaugeIncrement:
+		_, err = m.IncrementGauge(handlers.GaugeMetric(metric))
+	case handlers.CounterIncrement:
+		_, err = m.IncrementCounter(handlers.CounterMetric(metric))
+	}
+
+	return err
+}
+
+// checkMetricTypes fails if any of the metrics is of unknown type, so nothing is written in this case.
+func checkMetricTypes(metrics []interface{}) error {
+	for _, metric := range metrics {
+		switch metric.(type) {
+		case handlers.GaugeMetric, handlers.CounterMetric, handlers.HistogramMetric, handlers.GaugeIncrement, handlers.CounterIncrement:
+		default:
+			return errors.New("unknown metric type")
+		}
+	}
+
+	return nil
+}
+
 func (m *MemStorage) notifyObservers(event IEvent) error {
 	for _, observer := range m.observers {
 		if err := observer.HandleEvent(event); err != nil {
@@ -141,6 +384,78 @@ func (m *MemStorage) notifyObservers(event IEvent) error {
 	return nil
 }
 
+func (m *MemStorage) shard(key string) *memShard {
+	return m.shards[shardIndex(key)]
+}
+
+// shardIndex returns the shard of the series key, the history uses the same shards as the storage
+func shardIndex(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return h.Sum32() % shardCount
+}
+
+// snapshot copies the content of all the shards. All the shards are locked at once, so the copy
+// is not affected by the writes that happen in the middle of copying. The rollups are not included.
+func (m *MemStorage) snapshot() memStorageDump {
+	for _, shard := range m.shards {
+		shard.mu.RLock()
+	}
+	defer func() {
+		for _, shard := range m.shards {
+			shard.mu.RUnlock()
+		}
+	}()
+
+	dump := memStorageDump{
+		GaugeStore:     map[string]handlers.GaugeMetric{},
+		CounterStore:   map[string]handlers.CounterMetric{},
+		HistogramStore: map[string]handlers.HistogramMetric{},
+	}
+	for _, shard := range m.shards {
+		for key, metric := range shard.gaugeStore {
+			dump.GaugeStore[key] = metric
+		}
+		for key, metric := range shard.counterStore {
+			dump.CounterStore[key] = metric
+		}
+		for key, metric := range shard.histogramStore {
+			metric.Value = metric.Value.Clone()
+			dump.HistogramStore[key] = metric
+		}
+	}
+
+	return dump
+}
+
+// load replaces the content of the storage with the metrics of the dump. The rollups of the dump are ignored.
+func (m *MemStorage) load(dump memStorageDump) {
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+	}
+	defer func() {
+		for _, shard := range m.shards {
+			shard.mu.Unlock()
+		}
+	}()
+
+	for _, shard := range m.shards {
+		shard.gaugeStore = map[string]handlers.GaugeMetric{}
+		shard.counterStore = map[string]handlers.CounterMetric{}
+		shard.histogramStore = map[string]handlers.HistogramMetric{}
+	}
+	for key, metric := range dump.GaugeStore {
+		m.shard(key).gaugeStore[key] = metric
+	}
+	for key, metric := range dump.CounterStore {
+		m.shard(key).counterStore[key] = metric
+	}
+	for key, metric := range dump.HistogramStore {
+		m.shard(key).histogramStore[key] = metric
+	}
+}
+
 func (m *MemStorage) restore() error {
 	if err := m.fsPersister.restore(m); err != nil {
 		return fmt.Errorf("cannot restore the storage from the dump. Error: %w", err)
@@ -153,6 +468,18 @@ func (m *MemStorage) PersistToFile() error {
 	return m.fsPersister.flush(m)
 }
 
+// Close persists the metrics to the file for the last time and closes it.
+func (m *MemStorage) Close() error {
+	if m.fsPersister == nil {
+		return nil
+	}
+	if err := m.PersistToFile(); err != nil {
+		return err
+	}
+
+	return m.fsPersister.close()
+}
+
 func newPersistToFileObserver(memStorage *MemStorage) Observer {
 	return &FuncObserver{
 		FunctionToInvoke: func(e IEvent) error {
@@ -1,9 +1,14 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/smamykin/smetrics/internal/utils"
 	"github.com/stretchr/testify/require"
 	"math/rand"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -17,17 +22,13 @@ func (o *ObserverSpy) HandleEvent(e IEvent) error {
 }
 
 func TestMemStorage_UpsertCounter(t *testing.T) {
-	store := map[string]handlers.CounterMetric{}
-	m := &MemStorage{
-		counterStore: store,
-		gaugeStore:   map[string]handlers.GaugeMetric{},
-	}
+	m := NewMemStorageDefault()
 
 	metric := handlers.CounterMetric{Value: rand.Int63(), Name: "metric_name"}
 	spy := &ObserverSpy{}
 	m.AddObserver(spy)
 	m.UpsertCounter(metric)
-	require.Equal(t, map[string]handlers.CounterMetric{metric.Name: metric}, store)
+	require.Equal(t, map[string]handlers.CounterMetric{metric.Name: metric}, m.CounterStore())
 	require.Equal(
 		t,
 		spy.events,
@@ -36,21 +37,260 @@ func TestMemStorage_UpsertCounter(t *testing.T) {
 }
 
 func TestMemStorage_UpsertGauge(t *testing.T) {
-	store := map[string]handlers.GaugeMetric{}
-	m := &MemStorage{
-		counterStore: map[string]handlers.CounterMetric{},
-		gaugeStore:   store,
-	}
+	m := NewMemStorageDefault()
 
 	metric := handlers.GaugeMetric{Value: rand.Float64(), Name: "metric_name"}
 	spy := &ObserverSpy{}
 	m.AddObserver(spy)
 	m.UpsertGauge(metric)
 
-	require.Equal(t, map[string]handlers.GaugeMetric{metric.Name: metric}, store)
+	require.Equal(t, map[string]handlers.GaugeMetric{metric.Name: metric}, m.GaugeStore())
 	require.Equal(
 		t,
 		spy.events,
 		[]IEvent{AfterUpsertEvent{Event{payload: metric}}},
 	)
 }
+
+func TestMemStorage_IncrementCounter(t *testing.T) {
+	m := NewMemStorageDefault()
+
+	spy := &ObserverSpy{}
+	m.AddObserver(spy)
+
+	actual, err := m.IncrementCounter(handlers.CounterMetric{Value: 11, Name: "metric_name"})
+	require.Nil(t, err)
+	require.Equal(t, int64(11), actual)
+
+	actual, err = m.IncrementCounter(handlers.CounterMetric{Value: 22, Name: "metric_name"})
+	require.Nil(t, err)
+	require.Equal(t, int64(33), actual)
+
+	require.Equal(t, map[string]handlers.CounterMetric{"metric_name": {Value: 33, Name: "metric_name"}}, m.CounterStore())
+	require.Equal(
+		t,
+		spy.events,
+		[]IEvent{
+			AfterUpsertEvent{Event{payload: handlers.CounterMetric{Value: 11, Name: "metric_name"}}},
+			AfterUpsertEvent{Event{payload: handlers.CounterMetric{Value: 33, Name: "metric_name"}}},
+		},
+	)
+}
+
+func TestMemStorage_IncrementMany(t *testing.T) {
+	m := NewMemStorageDefault()
+	m.UpsertCounter(handlers.CounterMetric{Value: 5, Name: "metric_name1"})
+
+	err := m.IncrementMany(context.Background(), []interface{}{
+		handlers.CounterMetric{Value: 10, Name: "metric_name1"},
+		handlers.GaugeMetric{Value: 1.5, Name: "metric_name2"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]handlers.CounterMetric{"metric_name1": {Value: 15, Name: "metric_name1"}}, m.CounterStore())
+	require.Equal(t, map[string]handlers.GaugeMetric{"metric_name2": {Value: 1.5, Name: "metric_name2"}}, m.GaugeStore())
+
+	err = m.IncrementMany(context.Background(), []interface{}{"unknown"})
+	require.NotNil(t, err)
+}
+
+func TestMemStorage_UpsertMany_Increments(t *testing.T) {
+	m := NewMemStorageDefault()
+	m.UpsertCounter(handlers.CounterMetric{Value: 5, Name: "metric_name1"})
+	m.UpsertGauge(handlers.GaugeMetric{Value: 1.5, Name: "metric_name2"})
+
+	err := m.UpsertMany(context.Background(), []interface{}{
+		handlers.CounterIncrement{Value: 10, Name: "metric_name1"},
+		handlers.GaugeIncrement{Value: -0.5, Name: "metric_name2"},
+		handlers.GaugeIncrement{Value: 2, Name: "metric_name3"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]handlers.CounterMetric{"metric_name1": {Value: 15, Name: "metric_name1"}}, m.CounterStore())
+	require.Equal(t, map[string]handlers.GaugeMetric{
+		"metric_name2": {Value: 1, Name: "metric_name2"},
+		"metric_name3": {Value: 2, Name: "metric_name3"},
+	}, m.GaugeStore())
+}
+
+func TestMemStorage_Labels(t *testing.T) {
+	m := NewMemStorageDefault()
+
+	_, err := m.IncrementCounter(handlers.CounterMetric{Value: 1, Name: "requests"})
+	require.Nil(t, err)
+	_, err = m.IncrementCounter(handlers.CounterMetric{Value: 2, Name: "requests", Labels: handlers.Labels{"host": "a"}})
+	require.Nil(t, err)
+	_, err = m.IncrementCounter(handlers.CounterMetric{Value: 3, Name: "requests", Labels: handlers.Labels{"host": "b"}})
+	require.Nil(t, err)
+
+	actual, err := m.GetCounter("requests", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), actual)
+
+	actual, err = m.GetCounter("requests", handlers.Labels{"host": "b"})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), actual)
+
+	_, err = m.GetCounter("requests", handlers.Labels{"host": "c"})
+	require.ErrorIs(t, err, handlers.ErrMetricNotFound)
+
+	counters, err := m.GetAllCounters()
+	require.Nil(t, err)
+	require.Len(t, counters, 3)
+
+	// the key looking like several labels doesn't overwrite them
+	_, err = m.IncrementCounter(handlers.CounterMetric{Value: 4, Name: "requests", Labels: handlers.Labels{"host": "a", "zone": "b"}})
+	require.Nil(t, err)
+	_, err = m.IncrementCounter(handlers.CounterMetric{Value: 5, Name: "requests", Labels: handlers.Labels{`host="a",zone`: "b"}})
+	require.Nil(t, err)
+	actual, err = m.GetCounter("requests", handlers.Labels{"host": "a", "zone": "b"})
+	require.Nil(t, err)
+	require.Equal(t, int64(4), actual)
+	require.Equal(t, `requests{"host=\"a\",zone"="b"}`, handlers.SeriesKey("requests", handlers.Labels{`host="a",zone`: "b"}))
+}
+
+func TestMemStorage_MergeHistogram(t *testing.T) {
+	m, err := NewMemStorage(filepath.Join(t.TempDir(), "dump.json"), false, false)
+	require.Nil(t, err)
+
+	first, err := utils.NewHistogram([]float64{1, 2})
+	require.Nil(t, err)
+	first.Observe(0.5)
+	second := first.Clone()
+	second.Observe(1.5)
+
+	_, err = m.MergeHistogram(handlers.HistogramMetric{Name: "latency", Value: first})
+	require.Nil(t, err)
+	actual, err := m.MergeHistogram(handlers.HistogramMetric{Name: "latency", Value: second})
+	require.Nil(t, err)
+	require.Equal(t, []int64{2, 1, 0}, actual.Counts)
+	require.Equal(t, int64(3), actual.Count)
+	require.Equal(t, 2.5, actual.Sum)
+
+	other, err := utils.NewHistogram([]float64{5})
+	require.Nil(t, err)
+	_, err = m.MergeHistogram(handlers.HistogramMetric{Name: "latency", Value: other})
+	require.ErrorIs(t, err, utils.ErrHistogramBoundsMismatch)
+
+	stored, err := m.GetHistogram("latency", nil)
+	require.Nil(t, err)
+	require.Equal(t, actual, stored)
+
+	require.Nil(t, m.PersistToFile())
+	restored, err := NewMemStorage(m.fsPersister.file.Name(), true, false)
+	require.Nil(t, err)
+	require.Equal(t, m.HistogramStore(), restored.HistogramStore())
+}
+
+func TestMemStorage_Close(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dump.json")
+	m, err := NewMemStorage(fileName, false, false)
+	require.Nil(t, err)
+	require.Nil(t, m.UpsertCounter(handlers.CounterMetric{Name: "PollCount", Value: 5}))
+
+	// the metrics are persisted on close without waiting for the store interval
+	require.Nil(t, m.Close())
+
+	restored, err := NewMemStorage(fileName, true, false)
+	require.Nil(t, err)
+	require.Equal(t, m.CounterStore(), restored.CounterStore())
+
+	require.Nil(t, NewMemStorageDefault().Close())
+}
+
+func TestMemStorage_IncrementCounter_Concurrent(t *testing.T) {
+	m := NewMemStorageDefault()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.IncrementCounter(handlers.CounterMetric{Value: 1, Name: "metric_name"})
+		}()
+	}
+	wg.Wait()
+
+	actual, err := m.GetCounter("metric_name", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(100), actual)
+}
+
+func TestMemStorage_IncrementGauge_Concurrent(t *testing.T) {
+	m := NewMemStorageDefault()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.IncrementGauge(handlers.GaugeMetric{Value: 0.5, Name: "metric_name"})
+		}()
+	}
+	wg.Wait()
+
+	actual, err := m.GetGauge("metric_name", nil)
+	require.Nil(t, err)
+	require.Equal(t, 50.0, actual)
+}
+
+// TestMemStorage_Concurrent is supposed to be run with the -race flag.
+func TestMemStorage_Concurrent(t *testing.T) {
+	m, err := NewMemStorage(filepath.Join(t.TempDir(), "dump.json"), false, false)
+	require.Nil(t, err)
+
+	const workers = 8
+	const iterations = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(4)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				err := m.UpsertMany(context.Background(), []interface{}{
+					handlers.GaugeMetric{Name: fmt.Sprintf("gauge_%d_%d", w, i%10), Value: float64(i)},
+					handlers.CounterMetric{Name: fmt.Sprintf("counter_%d", i%10), Value: int64(i)},
+				})
+				require.Nil(t, err)
+				_, err = m.IncrementCounter(handlers.CounterMetric{Name: "counter_total", Value: 1})
+				require.Nil(t, err)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				_, err := m.GetAllGauge()
+				require.Nil(t, err)
+				_, err = m.GetGauge("gauge_0_0", nil)
+				require.True(t, err == nil || err == handlers.ErrMetricNotFound)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				_, err := m.GetAllCounters()
+				require.Nil(t, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations/10; i++ {
+				require.Nil(t, m.PersistToFile())
+			}
+		}()
+	}
+	wg.Wait()
+
+	actual, err := m.GetCounter("counter_total", nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(workers*iterations), actual)
+
+	gauges, err := m.GetAllGauge()
+	require.Nil(t, err)
+	require.Len(t, gauges, workers*10)
+
+	require.Nil(t, m.PersistToFile())
+	restored, err := NewMemStorage(m.fsPersister.file.Name(), true, false)
+	require.Nil(t, err)
+	require.Equal(t, m.GaugeStore(), restored.GaugeStore())
+	require.Equal(t, m.CounterStore(), restored.CounterStore())
+}
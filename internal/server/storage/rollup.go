@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RollupPolicy describes one resolution of the rollups and how long its buckets are kept.
+type RollupPolicy struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// ParseRollupPolicies parses the comma separated list of resolution:retention pairs, e.g. "1m:24h,1h:720h"
+func ParseRollupPolicies(value string) ([]RollupPolicy, error) {
+	var policies []RollupPolicy
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rollup policy %q, expected resolution:retention", item)
+		}
+		resolution, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution of the rollup policy %q: %w", item, err)
+		}
+		retention, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention of the rollup policy %q: %w", item, err)
+		}
+		if resolution < time.Second || retention < resolution {
+			return nil, fmt.Errorf("invalid rollup policy %q, the resolution must be at least 1s and the retention must be not less than the resolution", item)
+		}
+
+		policies = append(policies, RollupPolicy{Resolution: resolution, Retention: retention})
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Resolution < policies[j].Resolution
+	})
+
+	return policies, nil
+}
+
+// rollupSample is a single accepted update of the metric. For counters, Delta is the increment, not the total value.
+type rollupSample struct {
+	metricType string
+	name       string
+	labels     handlers.Labels
+	value      float64
+	delta      int64
+	at         time.Time
+}
+
+// rollupBucket is the aggregate of all the samples of the series within one interval of the resolution.
+type rollupBucket struct {
+	Start time.Time
+	Count int64
+	Min   float64
+	Max   float64
+	Sum   float64
+	Last  float64
+	Delta int64
+}
+
+func newRollupBucket(start time.Time, sample rollupSample) rollupBucket {
+	return rollupBucket{
+		Start: start,
+		Count: 1,
+		Min:   sample.value,
+		Max:   sample.value,
+		Sum:   sample.value,
+		Last:  sample.value,
+		Delta: sample.delta,
+	}
+}
+
+func (b *rollupBucket) add(sample rollupSample) {
+	b.Count++
+	if sample.value < b.Min {
+		b.Min = sample.value
+	}
+	if sample.value > b.Max {
+		b.Max = sample.value
+	}
+	b.Sum += sample.value
+	b.Last = sample.value
+	b.Delta += sample.delta
+}
+
+func (b rollupBucket) toPoint(metricType string) handlers.RollupPoint {
+	point := handlers.RollupPoint{Timestamp: b.Start, Count: b.Count}
+	if metricType == handlers.MetricTypeCounter {
+		point.Delta = &b.Delta
+		return point
+	}
+
+	avg := b.Sum / float64(b.Count)
+	point.Min = &b.Min
+	point.Max = &b.Max
+	point.Avg = &avg
+	point.Last = &b.Last
+
+	return point
+}
+
+func findRollupPolicy(policies []RollupPolicy, resolution time.Duration) (RollupPolicy, bool) {
+	for _, policy := range policies {
+		if policy.Resolution == resolution {
+			return policy, true
+		}
+	}
+
+	return RollupPolicy{}, false
+}
+
+// newRollupObserver creates the observer which turns the AfterUpsertEvent into the samples of the rollups.
+// The events carry the total values of the counters, so the observer remembers the last total of every counter
+// to calculate the increments. A total less than the remembered one means the counter has been reset,
+// e.g. the cumulative counter of the restarted OTLP exporter, so the whole total is the increment
+// as in the increase() of Prometheus.
+func newRollupObserver(counters []handlers.CounterMetric, add func(sample rollupSample) error) *rollupObserver {
+	lastCounters := map[string]int64{}
+	for _, counter := range counters {
+		lastCounters[counter.Key()] = counter.Value
+	}
+
+	return &rollupObserver{
+		lastCounters: lastCounters,
+		add:          add,
+		now:          time.Now,
+	}
+}
+
+type rollupObserver struct {
+	mu           sync.Mutex
+	lastCounters map[string]int64
+	add          func(sample rollupSample) error
+	now          func() time.Time
+}
+
+func (o *rollupObserver) HandleEvent(e IEvent) error {
+	if _, ok := e.(AfterUpsertEvent); !ok {
+		return nil
+	}
+
+	if metrics, ok := e.Payload().([]interface{}); ok {
+		for _, metric := range metrics {
+			if err := o.handleMetric(metric); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return o.handleMetric(e.Payload())
+}
+
+func (o *rollupObserver) handleMetric(metric interface{}) error {
+	switch metric := metric.(type) {
+	case handlers.GaugeMetric:
+		return o.add(rollupSample{
+			metricType: handlers.MetricTypeGauge,
+			name:       metric.Name,
+			labels:     metric.Labels,
+			value:      metric.Value,
+			at:         o.now(),
+		})
+	case handlers.CounterMetric:
+		o.mu.Lock()
+		delta := metric.Value - o.lastCounters[metric.Key()]
+		if delta < 0 {
+			delta = metric.Value
+		}
+		o.lastCounters[metric.Key()] = metric.Value
+		o.mu.Unlock()
+
+		return o.add(rollupSample{
+			metricType: handlers.MetricTypeCounter,
+			name:       metric.Name,
+			labels:     metric.Labels,
+			delta:      delta,
+			at:         o.now(),
+		})
+	}
+
+	return nil
+}
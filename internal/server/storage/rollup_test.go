@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"github.com/smamykin/smetrics/internal/server/handlers"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRollupPolicies(t *testing.T) {
+	policies, err := ParseRollupPolicies("1h:720h, 1m:24h")
+	require.Nil(t, err)
+	require.Equal(t, []RollupPolicy{
+		{Resolution: time.Minute, Retention: 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 720 * time.Hour},
+	}, policies)
+
+	policies, err = ParseRollupPolicies("")
+	require.Nil(t, err)
+	require.Empty(t, policies)
+
+	for _, value := range []string{"1m", "1m:1s", "1x:1h", "1m:1x", "100ms:1h"} {
+		_, err = ParseRollupPolicies(value)
+		require.NotNil(t, err, value)
+	}
+}
+
+func TestMemStorage_Rollups(t *testing.T) {
+	m := NewMemStorageDefault()
+
+	_, err := m.GetRollups(context.Background(), handlers.MetricTypeGauge, "metric_name", nil, time.Minute, time.Time{}, time.Now())
+	require.Equal(t, handlers.ErrRollupsDisabled, err)
+
+	// the counter existed before the rollups have been enabled, its value must not be counted as an increment
+	_, err = m.IncrementCounter(handlers.CounterMetric{Name: "metric_name", Value: 100})
+	require.Nil(t, err)
+
+	m.EnableRollups([]RollupPolicy{
+		{Resolution: time.Minute, Retention: time.Hour},
+		{Resolution: time.Hour, Retention: 24 * time.Hour},
+	})
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	m.observers[len(m.observers)-1].(*rollupObserver).now = func() time.Time {
+		return now
+	}
+
+	for _, value := range []float64{3, 1, 2} {
+		require.Nil(t, m.UpsertGauge(handlers.GaugeMetric{Name: "metric_name", Value: value}))
+		_, err = m.IncrementCounter(handlers.CounterMetric{Name: "metric_name", Value: 5})
+		require.Nil(t, err)
+		now = now.Add(30 * time.Second)
+	}
+
+	points, err := m.GetRollups(context.Background(), handlers.MetricTypeGauge, "metric_name", nil, time.Minute, start, now)
+	require.Nil(t, err)
+	require.Equal(t, []handlers.RollupPoint{
+		gaugePoint(start, 2, 1, 3, 2, 1),
+		gaugePoint(start.Add(time.Minute), 1, 2, 2, 2, 2),
+	}, points)
+
+	points, err = m.GetRollups(context.Background(), handlers.MetricTypeCounter, "metric_name", nil, time.Hour, start, now)
+	require.Nil(t, err)
+	require.Equal(t, []handlers.RollupPoint{counterPoint(start, 3, 15)}, points)
+
+	_, err = m.GetRollups(context.Background(), handlers.MetricTypeCounter, "metric_name", nil, time.Second, start, now)
+	require.Equal(t, handlers.ErrUnknownResolution, err)
+
+	// the minute buckets are expired, the hour bucket is not
+	require.Nil(t, m.CleanupRollups(context.Background(), start.Add(time.Hour+time.Minute)))
+
+	points, err = m.GetRollups(context.Background(), handlers.MetricTypeGauge, "metric_name", nil, time.Minute, start, now)
+	require.Nil(t, err)
+	require.Equal(t, []handlers.RollupPoint{gaugePoint(start.Add(time.Minute), 1, 2, 2, 2, 2)}, points)
+
+	points, err = m.GetRollups(context.Background(), handlers.MetricTypeGauge, "metric_name", nil, time.Hour, start, now)
+	require.Nil(t, err)
+	require.Len(t, points, 1)
+}
+
+func TestMemStorage_RollupsCounterReset(t *testing.T) {
+	m := NewMemStorageDefault()
+	m.EnableRollups([]RollupPolicy{{Resolution: time.Hour, Retention: 24 * time.Hour}})
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.observers[len(m.observers)-1].(*rollupObserver).now = func() time.Time {
+		return start
+	}
+
+	// the cumulative counter grows to 10, is reset and grows to 4 again: the increase is 14
+	for _, value := range []int64{5, 10, 3, 4} {
+		require.Nil(t, m.UpsertCounter(handlers.CounterMetric{Name: "metric_name", Value: value}))
+	}
+
+	points, err := m.GetRollups(context.Background(), handlers.MetricTypeCounter, "metric_name", nil, time.Hour, start, start)
+	require.Nil(t, err)
+	require.Equal(t, []handlers.RollupPoint{counterPoint(start, 4, 14)}, points)
+}
+
+func TestMemStorage_RollupsPersistence(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dump.json")
+	policies := []RollupPolicy{{Resolution: time.Minute, Retention: time.Hour}}
+
+	m, err := NewMemStorage(fileName, false, false)
+	require.Nil(t, err)
+	m.EnableRollups(policies)
+	require.Nil(t, m.UpsertGauge(handlers.GaugeMetric{Name: "metric_name", Value: 1.5}))
+	require.Nil(t, m.PersistToFile())
+
+	restored, err := NewMemStorage(fileName, true, false)
+	require.Nil(t, err)
+	restored.EnableRollups(policies)
+
+	require.Equal(t, m.rollups.dump(), restored.rollups.dump())
+	require.Len(t, restored.rollups.dump(), 1)
+}
+
+func gaugePoint(timestamp time.Time, count int64, min float64, max float64, avg float64, last float64) handlers.RollupPoint {
+	return handlers.RollupPoint{Timestamp: timestamp, Count: count, Min: &min, Max: &max, Avg: &avg, Last: &last}
+}
+
+func counterPoint(timestamp time.Time, count int64, delta int64) handlers.RollupPoint {
+	return handlers.RollupPoint{Timestamp: timestamp, Count: count, Delta: &delta}
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// EncryptionHeader marks the encrypted body of the request, its value is EncryptionScheme
+const (
+	EncryptionHeader = "Encryption"
+	EncryptionScheme = "rsa-oaep-sha256+aes-256-gcm"
+)
+
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+const aesKeySize = 32
+
+// Encrypt encrypts the data with the random AES-256-GCM key, and the key with RSA-OAEP, so the data of any size fit.
+// The result is the length of the encrypted key (2 bytes, big endian), the encrypted key, the nonce and the ciphertext.
+func Encrypt(publicKey *rsa.PublicKey, data []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(result, uint16(len(encryptedKey)))
+	result = append(result, encryptedKey...)
+	result = append(result, nonce...)
+
+	return gcm.Seal(result, nonce, data, nil), nil
+}
+
+// Decrypt decrypts the data encrypted by Encrypt.
+func Decrypt(privateKey *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrInvalidCiphertext
+	}
+	keyLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < keyLength {
+		return nil, ErrInvalidCiphertext
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, data[:keyLength], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	data = data[keyLength:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	result, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+
+	return result, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// LoadPublicKey reads the RSA public key in the PEM format, PKIX or PKCS #1
+func LoadPublicKey(fileName string) (*rsa.PublicKey, error) {
+	block, err := readPEM(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the public key %s: %w", fileName, err)
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the public key %s is not an RSA key", fileName)
+	}
+
+	return publicKey, nil
+}
+
+// LoadPrivateKey reads the RSA private key in the PEM format, PKCS #8 or PKCS #1
+func LoadPrivateKey(fileName string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the private key %s: %w", fileName, err)
+	}
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key %s is not an RSA key", fileName)
+	}
+
+	return privateKey, nil
+}
+
+func readPEM(fileName string) (*pem.Block, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", fileName)
+	}
+
+	return block, nil
+}
@@ -4,26 +4,28 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
-	"hash"
 )
 
+// HashSHA256Header is the header with the HMAC-SHA256 of the whole body of the request or the response
+const HashSHA256Header = "HashSHA256"
+
+// HashGenerator signs with HMAC-SHA256. It's safe for concurrent use, every sign is computed with a new hash.
 type HashGenerator struct {
-	Hash hash.Hash
+	key []byte
 }
 
 func NewHashGenerator(key string) *HashGenerator {
-	h := hmac.New(sha256.New, []byte(key))
-	return &HashGenerator{h}
+	return &HashGenerator{[]byte(key)}
 }
 
 func (h *HashGenerator) Generate(stringToHash string) (string, error) {
-	h.Hash.Reset()
-	_, err := h.Hash.Write([]byte(stringToHash))
+	mac := hmac.New(sha256.New, h.key)
+	_, err := mac.Write([]byte(stringToHash))
 	if err != nil {
 		return "", err
 	}
 
-	return hex.EncodeToString(h.Hash.Sum(nil)), nil
+	return hex.EncodeToString(mac.Sum(nil)), nil
 }
 
 func (h *HashGenerator) Equal(hash1 string, hash2 string) bool {
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultHistogramBounds are the upper bounds of the buckets suitable for the latencies in seconds.
+var DefaultHistogramBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var ErrHistogramBoundsMismatch = errors.New("histograms have different bounds")
+
+// ErrNonFiniteValue is returned for NaN and ±Inf, which can't be encoded to JSON
+var ErrNonFiniteValue = errors.New("the value of the histogram must be finite")
+
+// Histogram counts the observed values in the buckets. Bounds are the ascending upper bounds of the buckets,
+// the value belongs to the first bucket with the bound not less than the value.
+// Counts has one more bucket than Bounds for the values greater than the last bound (+Inf).
+// Counts are not cumulative, unlike the buckets of Prometheus.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  int64     `json:"count"`
+}
+
+func NewHistogram(bounds []float64) (Histogram, error) {
+	if err := validateHistogramBounds(bounds); err != nil {
+		return Histogram{}, err
+	}
+
+	return Histogram{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]int64, len(bounds)+1),
+	}, nil
+}
+
+// ParseHistogramBounds parses the comma separated list of the upper bounds of the buckets, e.g. "0.1,0.5,1"
+func ParseHistogramBounds(value string) ([]float64, error) {
+	var bounds []float64
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		bound, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bound of the histogram %q: %w", item, err)
+		}
+		bounds = append(bounds, bound)
+	}
+
+	return bounds, validateHistogramBounds(bounds)
+}
+
+func validateHistogramBounds(bounds []float64) error {
+	if len(bounds) == 0 {
+		return errors.New("histogram must have at least one bound")
+	}
+	for i, bound := range bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("bound of the histogram must be finite, got %v", bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return errors.New("bounds of the histogram must be strictly ascending")
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the histogram is consistent, e.g. after it is received from the network.
+func (h Histogram) Validate() error {
+	if err := validateHistogramBounds(h.Bounds); err != nil {
+		return err
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return ErrNonFiniteValue
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram must have %d counts for %d bounds, got %d", len(h.Bounds)+1, len(h.Bounds), len(h.Counts))
+	}
+
+	var count int64
+	for _, c := range h.Counts {
+		if c < 0 {
+			return errors.New("counts of the histogram must not be negative")
+		}
+		count += c
+	}
+	if count != h.Count {
+		return fmt.Errorf("count of the histogram %d doesn't match the sum of the counts %d", h.Count, count)
+	}
+
+	return nil
+}
+
+// Observe adds the value to its bucket, ErrNonFiniteValue is returned for NaN and ±Inf
+func (h *Histogram) Observe(value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ErrNonFiniteValue
+	}
+	h.Counts[sort.SearchFloat64s(h.Bounds, value)]++
+	h.Sum += value
+	h.Count++
+
+	return nil
+}
+
+// Merge adds the observations of the other histogram. An empty histogram without bounds takes the bounds of the other one.
+func (h *Histogram) Merge(other Histogram) error {
+	if len(h.Bounds) == 0 && h.Count == 0 {
+		*h = other.Clone()
+		return nil
+	}
+	if !h.hasSameBounds(other) {
+		return ErrHistogramBoundsMismatch
+	}
+
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+
+	return nil
+}
+
+func (h Histogram) hasSameBounds(other Histogram) bool {
+	if len(h.Bounds) != len(other.Bounds) || len(h.Counts) != len(other.Counts) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h Histogram) Clone() Histogram {
+	h.Bounds = append([]float64(nil), h.Bounds...)
+	h.Counts = append([]int64(nil), h.Counts...)
+
+	return h
+}
+
+// Quantile estimates the q-quantile (0 <= q <= 1) with the linear interpolation within the bucket the same way
+// as histogram_quantile of Prometheus does. The lower bound of the first bucket is 0 when its upper bound is positive.
+// The values of the last (+Inf) bucket are estimated as the last bound. It is NaN for the empty histogram.
+func (h Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || len(h.Bounds) == 0 || math.IsNaN(q) || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	rank := q * float64(h.Count)
+	var cumulative int64
+	for i, count := range h.Counts {
+		if float64(cumulative+count) < rank || count == 0 {
+			cumulative += count
+			continue
+		}
+		if i == len(h.Bounds) {
+			return h.Bounds[len(h.Bounds)-1]
+		}
+
+		upper := h.Bounds[i]
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		} else if upper <= 0 {
+			return upper
+		}
+
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(count)
+	}
+
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// SignString is the part of the string to hash of the histogram metric.
+// Both the agent and the server sign the histograms with it.
+func (h Histogram) SignString() string {
+	bounds := make([]string, len(h.Bounds))
+	for i, bound := range h.Bounds {
+		bounds[i] = strconv.FormatFloat(bound, 'g', -1, 64)
+	}
+	counts := make([]string, len(h.Counts))
+	for i, count := range h.Counts {
+		counts[i] = strconv.FormatInt(count, 10)
+	}
+
+	return fmt.Sprintf("%d:%f:%s:%s", h.Count, h.Sum, strings.Join(bounds, ","), strings.Join(counts, ","))
+}
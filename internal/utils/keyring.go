@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// HashKeyIDHeader is the header with the id of the key the HashSHA256 header is signed with
+const HashKeyIDHeader = "HashSHA256-Key-ID"
+
+// Keyring signs with the current key and verifies with any of the known keys, so the key can be rotated
+// without updating all the agents at the same time: the new key becomes the current one,
+// and the old one stays known until the uses show that no agent signs with it anymore.
+type Keyring struct {
+	currentID string
+	ids       []string
+	keys      map[string]*HashGenerator
+	mu        sync.Mutex
+	uses      map[string]int64
+}
+
+func NewKeyring(currentID string, currentKey string) *Keyring {
+	return &Keyring{
+		currentID: currentID,
+		ids:       []string{currentID},
+		keys:      map[string]*HashGenerator{currentID: NewHashGenerator(currentKey)},
+		uses:      map[string]int64{},
+	}
+}
+
+// AddKey adds the previous key, which is only used to verify the signs
+func (k *Keyring) AddKey(id string, key string) error {
+	if id == "" {
+		return fmt.Errorf("the id of the previous key is required")
+	}
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("the key %s is already known", id)
+	}
+	k.ids = append(k.ids, id)
+	k.keys[id] = NewHashGenerator(key)
+
+	return nil
+}
+
+// AddKeys adds the previous keys in the format id:key[,id:key...]
+func (k *Keyring) AddKeys(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(item, ":")
+		if !ok || key == "" {
+			return fmt.Errorf("the previous key %q must be in the format id:key", id)
+		}
+		if err := k.AddKey(strings.TrimSpace(id), key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KeyID returns the id of the current key
+func (k *Keyring) KeyID() string {
+	return k.currentID
+}
+
+// Generate signs with the current key
+func (k *Keyring) Generate(stringToHash string) (string, error) {
+	return k.keys[k.currentID].Generate(stringToHash)
+}
+
+// Verify checks the sign with the key of the id. The sign without the id, made by the agents which don't send it,
+// is checked with every known key. The use of the matching key is recorded.
+func (k *Keyring) Verify(keyID string, stringToHash string, sign string) bool {
+	ids := k.ids
+	if keyID != "" {
+		if _, ok := k.keys[keyID]; !ok {
+			return false
+		}
+		ids = []string{keyID}
+	}
+
+	for _, id := range ids {
+		expected, err := k.keys[id].Generate(stringToHash)
+		if err != nil {
+			return false
+		}
+		if k.keys[id].Equal(sign, expected) {
+			k.mu.Lock()
+			k.uses[id]++
+			k.mu.Unlock()
+			return true
+		}
+	}
+
+	return false
+}
+
+// TakeUses returns how many signs were verified with every key since the previous call
+func (k *Keyring) TakeUses() map[string]int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	uses := k.uses
+	k.uses = map[string]int64{}
+
+	return uses
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseLabels parses the comma separated list of key=value pairs, e.g. "service=api,env=prod"
+func ParseLabels(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", item)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return labels, nil
+}
+
+// LabelsString returns the canonical representation of the labels: {key1="value1",key2="value2"} with sorted keys.
+// The keys with the characters of the representation are quoted like the values, so the different labels never have the same one.
+// It is empty for the empty labels. Both the agent and the server sign the metrics with it.
+func LabelsString(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(labelKeyString(key))
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(labels[key]))
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+// labelKeyString quotes the key only if it has the characters of the representation, so the usual keys keep their form
+func labelKeyString(key string) string {
+	if strings.ContainsAny(key, `{}=,"\`) {
+		return strconv.Quote(key)
+	}
+
+	return key
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RealIPHeader is the header with the address the agent reports as its own
+const RealIPHeader = "X-Real-IP"
+
+// TrustedSubnets are the subnets the metrics are accepted from
+type TrustedSubnets []*net.IPNet
+
+// ParseTrustedSubnets parses the comma separated list of the subnets in the CIDR notation, e.g. 10.0.0.0/8,fd00::/8
+func ParseTrustedSubnets(value string) (TrustedSubnets, error) {
+	var subnets TrustedSubnets
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the trusted subnet %q: %w", item, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+// Contains reports whether the ip belongs to any of the subnets
+func (s TrustedSubnets) Contains(ip net.IP) bool {
+	for _, subnet := range s {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,15 +1,38 @@
 package utils
 
 import (
+	"context"
 	"os"
 	"time"
 )
 
-func InvokeFunctionWithInterval(duration time.Duration, functionToInvoke func()) {
+// InvokeFunctionWithInterval invokes the function every duration until the context is done.
+func InvokeFunctionWithInterval(ctx context.Context, duration time.Duration, functionToInvoke func()) {
 	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
-		functionToInvoke()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			functionToInvoke()
+		}
+	}
+}
+
+// InvokeFunctionWithDeadline waits for the function until the context is done.
+// If the context is done first, its error is returned and the function keeps running in the background.
+func InvokeFunctionWithDeadline(ctx context.Context, functionToInvoke func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- functionToInvoke()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 